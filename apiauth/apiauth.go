@@ -0,0 +1,221 @@
+// Package apiauth การลงลายมือชื่อคำขอของ smlmarketsync ด้วย HMAC-SHA256 และการตรวจสอบฝั่ง server
+//
+// client ลงลายมือชื่อด้วย Sign ส่วน server ที่รับ /pgselect และ /pgcommand ใช้ Verifier (หรือ Middleware)
+// ตรวจคำขอด้วย secret เดียวกัน ข้อความที่ลงลายมือชื่อประกอบด้วย method, path, เวลา, nonce และ SHA-256 ของ body
+// คำขอที่ถูกแก้ไข, เก่าเกิน MaxSkew หรือใช้ nonce ซ้ำจะถูกปฏิเสธ
+package apiauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// header ที่ Sign เพิ่มให้คำขอ
+const (
+	HeaderKeyID     = "X-SML-Key-Id"
+	HeaderTimestamp = "X-SML-Timestamp" // unix seconds
+	HeaderNonce     = "X-SML-Nonce"
+	HeaderSignature = "X-SML-Signature" // hex ของ HMAC-SHA256
+)
+
+// DefaultMaxSkew ระยะห่างสูงสุดระหว่างเวลาในคำขอกับเวลาของ server
+const DefaultMaxSkew = 5 * time.Minute
+
+// error ที่ Verify คืน (ตรวจด้วย errors.Is)
+var (
+	ErrMissingHeaders = errors.New("apiauth: missing signature headers")
+	ErrUnknownKey     = errors.New("apiauth: unknown key id")
+	ErrExpired        = errors.New("apiauth: timestamp outside allowed window")
+	ErrBadSignature   = errors.New("apiauth: signature mismatch")
+	ErrReplayed       = errors.New("apiauth: nonce already used")
+	ErrBadToken       = errors.New("apiauth: invalid bearer token")
+)
+
+// Sign เพิ่ม header ลายมือชื่อให้ req โดย body ต้องเป็นข้อมูลเดียวกับที่ส่งจริง
+func Sign(req *http.Request, body []byte, keyID string, secret []byte, now time.Time) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("apiauth: cannot generate nonce: %v", err)
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	req.Header.Set(HeaderKeyID, keyID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonceHex)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(signature(secret, req.Method, req.URL.EscapedPath(), timestamp, nonceHex, body)))
+	return nil
+}
+
+// signature HMAC-SHA256 ของ method, path, timestamp, nonce และ SHA-256 ของ body (คั่นด้วยบรรทัดใหม่)
+func signature(secret []byte, method, path, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+	return mac.Sum(nil)
+}
+
+// NonceStore จำ nonce ที่ใช้แล้วจนกว่าจะหมดอายุ
+type NonceStore interface {
+	// Use คืน false ถ้า nonce ของ keyID นี้ถูกใช้ไปแล้วและยังไม่หมดอายุ ณ เวลา now ไม่เช่นนั้นบันทึกไว้ถึง expires
+	// now คือเวลาเดียวกับที่ Verifier ใช้ตรวจ timestamp การหมดอายุของ nonce จึงใช้นาฬิกาเดียวกัน
+	Use(keyID, nonce string, now, expires time.Time) bool
+}
+
+// Verifier ตรวจลายมือชื่อของคำขอ
+type Verifier struct {
+	// Secrets คืน secret ของ key id (false = ไม่รู้จัก)
+	Secrets func(keyID string) ([]byte, bool)
+	// MaxSkew ระยะห่างของเวลาที่ยอมรับ (0 = DefaultMaxSkew)
+	MaxSkew time.Duration
+	// Nonces เก็บ nonce ที่ใช้แล้ว (nil = เก็บใน memory ของ Verifier)
+	Nonces NonceStore
+	// Now เวลาปัจจุบัน (nil = time.Now)
+	Now func() time.Time
+
+	once sync.Once
+}
+
+// NewVerifier สร้าง Verifier จาก secret ของแต่ละ key id
+func NewVerifier(secrets map[string][]byte) *Verifier {
+	return &Verifier{
+		Secrets: func(keyID string) ([]byte, bool) {
+			secret, ok := secrets[keyID]
+			return secret, ok
+		},
+	}
+}
+
+// Verify ตรวจลายมือชื่อ เวลา และ nonce ของคำขอ (body คือข้อมูลที่ได้รับทั้งหมด)
+func (v *Verifier) Verify(req *http.Request, body []byte) error {
+	v.once.Do(func() {
+		if v.Nonces == nil {
+			v.Nonces = NewMemoryNonceStore()
+		}
+	})
+
+	keyID := req.Header.Get(HeaderKeyID)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	signatureHex := req.Header.Get(HeaderSignature)
+	if keyID == "" || timestamp == "" || nonce == "" || signatureHex == "" {
+		return ErrMissingHeaders
+	}
+
+	secret, ok := v.Secrets(keyID)
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrExpired
+	}
+	maxSkew := v.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-maxSkew)) || signedAt.After(now.Add(maxSkew)) {
+		return ErrExpired
+	}
+
+	got, err := hex.DecodeString(signatureHex)
+	if err != nil || !hmac.Equal(got, signature(secret, req.Method, req.URL.EscapedPath(), timestamp, nonce, body)) {
+		return ErrBadSignature
+	}
+
+	// บันทึก nonce หลังตรวจลายมือชื่อแล้ว คำขอปลอมจึงจอง nonce ของคำขอจริงไม่ได้
+	if !v.Nonces.Use(keyID, nonce, now, signedAt.Add(maxSkew)) {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// Middleware ตรวจคำขอก่อนส่งต่อให้ next (ไม่ผ่าน = 401) โดย body ยังอ่านได้ตามปกติใน next
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "cannot read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if err := v.Verify(r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// VerifyBearer ตรวจ header Authorization: Bearer กับ token ที่อนุญาต (เทียบแบบ constant time)
+func VerifyBearer(req *http.Request, tokens ...string) error {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ErrBadToken
+	}
+	given := []byte(strings.TrimPrefix(header, "Bearer "))
+	matched := 0
+	for _, token := range tokens {
+		if token != "" {
+			matched |= subtle.ConstantTimeCompare(given, []byte(token))
+		}
+	}
+	if matched != 1 {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// MemoryNonceStore NonceStore ใน memory ของ process (ใช้ได้เมื่อ server มี instance เดียว)
+type MemoryNonceStore struct {
+	mu       sync.Mutex
+	expires  map[string]time.Time
+	prunedAt time.Time
+}
+
+// NewMemoryNonceStore สร้าง NonceStore ใน memory
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{expires: make(map[string]time.Time)}
+}
+
+// Use บันทึก nonce และลบ nonce ที่หมดอายุแล้ว (ไม่เกินนาทีละครั้ง)
+func (s *MemoryNonceStore) Use(keyID, nonce string, now, expires time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.prunedAt) >= time.Minute || now.Before(s.prunedAt) {
+		for key, expiry := range s.expires {
+			if now.After(expiry) {
+				delete(s.expires, key)
+			}
+		}
+		s.prunedAt = now
+	}
+
+	key := keyID + "\n" + nonce
+	if expiry, used := s.expires[key]; used && !now.After(expiry) {
+		return false
+	}
+	s.expires[key] = expires
+	return true
+}
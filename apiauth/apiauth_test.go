@@ -0,0 +1,211 @@
+package apiauth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testNow    = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+)
+
+func newTestVerifier(now *time.Time) *Verifier {
+	v := NewVerifier(map[string][]byte{"sync": testSecret})
+	v.Now = func() time.Time { return *now }
+	return v
+}
+
+func signedRequest(t *testing.T, path string, body []byte, keyID string, secret []byte, at time.Time) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	if err := Sign(req, body, keyID, secret, at); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"query":"SELECT 1"}`)
+
+	tests := []struct {
+		name    string
+		request func(t *testing.T) (*http.Request, []byte)
+		want    error
+	}{
+		{
+			name: "valid request",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return signedRequest(t, "/v1/pgselect", body, "sync", testSecret, testNow), body
+			},
+		},
+		{
+			name: "tampered body",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return signedRequest(t, "/v1/pgselect", body, "sync", testSecret, testNow), []byte(`{"query":"DELETE FROM ic_balance"}`)
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "tampered path",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				req := signedRequest(t, "/v1/pgselect", body, "sync", testSecret, testNow)
+				req.URL.Path = "/v1/pgcommand"
+				return req, body
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "tampered method",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				req := signedRequest(t, "/v1/pgselect", body, "sync", testSecret, testNow)
+				req.Method = http.MethodPut
+				return req, body
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "wrong secret",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return signedRequest(t, "/v1/pgselect", body, "sync", []byte("another-secret-another-secret-!!"), testNow), body
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "unknown key id",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return signedRequest(t, "/v1/pgselect", body, "other", testSecret, testNow), body
+			},
+			want: ErrUnknownKey,
+		},
+		{
+			name: "signed too long ago",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return signedRequest(t, "/v1/pgselect", body, "sync", testSecret, testNow.Add(-DefaultMaxSkew-time.Second)), body
+			},
+			want: ErrExpired,
+		},
+		{
+			name: "signed in the future",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return signedRequest(t, "/v1/pgselect", body, "sync", testSecret, testNow.Add(DefaultMaxSkew+time.Second)), body
+			},
+			want: ErrExpired,
+		},
+		{
+			name: "clock skew within the window",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return signedRequest(t, "/v1/pgselect", body, "sync", testSecret, testNow.Add(-DefaultMaxSkew+time.Second)), body
+			},
+		},
+		{
+			name: "missing headers",
+			request: func(t *testing.T) (*http.Request, []byte) {
+				return httptest.NewRequest(http.MethodPost, "/v1/pgselect", bytes.NewReader(body)), body
+			},
+			want: ErrMissingHeaders,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := testNow
+			req, received := tt.request(t)
+			err := newTestVerifier(&now).Verify(req, received)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	now := testNow
+	v := newTestVerifier(&now)
+	body := []byte(`{"query":"SELECT 1"}`)
+	req := signedRequest(t, "/v1/pgcommand", body, "sync", testSecret, testNow)
+
+	if err := v.Verify(req, body); err != nil {
+		t.Fatalf("first Verify() error = %v", err)
+	}
+	now = now.Add(time.Minute)
+	if err := v.Verify(req, body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed Verify() error = %v, want %v", err, ErrReplayed)
+	}
+
+	// หลังพ้นช่วงเวลาที่ยอมรับ คำขอเดิมถูกปฏิเสธเพราะหมดอายุ ไม่ใช่ถูกลืม nonce
+	now = testNow.Add(DefaultMaxSkew + time.Minute)
+	if err := v.Verify(req, body); !errors.Is(err, ErrExpired) {
+		t.Errorf("late replay Verify() error = %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestVerifyNonceExpiryUsesVerifierClock(t *testing.T) {
+	// นาฬิกาของ Verifier อยู่ในอดีต nonce ที่ยังไม่หมดอายุตามนาฬิกานี้ต้องยังถูกจำไว้
+	// แม้จะหมดอายุแล้วตามเวลาจริงของเครื่อง
+	signedAt := time.Now().Add(-24 * time.Hour)
+	now := signedAt
+	v := newTestVerifier(&now)
+	body := []byte(`{}`)
+	req := signedRequest(t, "/v1/pgcommand", body, "sync", testSecret, signedAt)
+
+	if err := v.Verify(req, body); err != nil {
+		t.Fatalf("first Verify() error = %v", err)
+	}
+	now = signedAt.Add(2 * time.Minute) // เลยรอบลบ nonce ที่หมดอายุ
+	if err := v.Verify(req, body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed Verify() error = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	now := time.Now()
+	v := newTestVerifier(&now)
+	var received []byte
+	handler := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+
+	body := []byte(`{"query":"SELECT 1"}`)
+	req := signedRequest(t, "/v1/pgselect", body, "sync", testSecret, now)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !bytes.Equal(received, body) {
+		t.Errorf("signed request: status = %d, body = %q", rec.Code, received)
+	}
+
+	tampered := signedRequest(t, "/v1/pgselect", body, "sync", testSecret, now)
+	tampered.Body = io.NopCloser(bytes.NewReader([]byte(`{"query":"SELECT 2"}`)))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, tampered)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("tampered request: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestVerifyBearer(t *testing.T) {
+	tests := []struct {
+		header string
+		want   error
+	}{
+		{"Bearer current", nil},
+		{"Bearer previous", nil},
+		{"Bearer wrong", ErrBadToken},
+		{"Basic current", ErrBadToken},
+		{"", ErrBadToken},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/v1/pgselect", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		if err := VerifyBearer(req, "current", "previous", ""); err != tt.want {
+			t.Errorf("VerifyBearer(%q) error = %v, want %v", tt.header, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"smlmarketsync/apiauth"
+	"time"
+)
+
+// Auth types ของ api.auth.type ใน smlmarketsync.json
+const (
+	AuthNone   = "none"
+	AuthBearer = "bearer"
+	AuthHMAC   = "hmac"
+)
+
+// minHMACSecretLength ความยาวขั้นต่ำของ secret สำหรับ HMAC-SHA256
+const minHMACSecretLength = 32
+
+// Authenticator เพิ่มข้อมูลยืนยันตัวตนให้คำขอก่อนส่ง (body คือข้อมูลที่ส่งจริง)
+// ถูกเรียกทุกครั้งที่ส่ง รวมถึงการส่งซ้ำ ลายมือชื่อจึงไม่ซ้ำกัน
+type Authenticator interface {
+	Authenticate(req *http.Request, body []byte) error
+}
+
+// authType ชนิดการยืนยันตัวตนที่ใช้จริง (ไม่ระบุ type = bearer เมื่อมี token)
+func (a APIAuthConfig) authType() string {
+	if a.Type != "" {
+		return a.Type
+	}
+	if a.Token != "" {
+		return AuthBearer
+	}
+	return AuthNone
+}
+
+// validate ตรวจข้อมูลที่ชนิดการยืนยันตัวตนต้องใช้
+func (a APIAuthConfig) validate() error {
+	switch a.authType() {
+	case AuthNone:
+		if a.Token != "" || a.Secret != "" {
+			return fmt.Errorf("auth.type เป็น \"none\" แต่ระบุ token หรือ secret ไว้ (ตั้ง auth.type เป็น \"bearer\" หรือ \"hmac\")")
+		}
+	case AuthBearer:
+		if a.Token == "" {
+			return fmt.Errorf("auth.type \"bearer\" ต้องระบุ auth.token")
+		}
+	case AuthHMAC:
+		if a.KeyID == "" {
+			return fmt.Errorf("auth.type \"hmac\" ต้องระบุ auth.key_id")
+		}
+		if len(a.Secret) < minHMACSecretLength {
+			return fmt.Errorf("auth.secret ต้องยาวอย่างน้อย %d ตัวอักษร", minHMACSecretLength)
+		}
+	default:
+		return fmt.Errorf("auth.type ไม่ถูกต้อง: %q (ใช้ได้ \"none\", \"bearer\" หรือ \"hmac\")", a.Type)
+	}
+	return nil
+}
+
+// newAuthenticator สร้าง Authenticator ตาม api.auth (nil = ไม่ยืนยันตัวตน)
+func newAuthenticator(a APIAuthConfig) Authenticator {
+	switch a.authType() {
+	case AuthBearer:
+		return BearerAuth(a.Token)
+	case AuthHMAC:
+		return &HMACAuth{KeyID: a.KeyID, Secret: []byte(a.Secret)}
+	default:
+		return nil
+	}
+}
+
+// BearerAuth ส่ง token คงที่ใน header Authorization: Bearer
+type BearerAuth string
+
+func (token BearerAuth) Authenticate(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	return nil
+}
+
+// HMACAuth ลงลายมือชื่อ body ด้วย HMAC-SHA256 พร้อมเวลาและ nonce (server ตรวจด้วย apiauth.Verifier)
+type HMACAuth struct {
+	KeyID  string
+	Secret []byte
+}
+
+func (h *HMACAuth) Authenticate(req *http.Request, body []byte) error {
+	return apiauth.Sign(req, body, h.KeyID, h.Secret, time.Now())
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen คืนเมื่อ circuit breaker เปิดอยู่ (API ล้มเหลวติดกันหลายครั้ง) คำขอจึงไม่ถูกส่ง
+// ผู้เรียกที่วนส่งหลาย batch ควรหยุดทันทีเมื่อพบ error นี้ (ตรวจด้วย errors.Is) แทนการส่ง batch ถัดไป
+var ErrCircuitOpen = errors.New("API circuit breaker is open")
+
+// circuitBreaker นับคำขอที่ล้มเหลวติดกัน (ติดต่อไม่ได้หรือได้ status ที่ส่งซ้ำได้ หลังส่งซ้ำครบแล้ว)
+// เมื่อถึง threshold จะปฏิเสธทุกคำขอเป็นเวลา cooldown แล้วปล่อยคำขอทดลองทีละหนึ่งคำขอ
+// ถ้าคำขอทดลองสำเร็จจะกลับมาส่งตามปกติ ถ้าไม่สำเร็จจะปิดต่ออีก cooldown
+type circuitBreaker struct {
+	threshold int // 0 = ไม่ใช้ circuit breaker
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // มีคำขอทดลองระหว่าง half-open อยู่
+}
+
+func newCircuitBreaker(config APIBreakerConfig) *circuitBreaker {
+	if config.Disabled {
+		return &circuitBreaker{}
+	}
+	return &circuitBreaker{
+		threshold: config.FailureThreshold,
+		cooldown:  time.Duration(config.CooldownSeconds) * time.Second,
+	}
+}
+
+// allow ตรวจว่าส่งคำขอได้หรือไม่ (error = circuit เปิดอยู่)
+// trial = true เมื่อคำขอนี้เป็นคำขอทดลองระหว่าง half-open ซึ่งผู้เรียกต้องส่งคืนให้ record
+func (b *circuitBreaker) allow() (trial bool, err error) {
+	if b.threshold <= 0 {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return false, nil
+	}
+	if remaining := time.Until(b.openUntil); remaining > 0 {
+		return false, fmt.Errorf("%w: API ล้มเหลวติดกัน %d ครั้ง จะลองใหม่ในอีก %s", ErrCircuitOpen, b.failures, remaining.Round(time.Second))
+	}
+	if b.trial {
+		return false, fmt.Errorf("%w: กำลังรอผลคำขอทดลอง", ErrCircuitOpen)
+	}
+	b.trial = true
+	fmt.Println("🔌 circuit breaker: ส่งคำขอทดลองเพื่อตรวจว่า API กลับมาแล้วหรือยัง")
+	return true, nil
+}
+
+// record บันทึกผลของคำขอที่ allow อนุญาต (ok = ได้คำตอบจาก API ตามปกติ)
+// trial คือค่าที่ allow คืนให้คำขอนั้น เฉพาะคำขอทดลองเท่านั้นที่ปลดสถานะรอผลทดลอง
+// คำขอที่ส่งไปก่อน circuit เปิดแล้วเพิ่งเสร็จจึงไม่ทำให้มีคำขอทดลองเพิ่ม
+func (b *circuitBreaker) record(trial bool, ok bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial {
+		b.trial = false
+	}
+	if ok {
+		if b.failures >= b.threshold {
+			fmt.Println("🔌 circuit breaker: API กลับมาแล้ว ส่งคำขอตามปกติ")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if trial || b.failures == b.threshold {
+			fmt.Printf("🔌 circuit breaker เปิด: API ล้มเหลวติดกัน %d ครั้ง หยุดส่งคำขอ %s\n", b.failures, b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// ขั้นตอน: "fail"/"ok" = record ผลคำขอที่ allow ล่าสุดอนุญาต, "cooldown" = ครบเวลา cooldown
+	// "late-fail"/"late-ok" = record ผลของคำขอที่ส่งไปก่อน circuit เปิด (ไม่ใช่คำขอทดลอง)
+	// "allow"/"deny" = เรียก allow แล้วต้องได้ผลตามนั้น
+	tests := []struct {
+		name   string
+		config APIBreakerConfig
+		steps  []string
+	}{
+		{
+			name:   "opens after threshold consecutive failures",
+			config: APIBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"allow", "fail", "allow", "fail", "deny"},
+		},
+		{
+			name:   "success resets the failure count",
+			config: APIBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"fail", "ok", "fail", "allow"},
+		},
+		{
+			name:   "half-open lets a single trial through after cooldown",
+			config: APIBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"fail", "fail", "deny", "cooldown", "allow", "deny"},
+		},
+		{
+			name:   "successful trial closes the circuit",
+			config: APIBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"fail", "fail", "cooldown", "allow", "ok", "allow", "allow"},
+		},
+		{
+			name:   "failed trial reopens for another cooldown",
+			config: APIBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"fail", "fail", "cooldown", "allow", "fail", "deny", "cooldown", "allow"},
+		},
+		{
+			name:   "in-flight failure does not release the pending trial",
+			config: APIBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"fail", "fail", "cooldown", "allow", "late-fail", "cooldown", "deny"},
+		},
+		{
+			name:   "in-flight success closes the circuit without waiting for the trial",
+			config: APIBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"fail", "fail", "cooldown", "allow", "late-ok", "allow", "allow"},
+		},
+		{
+			name:   "disabled breaker never opens",
+			config: APIBreakerConfig{Disabled: true, FailureThreshold: 2, CooldownSeconds: 60},
+			steps:  []string{"fail", "fail", "fail", "allow"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := newCircuitBreaker(tt.config)
+			trial := false
+			for i, step := range tt.steps {
+				switch step {
+				case "fail", "ok":
+					breaker.record(trial, step == "ok")
+					trial = false
+				case "late-fail", "late-ok":
+					breaker.record(false, step == "late-ok")
+				case "cooldown":
+					breaker.openUntil = time.Now().Add(-time.Millisecond)
+				case "allow":
+					allowed, err := breaker.allow()
+					if err != nil {
+						t.Fatalf("step %d: allow() error = %v, want nil", i, err)
+					}
+					trial = allowed
+				case "deny":
+					if _, err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+						t.Fatalf("step %d: allow() error = %v, want ErrCircuitOpen", i, err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -3,10 +3,10 @@ API Client Library for SML Market Sync
 
 Table of Contents:
 ================
-1. Core HTTP Client & Basic Types
+1. Core Client & Basic Types
    - APIClient struct & New function
    - QueryRequest/QueryResponse types
-   - ExecuteSelect/ExecuteCommand/executeQuery
+   - ExecuteSelect/ExecuteCommand (ส่งผ่าน Target ใน target.go)
 
 2. Database Utility Functions
    - CheckTableExists
@@ -46,34 +46,36 @@ Table of Contents:
 package config
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
 	"math"
-	"net/http"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // ================================================================================
-// 1. CORE HTTP CLIENT & BASIC TYPES
+// 1. CORE CLIENT & BASIC TYPES
 // ================================================================================
 
-const (
-	APIBaseURL      = "http://192.168.2.36:8008/v1"
-	SelectEndpoint  = "/pgselect"
-	CommandEndpoint = "/pgcommand"
-)
-
+// APIClient ส่งคำสั่งไปยังฐานข้อมูล marketplace ผ่าน Target (HTTP API หรือ PostgreSQL โดยตรง)
 type APIClient struct {
-	client  *http.Client
-	baseURL string
+	target   Target
+	config   *APIConfig
+	limiters *pipelineLimiters
+
+	// tx ใช้เมื่อเป็น client ของ transaction (ดู BeginTransaction)
+	tx *commandBuffer
 }
 
+// QueryRequest คำขอไปยัง /pgselect และ /pgcommand
+// Query ใช้ placeholder $1, $2, ... อ้างถึงค่าใน Params ตามลำดับ
 type QueryRequest struct {
-	Query string `json:"query"`
+	Query  string        `json:"query"`
+	Params []interface{} `json:"params,omitempty"`
+}
+
+// TransactionRequest คำขอไปยัง /pgtransaction: server รันทุกคำสั่งตามลำดับใน transaction เดียว
+type TransactionRequest struct {
+	Statements []QueryRequest `json:"statements"`
 }
 
 type QueryResponse struct {
@@ -83,71 +85,67 @@ type QueryResponse struct {
 	Error   string      `json:"error,omitempty"`
 }
 
+// NewAPIClient สร้าง client ตาม section "api" และ "target" ใน smlmarketsync.json (ค่าเริ่มต้นคือ HTTP API)
+// ควรสร้างครั้งเดียวแล้วส่งให้ทุก step เพื่อใช้ connection pool เดียวกัน
 func NewAPIClient() *APIClient {
-	return &APIClient{
-		client: &http.Client{
-			Timeout: 120 * time.Second, // เพิ่มเป็น 2 นาที สำหรับ batch ขนาดใหญ่
-		},
-		baseURL: APIBaseURL,
-	}
+	apiConfig := NewAPIConfig()
+	return NewAPIClientWithTarget(newTarget(apiConfig), apiConfig)
 }
 
-// ExecuteSelect ทำการ SELECT query ผ่าน API
-func (api *APIClient) ExecuteSelect(query string) (*QueryResponse, error) {
-	return api.executeQuery(query, SelectEndpoint)
-}
-
-// ExecuteCommand ทำการ execute command (INSERT, UPDATE, DELETE, CREATE, DROP, etc.) ผ่าน API
-func (api *APIClient) ExecuteCommand(query string) (*QueryResponse, error) {
-	return api.executeQuery(query, CommandEndpoint)
-}
-
-func (api *APIClient) executeQuery(query string, endpoint string) (*QueryResponse, error) {
-	reqBody := QueryRequest{Query: query}
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling request: %v", err)
+// NewAPIClientWithTarget สร้าง client ที่ส่งคำสั่งไปยัง target ที่กำหนด (apiConfig = nil ใช้ DefaultAPIConfig)
+func NewAPIClientWithTarget(target Target, apiConfig *APIConfig) *APIClient {
+	if apiConfig == nil {
+		apiConfig = DefaultAPIConfig()
 	}
+	return &APIClient{target: target, config: apiConfig, limiters: &pipelineLimiters{}}
+}
 
-	url := api.baseURL + endpoint
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+// upsertBatchSize จำนวนแถวต่อคำสั่ง upsert ตาม api.batch.upsert (0 = fallback ของตารางนั้น)
+func (api *APIClient) upsertBatchSize(fallback int) int {
+	if api.config.Batch.Upsert > 0 {
+		return api.config.Batch.Upsert
 	}
+	return fallback
+}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	// แสดงข้อมูล URL ที่กำลังเรียก
-	fmt.Printf("กำลังส่งคำขอไปยัง URL: %s\n", url)
-
-	resp, err := api.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error executing request to %s: %v", url, err)
+// deleteBatchSize จำนวนรายการต่อคำสั่ง DELETE ตาม api.batch.delete (0 = fallback ของตารางนั้น)
+func (api *APIClient) deleteBatchSize(fallback int) int {
+	if api.config.Batch.Delete > 0 {
+		return api.config.Batch.Delete
 	}
-	defer resp.Body.Close()
+	return fallback
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
-	}
+// ExecuteSelect ทำการ SELECT query ผ่าน API
+// params คือค่าของ placeholder $1, $2, ... ใน query
+func (api *APIClient) ExecuteSelect(query string, params ...interface{}) (*QueryResponse, error) {
+	return api.target.Select(query, params)
+}
 
-	// แสดงตัวอย่าง response body สำหรับ debug
-	bodySample := string(body)
-	if len(bodySample) > 500 {
-		bodySample = bodySample[:500] + "..."
+// ExecuteCommand ทำการ execute command (INSERT, UPDATE, DELETE, CREATE, DROP, etc.) ผ่าน API
+// params คือค่าของ placeholder $1, $2, ... ใน query
+// ถ้าเป็น client ของ transaction คำสั่งจะถูกเก็บไว้ส่งตอน CommitTransaction
+func (api *APIClient) ExecuteCommand(query string, params ...interface{}) (*QueryResponse, error) {
+	if api.tx != nil {
+		return api.tx.queue(query, params), nil
 	}
-	fmt.Printf("ได้รับการตอบกลับ: %s\n", bodySample)
+	return api.target.Command(query, params)
+}
 
-	var response QueryResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling response: %v\nResponse body: %s", err, bodySample)
+// UseInlineParams บังคับให้แปลง parameter เป็นข้อความ SQL ก่อนส่ง (สำหรับ server ที่รับเฉพาะ query แบบข้อความ)
+// มีผลเฉพาะเมื่อส่งผ่าน HTTP API
+func (api *APIClient) UseInlineParams(enabled bool) {
+	if target, ok := api.target.(*httpTarget); ok {
+		target.inlineParams.Store(enabled)
 	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return &response, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, response.Message)
+// UseAuthenticator เปลี่ยนวิธียืนยันตัวตนของคำขอ (nil = ไม่ยืนยันตัวตน) แทนค่าจาก api.auth
+// ต้องเรียกก่อนเริ่มส่งคำขอ และมีผลเฉพาะเมื่อส่งผ่าน HTTP API
+func (api *APIClient) UseAuthenticator(auth Authenticator) {
+	if target, ok := api.target.(*httpTarget); ok {
+		target.auth = auth
 	}
-	return &response, nil
 }
 
 // ================================================================================
@@ -156,9 +154,9 @@ func (api *APIClient) executeQuery(query string, endpoint string) (*QueryRespons
 
 // CheckTableExists ตรวจสอบว่าตารางมีอยู่หรือไม่
 func (api *APIClient) CheckTableExists(tableName string) (bool, error) {
-	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = '%s')", tableName)
+	query := "SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = $1)"
 
-	resp, err := api.ExecuteSelect(query)
+	resp, err := api.ExecuteSelect(query, tableName)
 	if err != nil {
 		return false, err
 	}
@@ -272,8 +270,15 @@ func (api *APIClient) CreateBalanceTable() error {
 		return err
 	}
 
-	// ถ้ามีตารางอยู่แล้ว ไม่ต้องทำอะไร
+	// ถ้ามีตารางอยู่แล้ว เพิ่มเฉพาะ column ที่ตารางรุ่นเก่ายังไม่มี
 	if exists {
+		resp, err := api.ExecuteCommand("ALTER TABLE ic_balance ADD COLUMN IF NOT EXISTS available_qty NUMERIC(18,3) DEFAULT 0")
+		if err != nil {
+			return err
+		}
+		if !resp.Success {
+			return fmt.Errorf("failed to add available_qty to balance table: %s", resp.Message)
+		}
 		return nil
 	}
 	query := `
@@ -282,6 +287,7 @@ func (api *APIClient) CreateBalanceTable() error {
 		wh_code VARCHAR(50) NOT NULL,
 		unit_code VARCHAR(50) NOT NULL,
 		balance_qty NUMERIC(18,3) DEFAULT 0,
+		available_qty NUMERIC(18,3) DEFAULT 0,
 		PRIMARY KEY (ic_code, wh_code, unit_code)
 	)`
 
@@ -375,215 +381,274 @@ func (api *APIClient) getInventoryCount() (int, error) {
 }
 
 // SyncProductBarcodeData ซิงค์ข้อมูล ProductBarcode จาก local ไปยัง API
-func (api *APIClient) SyncProductBarcodeData(syncIds []int, inserts []interface{}, updates []interface{}, deletes []interface{}) error {
+// deletes เป็น row_order_ref หรือ map ที่มี barcode เดิม ส่วน inserts/updates จะถูก upsert โดยใช้ barcode เป็น key
+// คืนค่า SyncResult ที่บอกว่า row_order_ref ไหน API ไม่ยืนยัน
+func (api *APIClient) SyncProductBarcodeData(inserts []interface{}, updates []interface{}, deletes []interface{}) *SyncResult {
+	result := newSyncResult()
+	if len(inserts) == 0 && len(updates) == 0 && len(deletes) == 0 {
+		fmt.Println("ℹ️ ไม่มีข้อมูล ProductBarcode ที่ต้องดำเนินการ")
+		return result
+	}
+
 	fmt.Printf("=== เริ่มซิงค์ข้อมูล ProductBarcode: %d inserts, %d updates, %d deletes ===\n",
 		len(inserts), len(updates), len(deletes))
 
-	// Handle deletes first
+	// 1. ลบข้อมูลบน server ตาม barcode เดิม (หรือ row_order_ref)
+	deleteCount := 0
 	if len(deletes) > 0 {
-		fmt.Printf("🗑️ กำลังลบข้อมูล ProductBarcode %d รายการ...\n", len(deletes))
-		err := api.executeBatchDeleteProductBarcode(deletes)
-		if err != nil {
-			return fmt.Errorf("error deleting ProductBarcode data: %v", err)
-		}
-		fmt.Printf("✅ ลบข้อมูล ProductBarcode เรียบร้อยแล้ว\n")
+		deleteCount = api.executeBatchDeleteProductBarcode(deletes, api.deleteBatchSize(100), result)
 	}
 
-	// Handle inserts
-	if len(inserts) > 0 {
-		fmt.Printf("📝 กำลังเพิ่มข้อมูล ProductBarcode %d รายการ...\n", len(inserts))
-		err := api.executeBatchInsertProductBarcode(inserts)
-		if err != nil {
-			return fmt.Errorf("error inserting ProductBarcode data: %v", err)
-		}
-		fmt.Printf("✅ เพิ่มข้อมูล ProductBarcode เรียบร้อยแล้ว\n")
+	// 2. upsert ข้อมูลใหม่และข้อมูลที่แก้ไข (key = barcode)
+	upserts := make([]interface{}, 0, len(inserts)+len(updates))
+	upserts = append(upserts, inserts...)
+	upserts = append(upserts, updates...)
+	upsertCount := 0
+	if len(upserts) > 0 {
+		upsertCount = api.executeBatchUpsertProductBarcode(upserts, api.upsertBatchSize(100), result)
 	}
 
-	fmt.Println("✅ ซิงค์ข้อมูล ProductBarcode เสร็จสิ้น")
-	return nil
+	// สรุปผลการดำเนินการ
+	fmt.Printf("\n📊 สรุปการซิงค์ ProductBarcode ic_inventory_barcode:\n")
+	fmt.Printf("   - ลบข้อมูล: %d/%d รายการ\n", deleteCount, len(deletes))
+	fmt.Printf("   - เพิ่ม/แก้ไขข้อมูล: %d/%d รายการ\n", upsertCount, len(upserts))
+	fmt.Printf("   - ส่งไม่สำเร็จ (จะส่งใหม่ตามรอบ retry): %d รายการ\n", result.FailedCount())
+	return result
 }
 
-// executeBatchInsertProductBarcode เพิ่มข้อมูล ProductBarcode แบบ batch
-func (api *APIClient) executeBatchInsertProductBarcode(inserts []interface{}) error {
-	if len(inserts) == 0 {
-		return nil
+// executeBatchUpsertProductBarcode เพิ่มหรือแก้ไขข้อมูล ProductBarcode แบบ batch
+// ถ้า row_order_ref เดิมเคยผูกกับ barcode อื่น (barcode ถูกแก้ไข) จะลบ barcode เก่าออกก่อน
+func (api *APIClient) executeBatchUpsertProductBarcode(items []interface{}, batchSize int, result *SyncResult) int {
+	// barcode ซ้ำใน batch เดียวกันจะทำให้ ON CONFLICT ล้มเหลว จึงเก็บเฉพาะรายการล่าสุดของแต่ละ barcode
+	latest := make(map[string]int)
+	var unique []interface{}
+	for _, item := range items {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok {
+			fmt.Printf("⚠️ ข้ามรายการที่ไม่ใช่ map: %v\n", item)
+			continue
+		}
+		barcode := parseStringValue(itemMap["barcode"])
+		if barcode == "" {
+			fmt.Printf("⚠️ ข้ามรายการที่ไม่มี barcode: %v\n", itemMap)
+			result.markFailed([]interface{}{itemMap}, "ไม่มี barcode")
+			continue
+		}
+		if idx, exists := latest[barcode]; exists {
+			unique[idx] = itemMap
+			continue
+		}
+		latest[barcode] = len(unique)
+		unique = append(unique, itemMap)
 	}
-	var values []string
-	for _, item := range inserts {
-		if itemMap, ok := item.(map[string]interface{}); ok {
-			icCode := fmt.Sprintf("%v", itemMap["ic_code"])
-			barcode := fmt.Sprintf("%v", itemMap["barcode"])
-			name := fmt.Sprintf("%v", itemMap["name"])
-			unitCode := fmt.Sprintf("%v", itemMap["unit_code"])
-			unitName := fmt.Sprintf("%v", itemMap["unit_name"])
-			rowOrderRef := fmt.Sprintf("%v", itemMap["row_order_ref"])
 
-			// Escape single quotes
-			name = strings.ReplaceAll(name, "'", "''")
-			unitName = strings.ReplaceAll(unitName, "'", "''")
+	fmt.Printf("📝 กำลังเพิ่ม/แก้ไขข้อมูล ProductBarcode %d รายการ (batch ละ %d รายการ)\n", len(unique), batchSize)
 
-			value := fmt.Sprintf("('%s', '%s', '%s', '%s', '%s', %s)",
-				icCode, barcode, name, unitCode, unitName, rowOrderRef)
-			values = append(values, value)
+	batchCount := (len(unique) + batchSize - 1) / batchSize
+	totalUpserted := api.runBatches("ic_inventory_barcode", unique, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
+		var rows []batchRow
+		for _, item := range unique[start:end] {
+			itemMap := item.(map[string]interface{})
+			rowOrderRef, ok := itemRowOrderRef(itemMap)
+			if !ok {
+				fmt.Printf("⚠️ ข้ามรายการที่ไม่มี row_order_ref: %v\n", itemMap)
+				continue
+			}
+			barcode := parseStringValue(itemMap["barcode"])
+			rows = append(rows, batchRow{item: itemMap, values: []interface{}{
+				parseStringValue(itemMap["ic_code"]),
+				barcode,
+				parseStringValue(itemMap["name"]),
+				parseStringValue(itemMap["unit_code"]),
+				parseStringValue(itemMap["unit_name"]),
+				rowOrderRef}})
+		}
+		if len(rows) == 0 {
+			return 0
 		}
-	}
-	if len(values) == 0 {
-		return nil
-	}
 
-	query := fmt.Sprintf(`
-		INSERT INTO ic_inventory_barcode (ic_code, barcode, name, unit_code, unit_name, row_order_ref)
-		VALUES %s
-	`, strings.Join(values, ","))
+		// ลบ barcode เก่าของ row_order_ref เดียวกันที่ไม่ตรงกับ barcode ใหม่
+		if err := api.deleteStaleKeys("ic_inventory_barcode", "barcode", rows, 1, 5); err != nil {
+			fmt.Printf("❌ ERROR: ไม่สามารถลบ barcode เก่าของ batch %d ได้: %v\n", b+1, err)
+			batchResult.markError(batchRowItems(rows), err)
+			return 0
+		}
 
-	resp, err := api.ExecuteCommand(query)
-	if err != nil {
-		return fmt.Errorf("error executing batch insert ProductBarcode: %v", err)
-	}
+		// ถ้า server ปฏิเสธ batch จะแบ่งครึ่งเพื่อหาแถวที่ผิด (เช่นชื่อยาวเกิน) แถวอื่นยังถูกบันทึก
+		upserted := api.upsertRows("ic_inventory_barcode", []string{"barcode"}, barcodeColumns, rows, batchResult)
+		if upserted < len(rows) {
+			fmt.Printf("❌ ERROR: เพิ่ม/แก้ไขข้อมูล ProductBarcode (batch %d) ไม่สำเร็จ %d จาก %d รายการ\n", b+1, len(rows)-upserted, len(rows))
+		} else {
+			fmt.Printf("   ✅ เพิ่ม/แก้ไขข้อมูล ProductBarcode batch %d/%d สำเร็จ: %d รายการ\n", b+1, batchCount, upserted)
+		}
+		return upserted
+	})
 
-	if !resp.Success {
-		return fmt.Errorf("batch insert ProductBarcode failed: %s", resp.Message)
-	}
-	return nil
+	fmt.Printf("✅ เพิ่ม/แก้ไขข้อมูล ProductBarcode เรียบร้อยแล้ว: %d จาก %d รายการ\n", totalUpserted, len(unique))
+	return totalUpserted
 }
 
-// executeBatchDeleteProductBarcode ลบข้อมูล ProductBarcode แบบ batch
-func (api *APIClient) executeBatchDeleteProductBarcode(deletes []interface{}) error {
-	if len(deletes) == 0 {
-		return nil
-	}
+// barcodeColumns column ของ ic_inventory_barcode ตามลำดับค่าที่ executeBatchUpsertProductBarcode ส่ง
+var barcodeColumns = []string{"ic_code", "barcode", "name", "unit_code", "unit_name", "row_order_ref"}
 
+// executeBatchDeleteProductBarcode ลบข้อมูล ProductBarcode แบบ batch ตาม barcode (หรือ row_order_ref ถ้าไม่มี snapshot)
+func (api *APIClient) executeBatchDeleteProductBarcode(deletes []interface{}, batchSize int, result *SyncResult) int {
 	fmt.Printf("🗑️ กำลังลบข้อมูล ProductBarcode %d รายการ...\n", len(deletes))
 
-	// แบ่งเป็น batch เพื่อป้องกัน query ยาวเกินไป
-	batchSize := 100
-	totalDeleted := 0
-
-	for i := 0; i < len(deletes); i += batchSize {
-		end := i + batchSize
-		if end > len(deletes) {
-			end = len(deletes)
-		}
-
-		currentBatch := deletes[i:end]
-		var rowOrderRefs []string
+	totalDeleted := api.runBatches("ic_inventory_barcode", deletes, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
+		currentBatch := deletes[start:end]
+		var keys, rowOrderRefs []interface{}
 
-		// สร้างรายการ row_order_ref สำหรับลบ
+		// ลบตาม barcode เดิมจาก snapshot ถ้ามี ไม่เช่นนั้นลบตาม row_order_ref
 		for _, item := range currentBatch {
-			rowOrderRef := fmt.Sprintf("%v", item)
+			if key := parseStringValue(deleteKeyValue(item, "barcode")); key != "" {
+				if _, isMap := item.(map[string]interface{}); isMap {
+					keys = append(keys, key)
+					continue
+				}
+			}
+			rowOrderRef, ok := itemRowOrderRef(item)
+			if !ok {
+				fmt.Printf("⚠️ ข้าม row_order_ref ที่ไม่ถูกต้อง: %v\n", item)
+				continue
+			}
 			rowOrderRefs = append(rowOrderRefs, rowOrderRef)
 		}
 
-		if len(rowOrderRefs) > 0 {
-			query := fmt.Sprintf(`
-				DELETE FROM ic_inventory_barcode 
-				WHERE row_order_ref IN (%s)
-			`, strings.Join(rowOrderRefs, ","))
-
-			resp, err := api.ExecuteCommand(query)
-			if err != nil {
-				fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูล ProductBarcode batch ได้: %v\n", err)
-				continue
-			}
+		if len(keys)+len(rowOrderRefs) == 0 {
+			return 0
+		}
 
-			if !resp.Success {
-				fmt.Printf("⚠️ Warning: ลบข้อมูล ProductBarcode batch ล้มเหลว: %s\n", resp.Message)
-				continue
-			}
+		var params queryParams
+		var conditions []string
+		if len(keys) > 0 {
+			conditions = append(conditions, fmt.Sprintf("barcode IN (%s)", params.list(keys)))
+		}
+		if len(rowOrderRefs) > 0 {
+			conditions = append(conditions, fmt.Sprintf("row_order_ref IN (%s)", params.list(rowOrderRefs)))
+		}
+		query := fmt.Sprintf(`
+			DELETE FROM ic_inventory_barcode 
+			WHERE %s
+		`, strings.Join(conditions, " OR "))
 
-			totalDeleted += len(rowOrderRefs)
-			fmt.Printf("   ✅ ลบข้อมูล ProductBarcode batch สำเร็จ: %d รายการ\n", len(rowOrderRefs))
+		resp, err := api.ExecuteCommand(query, params.values...)
+		if err != nil {
+			fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูล ProductBarcode batch ได้: %v\n", err)
+			batchResult.markError(currentBatch, err)
+			return 0
 		}
 
-		// หน่วงเวลาเล็กน้อยระหว่าง batch
-		if end < len(deletes) {
-			time.Sleep(100 * time.Millisecond)
+		if !resp.Success {
+			fmt.Printf("⚠️ Warning: ลบข้อมูล ProductBarcode batch ล้มเหลว: %s\n", resp.Message)
+			batchResult.markFailed(currentBatch, resp.Message)
+			return 0
 		}
-	}
+
+		fmt.Printf("   ✅ ลบข้อมูล ProductBarcode batch สำเร็จ: %d รายการ\n", len(keys)+len(rowOrderRefs))
+		return len(keys) + len(rowOrderRefs)
+	})
 
 	fmt.Printf("✅ ลบข้อมูล ProductBarcode เรียบร้อยแล้ว: %d รายการ\n", totalDeleted)
-	return nil
+	return totalDeleted
 }
 
 // SyncCustomerData ซิงค์ข้อมูลลูกค้าจาก local ไปยัง API
-func (api *APIClient) SyncCustomerData(inserts []interface{}, updates []interface{}, deletes []interface{}) error {
+// คืนค่า SyncResult ที่บอกว่า row_order_ref ไหน API ไม่ยืนยัน
+func (api *APIClient) SyncCustomerData(inserts []interface{}, updates []interface{}, deletes []interface{}) *SyncResult {
+	result := newSyncResult()
 	fmt.Printf("=== เริ่มซิงค์ข้อมูลลูกค้า: %d inserts, %d updates, %d deletes ===\n",
 		len(inserts), len(updates), len(deletes))
 
 	// Handle deletes first
 	if len(deletes) > 0 {
 		fmt.Printf("🗑️ กำลังลบข้อมูลลูกค้า %d รายการ...\n", len(deletes))
-		err := api.executeBatchDeleteCustomer(deletes)
-		if err != nil {
-			return fmt.Errorf("error deleting customer data: %v", err)
-		}
-		fmt.Printf("✅ ลบข้อมูลลูกค้าเรียบร้อยแล้ว\n")
+		api.executeBatchDeleteCustomer(deletes, result)
 	}
 
-	// Handle inserts
-	if len(inserts) > 0 {
-		fmt.Printf("📝 กำลังเพิ่มข้อมูลลูกค้า %d รายการ...\n", len(inserts))
-		err := api.executeBatchInsertCustomer(inserts)
-		if err != nil {
-			return fmt.Errorf("error inserting customer data: %v", err)
-		}
-		fmt.Printf("✅ เพิ่มข้อมูลลูกค้าเรียบร้อยแล้ว\n")
+	// Handle inserts/updates (upsert ตาม code)
+	upserts := make([]interface{}, 0, len(inserts)+len(updates))
+	upserts = append(upserts, inserts...)
+	upserts = append(upserts, updates...)
+	if len(upserts) > 0 {
+		fmt.Printf("📝 กำลังเพิ่ม/แก้ไขข้อมูลลูกค้า %d รายการ...\n", len(upserts))
+		upserted := api.executeBatchUpsertCustomer(upserts, api.upsertBatchSize(100), result)
+		fmt.Printf("✅ เพิ่ม/แก้ไขข้อมูลลูกค้าเรียบร้อยแล้ว: %d/%d รายการ\n", upserted, len(upserts))
 	}
 
 	fmt.Println("✅ ซิงค์ข้อมูลลูกค้าเสร็จสิ้น")
-	return nil
+	return result
 }
 
-// executeBatchInsertCustomer เพิ่มข้อมูลลูกค้าแบบ batch
-func (api *APIClient) executeBatchInsertCustomer(inserts []interface{}) error {
-	if len(inserts) == 0 {
-		return nil
-	}
-	var values []string
-	for _, item := range inserts {
-		if itemMap, ok := item.(map[string]interface{}); ok {
-			code := fmt.Sprintf("%v", itemMap["code"])
-			priceLevel := fmt.Sprintf("%v", itemMap["price_level"])
-			rowOrderRef := fmt.Sprintf("%v", itemMap["row_order_ref"])
-			// Escape single quotes
-			priceLevel = strings.ReplaceAll(priceLevel, "'", "''")
-			// สร้างค่า value สำหรับ insert
-			// ใช้ row_order_ref เป็น key ในการ insert
-			if rowOrderRef == "" {
-				return fmt.Errorf("row_order_ref is required")
-			}
-			if code == "" {
-				return fmt.Errorf("code is required")
-			}
-			if priceLevel == "" {
-				return fmt.Errorf("price_level is required")
-			}
-			value := fmt.Sprintf("('%s', '%s', '%s')", code, priceLevel, rowOrderRef)
-			values = append(values, value)
+// executeBatchUpsertCustomer เพิ่มหรือแก้ไขข้อมูลลูกค้าแบบ batch ตาม code คืนค่าจำนวนรายการที่สำเร็จ
+// รายการที่ข้อมูลไม่ครบหรือถูก server ปฏิเสธจะถูกบันทึกลง result ทีละรายการ
+// ถ้า code ของ row_order_ref เดิมถูกแก้ไข จะลบแถวของ code เก่าออกก่อน
+func (api *APIClient) executeBatchUpsertCustomer(items []interface{}, batchSize int, result *SyncResult) int {
+	// code ซ้ำใน batch เดียวกันจะทำให้ ON CONFLICT ล้มเหลว จึงเก็บเฉพาะรายการล่าสุดของแต่ละ code
+	latest := make(map[string]int)
+	var unique []interface{}
+	for _, item := range items {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok {
+			fmt.Printf("⚠️ ข้ามรายการที่ไม่ใช่ map: %v\n", item)
+			continue
+		}
+		if _, ok := itemRowOrderRef(itemMap); !ok {
+			fmt.Printf("⚠️ ข้ามรายการที่ไม่มี row_order_ref: %v\n", itemMap)
+			continue
+		}
+		code := parseStringValue(itemMap["code"])
+		if code == "" {
+			result.markFailed([]interface{}{itemMap}, "code is required")
+			continue
+		}
+		if parseStringValue(itemMap["price_level"]) == "" {
+			result.markFailed([]interface{}{itemMap}, "price_level is required")
+			continue
+		}
+		if idx, exists := latest[code]; exists {
+			unique[idx] = itemMap
+			continue
+		}
+		latest[code] = len(unique)
+		unique = append(unique, itemMap)
+	}
+	if len(unique) == 0 {
+		return 0
+	}
+
+	fmt.Printf("📝 กำลังเพิ่ม/แก้ไขข้อมูลลูกค้า %d รายการ (batch ละ %d รายการ)\n", len(unique), batchSize)
+	return api.runBatches("ar_customer", unique, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
+		rows := make([]batchRow, 0, end-start)
+		for _, item := range unique[start:end] {
+			itemMap := item.(map[string]interface{})
+			rowOrderRef, _ := itemRowOrderRef(itemMap)
+			rows = append(rows, batchRow{item: itemMap, values: []interface{}{
+				parseStringValue(itemMap["code"]),
+				parseStringValue(itemMap["price_level"]),
+				rowOrderRef}})
 		}
-	}
-	if len(values) == 0 {
-		return nil
-	}
-
-	query := fmt.Sprintf(`
-		INSERT INTO ar_customer (code, price_level, row_order_ref)
-		VALUES %s
-	`, strings.Join(values, ","))
 
-	resp, err := api.ExecuteCommand(query)
-	if err != nil {
-		return fmt.Errorf("error executing batch insert customer: %v", err)
-	}
+		// ลบ code เก่าของ row_order_ref เดียวกันที่ไม่ตรงกับ code ใหม่
+		if err := api.deleteStaleKeys("ar_customer", "code", rows, 0, 2); err != nil {
+			fmt.Printf("❌ ERROR: ไม่สามารถลบ code เก่าของลูกค้า batch %d ได้: %v\n", b+1, err)
+			batchResult.markError(batchRowItems(rows), err)
+			return 0
+		}
 
-	if !resp.Success {
-		return fmt.Errorf("batch insert customer failed: %s", resp.Message)
-	}
-	return nil
+		upserted := api.upsertRows("ar_customer", []string{"code"}, customerColumns, rows, batchResult)
+		if upserted < len(rows) {
+			fmt.Printf("❌ ERROR: เพิ่ม/แก้ไขข้อมูลลูกค้า (batch %d) ไม่สำเร็จ %d จาก %d รายการ\n", b+1, len(rows)-upserted, len(rows))
+		}
+		return upserted
+	})
 }
 
+// customerColumns column ของ ar_customer ตามลำดับค่าที่ executeBatchUpsertCustomer ส่ง
+var customerColumns = []string{"code", "price_level", "row_order_ref"}
+
 // executeBatchDeleteCustomer ลบข้อมูลลูกค้าแบบ batch
-func (api *APIClient) executeBatchDeleteCustomer(deletes []interface{}) error {
+func (api *APIClient) executeBatchDeleteCustomer(deletes []interface{}, result *SyncResult) error {
 	if len(deletes) == 0 {
 		return nil
 	}
@@ -591,303 +656,72 @@ func (api *APIClient) executeBatchDeleteCustomer(deletes []interface{}) error {
 	fmt.Printf("🗑️ กำลังลบข้อมูลลูกค้า %d รายการ...\n", len(deletes))
 
 	// แบ่งเป็น batch เพื่อป้องกัน query ยาวเกินไป
-	batchSize := 100
-	totalDeleted := 0
-
-	for i := 0; i < len(deletes); i += batchSize {
-		end := i + batchSize
-		if end > len(deletes) {
-			end = len(deletes)
-		}
+	batchSize := api.deleteBatchSize(100)
+	totalDeleted := api.runBatches("ar_customer", deletes, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
+		currentBatch := deletes[start:end]
+		var keys, rowOrderRefs []interface{}
 
-		currentBatch := deletes[i:end]
-		var rowOrderRefs []string
-
-		// สร้างรายการ code สำหรับลบ
+		// ลบตาม code เดิมจาก snapshot ถ้ามี ไม่เช่นนั้นลบตาม row_order_ref
 		for _, item := range currentBatch {
-			code := fmt.Sprintf("'%v'", item) // ใช้ code เป็น key ในการลบ
-			rowOrderRefs = append(rowOrderRefs, code)
-		}
-
-		if len(rowOrderRefs) > 0 {
-			query := fmt.Sprintf(`
-				DELETE FROM ar_customer 
-				WHERE row_order_ref IN (%s)
-			`, strings.Join(rowOrderRefs, ","))
-
-			resp, err := api.ExecuteCommand(query)
-			if err != nil {
-				fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลลูกค้า batch ได้: %v\n", err)
-				continue
+			if key := parseStringValue(deleteKeyValue(item, "code")); key != "" {
+				if _, isMap := item.(map[string]interface{}); isMap {
+					keys = append(keys, key)
+					continue
+				}
 			}
-
-			if !resp.Success {
-				fmt.Printf("⚠️ Warning: ลบข้อมูลลูกค้า batch ล้มเหลว: %s\n", resp.Message)
+			rowOrderRef, ok := itemRowOrderRef(item)
+			if !ok {
+				fmt.Printf("⚠️ ข้าม row_order_ref ที่ไม่ถูกต้อง: %v\n", item)
 				continue
 			}
-
-			totalDeleted += len(rowOrderRefs)
-			fmt.Printf("   ✅ ลบข้อมูลลูกค้า batch สำเร็จ: %d รายการ\n", len(rowOrderRefs))
-		}
-
-		// หน่วงเวลาเล็กน้อยระหว่าง batch
-		if end < len(deletes) {
-			time.Sleep(100 * time.Millisecond)
-		}
-	}
-
-	fmt.Printf("✅ ลบข้อมูลลูกค้าเรียบร้อยแล้ว: %d รายการ\n", totalDeleted)
-	return nil
-}
-
-func (api *APIClient) SyncInventoryBalanceData(data []interface{}) (int, error) {
-	fmt.Printf("🔄 กำลัง sync ข้อมูล balance %d รายการ\n", len(data))
-
-	// ดึงข้อมูลเดิมจาก server มาไว้ใน memory ใช้ API (แบบแบ่งหน้า)
-	fmt.Println("📥 กำลังดึงข้อมูล balance จาก server มาเก็บใน memory")
-	serverDataMap := make(map[string]map[string]interface{})
-
-	batchSize := 10000
-	offset := 0
-	totalFetched := 0
-
-	for {
-		// ดึงข้อมูลครั้งละ 10,000 รายการ
-		query := fmt.Sprintf("SELECT ic_code, wh_code, unit_code, balance_qty FROM ic_balance LIMIT %d OFFSET %d", batchSize, offset)
-		resp, err := api.ExecuteSelect(query)
-
-		if err != nil {
-			if offset == 0 {
-				fmt.Printf("⚠️ Warning: ไม่สามารถดึงข้อมูลจาก server: %v (จะทำการ insert ทั้งหมด)\n", err)
-				break
-			} else {
-				fmt.Printf("⚠️ Warning: Error ดึงข้อมูล batch ที่ offset %d: %v\n", offset, err)
-				break
-			}
-		}
-
-		if !resp.Success || resp.Data == nil {
-			fmt.Printf("📊 ไม่มีข้อมูลเพิ่มเติม หรือ response ไม่สำเร็จ\n")
-			break
-		}
-
-		// Parse ข้อมูลจาก server
-		batchCount := 0
-		if rows, ok := resp.Data.([]interface{}); ok {
-			for _, row := range rows {
-				if rowMap, ok := row.(map[string]interface{}); ok {
-					icCode := fmt.Sprintf("%v", rowMap["ic_code"])
-					whCode := fmt.Sprintf("%v", rowMap["wh_code"])
-					unitCode := fmt.Sprintf("%v", rowMap["unit_code"])
-
-					// สร้าง key สำหรับ map (ic_code + wh_code + unit_code)
-					key := fmt.Sprintf("%s|%s|%s", icCode, whCode, unitCode)
-					serverDataMap[key] = rowMap
-					batchCount++
-				}
-			}
+			rowOrderRefs = append(rowOrderRefs, rowOrderRef)
 		}
 
-		totalFetched += batchCount
-		fmt.Printf("📊 ดึงข้อมูล batch ที่ %d: %d รายการ (รวม %d รายการ)\n", (offset/batchSize)+1, batchCount, totalFetched)
-
-		// ถ้าได้ข้อมูลน้อยกว่า batchSize แสดงว่าหมดแล้ว
-		if batchCount < batchSize {
-			break
+		if len(keys)+len(rowOrderRefs) == 0 {
+			return 0
 		}
 
-		offset += batchSize
-		time.Sleep(200 * time.Millisecond)
-	}
-
-	fmt.Printf("📊 ดึงข้อมูลจาก server เสร็จสิ้น: %d รายการทั้งหมด\n", totalFetched)
-	// สร้าง map สำหรับข้อมูล local
-	localDataMap := make(map[string]map[string]interface{})
-	for _, item := range data {
-		if itemMap, ok := item.(map[string]interface{}); ok {
-			icCode := fmt.Sprintf("%v", itemMap["ic_code"])
-			// ตรวจสอบชื่อฟิลด์ warehouse หรือ wh_code
-			whCode := ""
-			if whCodeVal, exists := itemMap["wh_code"]; exists {
-				whCode = fmt.Sprintf("%v", whCodeVal)
-			} else if warehouseVal, exists := itemMap["warehouse"]; exists {
-				whCode = fmt.Sprintf("%v", warehouseVal)
-			}
-			// ตรวจสอบชื่อฟิลด์ unit_code หรือ ic_unit_code
-			unitCode := ""
-			if unitCodeVal, exists := itemMap["unit_code"]; exists {
-				unitCode = fmt.Sprintf("%v", unitCodeVal)
-			} else if icUnitCodeVal, exists := itemMap["ic_unit_code"]; exists {
-				unitCode = fmt.Sprintf("%v", icUnitCodeVal)
-			} // ข้าม record ที่มีข้อมูลไม่ครบ
-			if icCode == "<nil>" || icCode == "" || whCode == "<nil>" || whCode == "" || unitCode == "<nil>" || unitCode == "" {
-				continue
-			}
-
-			key := fmt.Sprintf("%s|%s|%s", icCode, whCode, unitCode)
-			// สร้าง normalized item สำหรับการ sync
-			normalizedItem := map[string]interface{}{
-				"ic_code":     icCode,
-				"wh_code":     whCode,
-				"unit_code":   unitCode,
-				"balance_qty": itemMap["balance_qty"],
-			}
-			localDataMap[key] = normalizedItem
-		}
-	}
-
-	// เปรียบเทียบข้อมูลและแยกประเภท insert/update/delete
-	var insertsData []map[string]interface{}
-	var updatesData []map[string]interface{}
-	var deletesKeys []string
-	// ตรวจสอบข้อมูลใน local เปรียบเทียบกับ server
-	for key, localItem := range localDataMap {
-		if serverData, exists := serverDataMap[key]; exists {
-			// มีข้อมูลทั้งใน local และ server - ตรวจสอบการเปลี่ยนแปลง
-			serverIcCode := fmt.Sprintf("%v", serverData["ic_code"])
-			serverWhCode := fmt.Sprintf("%v", serverData["wh_code"])
-			serverUnitCode := fmt.Sprintf("%v", serverData["unit_code"])
-
-			newIcCode := fmt.Sprintf("%v", localItem["ic_code"])
-			newWhCode := fmt.Sprintf("%v", localItem["wh_code"])
-			newUnitCode := fmt.Sprintf("%v", localItem["unit_code"])
-
-			// แปลง balance_qty เป็นตัวเลขเพื่อเปรียบเทียบ
-			serverBalanceQtyFloat, serverErr := strconv.ParseFloat(fmt.Sprintf("%v", serverData["balance_qty"]), 64)
-			localBalanceQtyFloat, localErr := strconv.ParseFloat(fmt.Sprintf("%v", localItem["balance_qty"]), 64)
-
-			balanceQtyChanged := false
-			if serverErr != nil || localErr != nil {
-				// ถ้าแปลงไม่ได้ ให้เปรียบเทียบเป็น string
-				balanceQtyChanged = fmt.Sprintf("%v", serverData["balance_qty"]) != fmt.Sprintf("%v", localItem["balance_qty"])
-			} else {
-				// เปรียบเทียบเป็นตัวเลข (ใช้ความแม่นยำ 0.001)
-				balanceQtyChanged = math.Abs(serverBalanceQtyFloat-localBalanceQtyFloat) > 0.001
-			}
-
-			// ตรวจสอบการเปลี่ยนแปลงในทั้ง 4 ฟิลด์
-			if serverIcCode != newIcCode ||
-				serverWhCode != newWhCode ||
-				serverUnitCode != newUnitCode ||
-				balanceQtyChanged {
-				// ข้อมูลเปลี่ยนแปลง ต้อง update
-				updatesData = append(updatesData, localItem)
-			}
-		} else {
-			// มีใน local แต่ไม่มีใน server - ต้อง insert
-			insertsData = append(insertsData, localItem)
+		var params queryParams
+		var conditions []string
+		if len(keys) > 0 {
+			conditions = append(conditions, fmt.Sprintf("code IN (%s)", params.list(keys)))
 		}
-	} // ตรวจสอบข้อมูลใน server ที่ไม่มีใน local - ต้อง delete
-	for key := range serverDataMap {
-		if _, exists := localDataMap[key]; !exists {
-			// มีใน server แต่ไม่มีใน local - ต้อง delete
-			deletesKeys = append(deletesKeys, key)
+		if len(rowOrderRefs) > 0 {
+			conditions = append(conditions, fmt.Sprintf("row_order_ref IN (%s)", params.list(rowOrderRefs)))
 		}
-	}
-
-	fmt.Printf("📋 การวิเคราะห์ข้อมูล: Insert %d รายการ, Update %d รายการ, Delete %d รายการ\n",
-		len(insertsData), len(updatesData), len(deletesKeys))
-
-	successCount := 0
-
-	// ทำการ DELETE ข้อมูลที่ไม่มีใน local
-	if len(deletesKeys) > 0 {
-		fmt.Printf("🗑️ กำลังลบข้อมูลที่ไม่มีใน local %d รายการ\n", len(deletesKeys))
-		deleteCount := 0
-		for i, key := range deletesKeys {
-			parts := strings.Split(key, "|")
-			if len(parts) == 3 {
-				icCode := parts[0]
-				whCode := parts[1]
-				unitCode := parts[2]
-				deleteQuery := fmt.Sprintf("DELETE FROM ic_balance WHERE ic_code = '%s' AND wh_code = '%s' AND unit_code = '%s'", icCode, whCode, unitCode)
-
-				resp, err := api.ExecuteCommand(deleteQuery)
-				if err != nil {
-					fmt.Printf("❌ Error deleting record %d: %v\n", i+1, err)
-					continue
-				}
-
-				if !resp.Success {
-					fmt.Printf("❌ Failed to delete record %d: %s\n", i+1, resp.Message)
-					continue
-				}
+		query := fmt.Sprintf(`
+			DELETE FROM ar_customer 
+			WHERE %s
+		`, strings.Join(conditions, " OR "))
 
-				deleteCount++
-				if (i+1)%100 == 0 {
-					fmt.Printf("⏳ Delete แล้ว %d/%d รายการ\n", i+1, len(deletesKeys))
-				}
-			}
+		resp, err := api.ExecuteCommand(query, params.values...)
+		if err != nil {
+			fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลลูกค้า batch ได้: %v\n", err)
+			batchResult.markError(currentBatch, err)
+			return 0
 		}
-		fmt.Printf("✅ Delete เสร็จสิ้น: %d รายการสำเร็จ\n", deleteCount)
-		successCount += deleteCount
-	}
-	// ทำการ INSERT ข้อมูลใหม่
-	if len(insertsData) > 0 {
-		fmt.Printf("➕ กำลัง insert ข้อมูลใหม่ %d รายการ\n", len(insertsData))
-		insertCount := 0
-		for i, itemMap := range insertsData {
-			icCode := fmt.Sprintf("%v", itemMap["ic_code"])
-			whCode := fmt.Sprintf("%v", itemMap["wh_code"])
-			unitCode := fmt.Sprintf("%v", itemMap["unit_code"])
-			balanceQty := fmt.Sprintf("%v", itemMap["balance_qty"])
-
-			if i < 5 { // แสดงข้อมูลตัวอย่าง 5 รายการแรก
-				fmt.Printf("📝 กำลัง insert: ic_code='%s', wh_code='%s', unit_code='%s', balance_qty=%s\n", icCode, whCode, unitCode, balanceQty)
-			}
-
-			insertQuery := fmt.Sprintf("INSERT INTO ic_balance (ic_code, wh_code, unit_code, balance_qty) VALUES ('%s', '%s', '%s', %s)", icCode, whCode, unitCode, balanceQty)
-
-			resp, err := api.ExecuteCommand(insertQuery)
-			if err != nil {
-				fmt.Printf("❌ Error inserting record %d: %v\n", i+1, err)
-				continue
-			}
-
-			if !resp.Success {
-				fmt.Printf("❌ Failed to insert record %d: %s\n", i+1, resp.Message)
-				continue
-			}
 
-			insertCount++
-			if (i+1)%100 == 0 {
-				fmt.Printf("⏳ Insert แล้ว %d/%d รายการ\n", i+1, len(insertsData))
-			}
+		if !resp.Success {
+			fmt.Printf("⚠️ Warning: ลบข้อมูลลูกค้า batch ล้มเหลว: %s\n", resp.Message)
+			batchResult.markFailed(currentBatch, resp.Message)
+			return 0
 		}
-		fmt.Printf("✅ Insert เสร็จสิ้น: %d รายการสำเร็จ\n", insertCount)
-		successCount += insertCount
-	}
-
-	// ทำการ UPDATE ข้อมูลที่เปลี่ยนแปลง
-	if len(updatesData) > 0 {
-		fmt.Printf("🔄 กำลัง update ข้อมูลที่เปลี่ยนแปลง %d รายการ\n", len(updatesData))
-		updateCount := 0
-		for i, itemMap := range updatesData {
-			icCode := fmt.Sprintf("%v", itemMap["ic_code"])
-			whCode := fmt.Sprintf("%v", itemMap["wh_code"])
-			unitCode := fmt.Sprintf("%v", itemMap["unit_code"])
-			balanceQty := fmt.Sprintf("%v", itemMap["balance_qty"])
-			updateQuery := fmt.Sprintf("UPDATE ic_balance SET balance_qty = %s WHERE ic_code = '%s' AND wh_code = '%s' AND unit_code = '%s'", balanceQty, icCode, whCode, unitCode)
 
-			resp, err := api.ExecuteCommand(updateQuery)
-			if err != nil {
-				fmt.Printf("❌ Error updating record %d: %v\n", i+1, err)
-				continue
-			}
+		fmt.Printf("   ✅ ลบข้อมูลลูกค้า batch สำเร็จ: %d รายการ\n", len(keys)+len(rowOrderRefs))
+		return len(keys) + len(rowOrderRefs)
+	})
 
-			if !resp.Success {
-				fmt.Printf("❌ Failed to update record %d: %s\n", i+1, resp.Message)
-				continue
-			}
+	fmt.Printf("✅ ลบข้อมูลลูกค้าเรียบร้อยแล้ว: %d รายการ\n", totalDeleted)
+	return nil
+}
 
-			updateCount++
-			if (i+1)%100 == 0 {
-				fmt.Printf("⏳ Update แล้ว %d/%d รายการ\n", i+1, len(updatesData))
-			}
-		}
-		fmt.Printf("✅ Update เสร็จสิ้น: %d รายการสำเร็จ\n", updateCount)
-		successCount += updateCount
+// balanceQtyChanged เปรียบเทียบจำนวนจาก server และ local เป็นตัวเลข (ใช้ความแม่นยำ 0.001)
+// ถ้าแปลงเป็นตัวเลขไม่ได้ ให้เปรียบเทียบเป็น string
+func balanceQtyChanged(serverQty, localQty interface{}) bool {
+	serverQtyFloat, serverErr := strconv.ParseFloat(fmt.Sprintf("%v", serverQty), 64)
+	localQtyFloat, localErr := strconv.ParseFloat(fmt.Sprintf("%v", localQty), 64)
+	if serverErr != nil || localErr != nil {
+		return fmt.Sprintf("%v", serverQty) != fmt.Sprintf("%v", localQty)
 	}
-	fmt.Printf("🎉 Sync balance เสร็จสิ้นทั้งหมด: %d รายการสำเร็จ (Delete: %d, Insert: %d, Update: %d)\n", successCount, len(deletesKeys), len(insertsData), len(updatesData))
-	return successCount, nil
+	return math.Abs(serverQtyFloat-localQtyFloat) > 0.001
 }
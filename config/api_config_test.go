@@ -0,0 +1,69 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIRetryConfigBackoff(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name       string
+		retry      APIRetryConfig
+		attempt    int
+		retryAfter time.Duration
+		min, max   time.Duration // jitter ลดได้ไม่เกินครึ่งหนึ่ง
+	}{
+		{
+			name:    "first retry uses delay_ms",
+			retry:   APIRetryConfig{DelayMs: 100, MaxDelayMs: 10000},
+			attempt: 1,
+			min:     50 * ms, max: 100 * ms,
+		},
+		{
+			name:    "delay doubles on each attempt",
+			retry:   APIRetryConfig{DelayMs: 100, MaxDelayMs: 10000},
+			attempt: 3,
+			min:     200 * ms, max: 400 * ms,
+		},
+		{
+			name:    "delay is capped at max_delay_ms before jitter",
+			retry:   APIRetryConfig{DelayMs: 100, MaxDelayMs: 1000},
+			attempt: 10,
+			min:     500 * ms, max: 1000 * ms,
+		},
+		{
+			name:       "retry-after longer than the delay is honoured",
+			retry:      APIRetryConfig{DelayMs: 100, MaxDelayMs: 10000},
+			attempt:    1,
+			retryAfter: 3 * time.Second,
+			min:        3 * time.Second, max: 3 * time.Second,
+		},
+		{
+			name:       "retry-after is clamped to max_delay_ms",
+			retry:      APIRetryConfig{DelayMs: 100, MaxDelayMs: 5000},
+			attempt:    1,
+			retryAfter: time.Minute,
+			min:        5 * time.Second, max: 5 * time.Second,
+		},
+		{
+			name:    "zero delay_ms does not wait",
+			retry:   APIRetryConfig{MaxDelayMs: 1000},
+			attempt: 2,
+			min:     0, max: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// jitter สุ่มทุกครั้ง จึงตรวจหลายรอบ
+			for i := 0; i < 200; i++ {
+				got := tt.retry.backoff(tt.attempt, tt.retryAfter)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("backoff(%d, %s) = %s, want between %s and %s", tt.attempt, tt.retryAfter, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
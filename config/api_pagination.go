@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultSelectPageSize จำนวนแถวต่อหน้าของ SelectPages เมื่อไม่ได้ระบุ
+const DefaultSelectPageSize = 10000
+
+// PagedSelect คำสั่ง select แบบแบ่งหน้าตาม key (keyset pagination)
+type PagedSelect struct {
+	Table      string        // ชื่อตาราง
+	Columns    []string      // column ที่ต้องการ (ต้องรวม KeyColumns)
+	KeyColumns []string      // column ที่ไม่ซ้ำกันและไม่เป็น NULL ใช้เรียงและแบ่งหน้า เช่น primary key
+	Filter     string        // เงื่อนไข WHERE เพิ่มเติม (ว่าง = ทั้งตาราง) ใช้ $1, $2, ... ตาม Params
+	Params     []interface{} // ค่าของ parameter ใน Filter
+	PageSize   int           // จำนวนแถวต่อหน้า (0 = DefaultSelectPageSize)
+
+	// KeyCollation collation ที่ใช้เรียงและเทียบ key (เช่น "C" ให้ลำดับตรงกับการเทียบ string ของ Go) ว่าง = ของฐานข้อมูล
+	KeyCollation string
+}
+
+// SelectPages ดึงแถวของ q.Table ทีละหน้าเรียงตาม q.KeyColumns แล้วเรียก handle กับแต่ละหน้า
+// หน้าถัดไปเริ่มจาก key ของแถวสุดท้ายของหน้าก่อน (WHERE (key) > (...)) แทน OFFSET
+// จึงไม่ข้ามหรือซ้ำแถวเมื่อตารางเปลี่ยนระหว่างดึง และหน้าลึก ๆ ก็เร็วเท่าหน้าแรก
+// ผู้เรียกเก็บเฉพาะสิ่งที่ต้องการจากแต่ละหน้า ไม่ต้องเก็บทั้งตารางไว้ใน memory
+// แต่ละหน้านับเป็นหนึ่งคำขอใน requests_per_second ของ q.Table (ใช้ร่วมกับ batch ที่ส่งไปตารางเดียวกัน)
+// ถ้า handle คืน error จะหยุดดึงและคืน error นั้น
+func (api *APIClient) SelectPages(q PagedSelect, handle func(page []map[string]interface{}) error) error {
+	if len(q.KeyColumns) == 0 {
+		return fmt.Errorf("paged select on %s requires key columns", q.Table)
+	}
+	pageSize := q.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultSelectPageSize
+	}
+
+	keys := make([]string, len(q.KeyColumns))
+	for i, column := range q.KeyColumns {
+		keys[i] = column
+		if q.KeyCollation != "" {
+			keys[i] = fmt.Sprintf(`%s COLLATE "%s"`, column, q.KeyCollation)
+		}
+	}
+	keyList := strings.Join(keys, ", ")
+	limiter := api.limiters.get(q.Table, api.config.Pipeline.limits(q.Table))
+	var lastKey []interface{}
+
+	for page := 1; ; page++ {
+		var conditions []string
+		if q.Filter != "" {
+			conditions = append(conditions, "("+q.Filter+")")
+		}
+		params := queryParams{values: append([]interface{}{}, q.Params...)}
+		if lastKey != nil {
+			conditions = append(conditions, fmt.Sprintf("(%s) > %s", keyList, params.row(lastKey...)))
+		}
+
+		where := ""
+		if len(conditions) > 0 {
+			where = "WHERE " + strings.Join(conditions, " AND ")
+		}
+		query := fmt.Sprintf("SELECT %s FROM %s %s ORDER BY %s LIMIT %s",
+			strings.Join(q.Columns, ", "), q.Table, where, keyList, params.add(pageSize))
+
+		limiter.wait()
+		resp, err := api.ExecuteSelect(query, params.values...)
+		if err != nil {
+			return fmt.Errorf("error selecting page %d of %s: %w", page, q.Table, err)
+		}
+		if !resp.Success {
+			return fmt.Errorf("error selecting page %d of %s: %s", page, q.Table, resp.Message)
+		}
+
+		var rows []map[string]interface{}
+		if data, ok := resp.Data.([]interface{}); ok {
+			for _, row := range data {
+				if rowMap, ok := row.(map[string]interface{}); ok {
+					rows = append(rows, rowMap)
+				}
+			}
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		if err := handle(rows); err != nil {
+			return err
+		}
+
+		// ถ้าได้ข้อมูลน้อยกว่า pageSize แสดงว่าหมดแล้ว
+		if len(rows) < pageSize {
+			return nil
+		}
+
+		last := rows[len(rows)-1]
+		lastKey = make([]interface{}, len(q.KeyColumns))
+		for i, column := range q.KeyColumns {
+			lastKey[i] = last[column]
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"smlmarketsync/types"
+)
+
+// commandBuffer เก็บคำสั่งพร้อม parameter ตามลำดับที่เรียก ExecuteCommand
+type commandBuffer struct {
+	mu         sync.Mutex
+	statements []TxStatement
+}
+
+// BeginTransaction คืน APIClient ที่ ExecuteCommand จะเก็บคำสั่งไว้แทนการส่งทันที (ExecuteSelect ยังส่งตามปกติ)
+// เมื่อเรียก CommitTransaction คำสั่งทั้งหมดจะถูกส่งด้วย Target.Tx ปลายทางจึงรันทุกคำสั่งใน transaction เดียวกัน
+// การเปลี่ยนแปลงบน server จะเห็นพร้อมกันทั้งหมด หรือไม่มีเลยถ้าคำสั่งใดล้มเหลว
+func (api *APIClient) BeginTransaction() *APIClient {
+	return &APIClient{
+		target:   api.target,
+		config:   api.config,
+		limiters: api.limiters,
+		tx:       &commandBuffer{},
+	}
+}
+
+// CommitTransaction ส่งคำสั่งที่เก็บไว้ทั้งหมดใน transaction เดียว
+func (api *APIClient) CommitTransaction() error {
+	resp, err := api.commitTransaction()
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("transaction failed: %s", resp.Message)
+	}
+	return nil
+}
+
+// RollbackTransaction ยกเลิกคำสั่งที่เก็บไว้โดยไม่ส่งไปยัง server
+func (api *APIClient) RollbackTransaction() {
+	if api.tx == nil {
+		return
+	}
+	api.tx.mu.Lock()
+	api.tx.statements = nil
+	api.tx.mu.Unlock()
+}
+
+// TxLoader อ่านรายการเพิ่ม แก้ไข และลบของ records จากต้นทาง (รายการต้องมี row_order_ref)
+type TxLoader func(records []types.SyncRecord) (inserts []interface{}, updates []interface{}, deletes []interface{}, err error)
+
+// TxSyncer ส่งรายการเพิ่ม แก้ไข และลบด้วย api (เช่น (*APIClient).SyncPriceData)
+type TxSyncer func(api *APIClient, inserts []interface{}, updates []interface{}, deletes []interface{}) *SyncResult
+
+// txGroup คำสั่งของ record หนึ่งแถวที่เก็บไว้ตอนหาแถวที่ผิด
+type txGroup struct {
+	record     types.SyncRecord
+	statements []TxStatement
+	result     *SyncResult
+}
+
+// ApplySyncChangesInTransaction ส่งรายการสุทธิทั้งหมดของ changes ใน transaction เดียว
+// step เรียกกับแถวที่จองไว้ทั้งชุด การเปลี่ยนแปลงของชุดนั้นจึงปรากฏบน server พร้อมกันทั้งหมด หรือไม่มีเลย
+// คำสั่งถูกเก็บทีละ batch ตาม planSyncBatches ลำดับเหตุการณ์ของ key เดียวกันจึงยังถูกต้องภายใน transaction
+// ถ้า server ปฏิเสธ transaction หรือ sync ปฏิเสธบางรายการเองซึ่ง batch ถัดไปที่ใช้ key เดียวกันต้องรอ
+// จะไม่มีการเปลี่ยนแปลงใดเกิดขึ้น แล้วส่งใหม่ด้วย ApplySyncChanges ทีละ batch ผ่าน ApplyInTransaction เพื่อหาแถวที่ผิด
+// การส่งใหม่ใช้ข้อมูลที่อ่านไว้แล้ว ไม่อ่านต้นทางซ้ำ ถ้า circuit breaker เปิดอยู่ทุกรายการถูกบันทึกเป็น skipped แล้วคืน ErrCircuitOpen
+func (api *APIClient) ApplySyncChangesInTransaction(changes []types.SyncRecord, keyColumn string, load TxLoader, sync TxSyncer) (*SyncResult, error) {
+	batches := planSyncBatches(changes, keyColumn)
+	if len(batches) > 1 {
+		fmt.Printf("🧩 เก็บคำสั่ง %d ชุดตามลำดับเหตุการณ์ไว้ใน transaction เดียว (มี key ซ้ำกันระหว่างแถว)\n", len(batches))
+	}
+
+	tx := api.BeginTransaction()
+	result := newSyncResult()
+	var inserts, updates, deletes []interface{}
+	for _, batch := range batches {
+		batchInserts, batchUpdates, batchDeletes, err := load(batch)
+		if err != nil {
+			tx.RollbackTransaction()
+			return skippedRecords(changes, err), err
+		}
+		inserts = append(inserts, batchInserts...)
+		updates = append(updates, batchUpdates...)
+		deletes = append(deletes, batchDeletes...)
+		result.merge(sync(tx, batchInserts, batchUpdates, batchDeletes))
+	}
+
+	if result.FailedCount() == 0 || len(batches) == 1 {
+		resp, err := tx.commitTransaction()
+		if err == nil && resp.Success {
+			return result, nil
+		}
+		if errors.Is(err, ErrCircuitOpen) {
+			return skippedRecords(changes, err), err
+		}
+		fmt.Printf("❌ ERROR: transaction ของ %d รายการล้มเหลว ไม่มีการเปลี่ยนแปลงบน server: %s\n", len(changes), transactionMessage(resp, err))
+	} else {
+		tx.RollbackTransaction()
+	}
+
+	// รายการของแต่ละ batch อ่านจากข้อมูลที่ load คืนไว้แล้ว (row_order_ref ไม่ซ้ำกันหลัง CoalesceSyncRecords)
+	loaded := func(records []types.SyncRecord) ([]interface{}, []interface{}, []interface{}, error) {
+		refs := make(map[int]bool, len(records))
+		for _, record := range records {
+			refs[record.RowOrderRef] = true
+		}
+		return itemsOfRefs(inserts, refs), itemsOfRefs(updates, refs), itemsOfRefs(deletes, refs), nil
+	}
+	return ApplySyncChanges(changes, keyColumn, func(batch []types.SyncRecord) (*SyncResult, error) {
+		return api.ApplyInTransaction(batch, loaded, sync)
+	})
+}
+
+// ApplyInTransaction ส่งรายการของ records ใน transaction เดียวด้วย applyTransaction
+// ถ้าคืน error (เช่น circuit breaker เปิด) ทุกแถวใน records ถูกบันทึกเป็น skipped แล้วคืน result พร้อม error
+func (api *APIClient) ApplyInTransaction(records []types.SyncRecord, load TxLoader, sync TxSyncer) (*SyncResult, error) {
+	result, err := api.applyTransaction(records, load, sync)
+	if err != nil {
+		return skippedRecords(records, err), err
+	}
+	return result, nil
+}
+
+// applyTransaction อ่านข้อมูลของ records ด้วย load ครั้งเดียว แล้วส่งด้วย sync ผ่าน APIClient แบบ transaction
+// คำสั่งทั้งหมดของ records ถูกส่งในครั้งเดียว ถ้า server ปฏิเสธ transaction จะไม่มีการเปลี่ยนแปลงใดเกิดขึ้น
+// จากนั้นจะเก็บคำสั่งของแต่ละแถวแยกกัน (จากข้อมูลที่อ่านไว้แล้ว ไม่อ่านต้นทางซ้ำ) แล้วแบ่งครึ่งส่งเป็น transaction ใหม่
+// จนเหลือแถวที่ผิดจริง (แบบเดียวกับ executeBatchBisect) แถวอื่นจึงยังถูกบันทึก ส่วนแถวที่ผิดถูกบันทึกลง result
+// ถ้าติดต่อ server ไม่ได้ ทุกแถวใน records ถูกบันทึกว่าส่งไม่สำเร็จ และถ้า circuit breaker เปิดอยู่จะคืน ErrCircuitOpen
+func (api *APIClient) applyTransaction(records []types.SyncRecord, load TxLoader, sync TxSyncer) (*SyncResult, error) {
+	inserts, updates, deletes, err := load(records)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := api.BeginTransaction()
+	result := sync(tx, inserts, updates, deletes)
+	resp, err := tx.commitTransaction()
+	if err == nil && resp.Success {
+		return result, nil
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		// API ล่มอยู่ หยุดส่ง records ที่เหลือแทนการแบ่งครึ่งต่อ (ผู้เรียกปลดการจองไว้ส่งรอบหน้า)
+		return nil, err
+	}
+
+	message := transactionMessage(resp, err)
+	fmt.Printf("❌ ERROR: transaction ของ %d รายการล้มเหลว ไม่มีการเปลี่ยนแปลงบน server: %s\n", len(records), message)
+	if resp == nil || len(records) == 1 {
+		return failedRecords(records, message), nil
+	}
+
+	fmt.Printf("   🔍 เก็บคำสั่งของแต่ละรายการเพื่อหาแถวที่ผิด\n")
+	groups := make([]txGroup, len(records))
+	for i, record := range records {
+		tx := api.BeginTransaction()
+		ref := record.RowOrderRef
+		groups[i] = txGroup{
+			record: record,
+			result: sync(tx, itemsOfRef(inserts, ref), itemsOfRef(updates, ref), itemsOfRef(deletes, ref)),
+		}
+		groups[i].statements = tx.tx.statements
+	}
+	return api.bisectGroups(groups)
+}
+
+// bisectGroups แบ่ง groups ครึ่งหนึ่งแล้วส่งแต่ละครึ่งเป็น transaction ใหม่ด้วย commitGroups
+func (api *APIClient) bisectGroups(groups []txGroup) (*SyncResult, error) {
+	mid := len(groups) / 2
+	fmt.Printf("   🔍 แบ่งเป็น %d + %d รายการเพื่อหาแถวที่ผิด\n", mid, len(groups)-mid)
+	left, err := api.commitGroups(groups[:mid])
+	if err != nil {
+		return nil, err
+	}
+	right, err := api.commitGroups(groups[mid:])
+	if err != nil {
+		return nil, err
+	}
+	left.merge(right)
+	return left, nil
+}
+
+// commitGroups ส่งคำสั่งที่เก็บไว้ของ groups ใน transaction เดียว ถ้าถูกปฏิเสธจะแบ่งครึ่งต่อจนเหลือแถวที่ผิด
+func (api *APIClient) commitGroups(groups []txGroup) (*SyncResult, error) {
+	var statements []TxStatement
+	result := newSyncResult()
+	records := make([]types.SyncRecord, len(groups))
+	for i, group := range groups {
+		statements = append(statements, group.statements...)
+		result.merge(group.result)
+		records[i] = group.record
+	}
+
+	resp, err := api.sendTransaction(statements)
+	if err == nil && resp.Success {
+		return result, nil
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return nil, err
+	}
+
+	message := transactionMessage(resp, err)
+	fmt.Printf("❌ ERROR: transaction ของ %d รายการล้มเหลว ไม่มีการเปลี่ยนแปลงบน server: %s\n", len(groups), message)
+	if resp == nil || len(groups) == 1 {
+		return failedRecords(records, message), nil
+	}
+	return api.bisectGroups(groups)
+}
+
+// itemsOfRef คืนรายการใน items ที่มี row_order_ref ตรงกับ ref
+func itemsOfRef(items []interface{}, ref int) []interface{} {
+	var matched []interface{}
+	for _, item := range items {
+		if itemRef, ok := itemRowOrderRef(item); ok && itemRef == ref {
+			matched = append(matched, item)
+		}
+	}
+	return matched
+}
+
+// itemsOfRefs คืนรายการใน items ที่มี row_order_ref อยู่ใน refs
+func itemsOfRefs(items []interface{}, refs map[int]bool) []interface{} {
+	var matched []interface{}
+	for _, item := range items {
+		if itemRef, ok := itemRowOrderRef(item); ok && refs[itemRef] {
+			matched = append(matched, item)
+		}
+	}
+	return matched
+}
+
+// failedRecords SyncResult ที่ทุกแถวใน records ส่งไม่สำเร็จด้วยเหตุผล message
+func failedRecords(records []types.SyncRecord, message string) *SyncResult {
+	failed := newSyncResult()
+	for _, record := range records {
+		failed.failedRefs[record.RowOrderRef] = message
+	}
+	return failed
+}
+
+// skippedRecords SyncResult ที่ทุกแถวใน records ยังไม่ได้ส่งเพราะ err
+func skippedRecords(records []types.SyncRecord, err error) *SyncResult {
+	skipped := newSyncResult()
+	for _, record := range records {
+		skipped.markSkipped(record.RowOrderRef, err.Error())
+	}
+	return skipped
+}
+
+// transactionMessage ข้อความ error ของ transaction ที่ล้มเหลว
+func transactionMessage(resp *QueryResponse, err error) string {
+	message := ""
+	if resp != nil {
+		message = resp.Message
+	}
+	if message == "" && err != nil {
+		message = err.Error()
+	}
+	return message
+}
+
+// commitTransaction ส่งคำสั่งที่เก็บไว้ใน transaction เดียว (ถ้าไม่มีคำสั่งจะคืนค่าสำเร็จโดยไม่ส่ง)
+func (api *APIClient) commitTransaction() (*QueryResponse, error) {
+	if api.tx == nil {
+		return nil, fmt.Errorf("no transaction in progress")
+	}
+
+	api.tx.mu.Lock()
+	statements := api.tx.statements
+	api.tx.statements = nil
+	api.tx.mu.Unlock()
+
+	return api.sendTransaction(statements)
+}
+
+// sendTransaction ส่ง statements ด้วย Target.Tx (ถ้าไม่มีคำสั่งจะคืนค่าสำเร็จโดยไม่ส่ง)
+func (api *APIClient) sendTransaction(statements []TxStatement) (*QueryResponse, error) {
+	if len(statements) == 0 {
+		return &QueryResponse{Success: true}, nil
+	}
+
+	fmt.Printf("📦 กำลังส่ง %d คำสั่งใน transaction เดียว\n", len(statements))
+	return api.target.Tx(statements)
+}
+
+// queueBulk เก็บการ upsert หลายแถวไว้ใน transaction (ส่งด้วย COPY เมื่อปลายทางรองรับ)
+func (b *commandBuffer) queueBulk(bulk *BulkRows) {
+	b.mu.Lock()
+	b.statements = append(b.statements, TxStatement{Bulk: bulk})
+	b.mu.Unlock()
+}
+
+// queue เก็บคำสั่งไว้ใน transaction และคืนค่าสำเร็จ (ผลจริงจะรู้ตอน CommitTransaction)
+func (b *commandBuffer) queue(query string, params []interface{}) *QueryResponse {
+	b.mu.Lock()
+	b.statements = append(b.statements, TxStatement{Query: query, Params: params})
+	b.mu.Unlock()
+
+	return &QueryResponse{Success: true, Message: "queued in transaction"}
+}
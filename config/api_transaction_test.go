@@ -0,0 +1,148 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"smlmarketsync/types"
+)
+
+// txTarget ปลายทางที่ปฏิเสธ transaction ที่มีคำสั่งของ row_order_ref ใน reject
+type txTarget struct {
+	reject    map[interface{}]bool
+	committed []interface{}
+	sizes     []int // จำนวนคำสั่งของแต่ละ transaction ที่ commit
+}
+
+func (t *txTarget) Select(query string, params []interface{}) (*QueryResponse, error) {
+	return &QueryResponse{Success: true}, nil
+}
+
+func (t *txTarget) Command(query string, params []interface{}) (*QueryResponse, error) {
+	return &QueryResponse{Success: true}, nil
+}
+
+func (t *txTarget) Tx(statements []TxStatement) (*QueryResponse, error) {
+	for _, statement := range statements {
+		if t.reject[statement.Params[0]] {
+			return &QueryResponse{Success: false, Message: "rejected"}, nil
+		}
+	}
+	for _, statement := range statements {
+		t.committed = append(t.committed, statement.Params[0])
+	}
+	t.sizes = append(t.sizes, len(statements))
+	return &QueryResponse{Success: true}, nil
+}
+
+func TestApplyInTransactionBisectsWithoutReloading(t *testing.T) {
+	target := &txTarget{reject: map[interface{}]bool{20: true}}
+	api := &APIClient{target: target, config: DefaultAPIConfig(), limiters: &pipelineLimiters{}}
+	records := []types.SyncRecord{{RowOrderRef: 10}, {RowOrderRef: 20}, {RowOrderRef: 30}, {RowOrderRef: 40}}
+
+	loads := 0
+	load := func(records []types.SyncRecord) ([]interface{}, []interface{}, []interface{}, error) {
+		loads++
+		var inserts []interface{}
+		for _, record := range records {
+			inserts = append(inserts, map[string]interface{}{"row_order_ref": record.RowOrderRef})
+		}
+		return inserts, nil, nil, nil
+	}
+	sync := func(api *APIClient, inserts, updates, deletes []interface{}) *SyncResult {
+		for _, item := range inserts {
+			api.ExecuteCommand("UPDATE t SET v = 1 WHERE row_order_ref = $1", item.(map[string]interface{})["row_order_ref"])
+		}
+		return newSyncResult()
+	}
+
+	result, err := api.ApplyInTransaction(records, load, sync)
+	if err != nil {
+		t.Fatalf("ApplyInTransaction() error = %v", err)
+	}
+	if loads != 1 {
+		t.Errorf("load called %d times, want 1", loads)
+	}
+	if want := []interface{}{10, 30, 40}; !reflect.DeepEqual(target.committed, want) {
+		t.Errorf("committed = %v, want %v", target.committed, want)
+	}
+	for ref, failed := range map[int]bool{10: false, 20: true, 30: false, 40: false} {
+		if result.Failed(ref) != failed {
+			t.Errorf("Failed(%d) = %v, want %v", ref, result.Failed(ref), failed)
+		}
+	}
+}
+
+func TestApplySyncChangesInTransaction(t *testing.T) {
+	// ref 1 และ 3 ใช้ code เดียวกัน จึงถูกแบ่งเป็น 2 batch แต่ยังต้อง commit ใน transaction เดียว
+	records := []types.SyncRecord{
+		{ID: 1, RowOrderRef: 1, NewData: []byte(`{"code":"A"}`)},
+		{ID: 2, RowOrderRef: 2, NewData: []byte(`{"code":"B"}`)},
+		{ID: 3, RowOrderRef: 3, NewData: []byte(`{"code":"A"}`)},
+	}
+
+	tests := []struct {
+		name      string
+		reject    map[interface{}]bool
+		committed []interface{}
+		sizes     []int
+		failed    map[int]bool
+	}{
+		{
+			name:      "whole set in one transaction",
+			committed: []interface{}{1, 2, 3},
+			sizes:     []int{3},
+			failed:    map[int]bool{1: false, 2: false, 3: false},
+		},
+		{
+			name:      "rejected transaction retried per batch",
+			reject:    map[interface{}]bool{2: true},
+			committed: []interface{}{1, 3},
+			sizes:     []int{1, 1},
+			failed:    map[int]bool{1: false, 2: true, 3: false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &txTarget{reject: tt.reject}
+			api := &APIClient{target: target, config: DefaultAPIConfig(), limiters: &pipelineLimiters{}}
+
+			loads := 0
+			load := func(records []types.SyncRecord) ([]interface{}, []interface{}, []interface{}, error) {
+				loads++
+				var inserts []interface{}
+				for _, record := range records {
+					inserts = append(inserts, map[string]interface{}{"row_order_ref": record.RowOrderRef})
+				}
+				return inserts, nil, nil, nil
+			}
+			sync := func(api *APIClient, inserts, updates, deletes []interface{}) *SyncResult {
+				for _, item := range inserts {
+					api.ExecuteCommand("UPDATE t SET v = 1 WHERE row_order_ref = $1", item.(map[string]interface{})["row_order_ref"])
+				}
+				return newSyncResult()
+			}
+
+			result, err := api.ApplySyncChangesInTransaction(records, "code", load, sync)
+			if err != nil {
+				t.Fatalf("ApplySyncChangesInTransaction() error = %v", err)
+			}
+			// ต้นทางถูกอ่านครั้งเดียวต่อ batch แม้ต้องส่งใหม่
+			if loads != 2 {
+				t.Errorf("load called %d times, want 2", loads)
+			}
+			if !reflect.DeepEqual(target.committed, tt.committed) {
+				t.Errorf("committed = %v, want %v", target.committed, tt.committed)
+			}
+			if !reflect.DeepEqual(target.sizes, tt.sizes) {
+				t.Errorf("transaction sizes = %v, want %v", target.sizes, tt.sizes)
+			}
+			for ref, failed := range tt.failed {
+				if result.Failed(ref) != failed {
+					t.Errorf("Failed(%d) = %v, want %v", ref, result.Failed(ref), failed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AvailabilityConfig การคำนวณยอดพร้อมขาย (available_qty) ที่ส่งไปพร้อม balance_qty (section "availability" ใน smlmarketsync.json)
+// available_qty = balance_qty - ยอดที่ถูกจองโดยใบสั่งขายที่ยังเปิดอยู่ - safety stock (ไม่ต่ำกว่า 0)
+type AvailabilityConfig struct {
+	Reservations *StockRules     `json:"reservations"` // กฎของแถวใน ic_trans_detail ที่นับเป็นยอดจอง (nil = DefaultReservationRules)
+	OpenOrders   *OpenOrderRules `json:"open_orders"`  // การตัดยอดจองของเอกสารที่ปิดแล้วหรือส่งของแล้ว (nil = DefaultOpenOrderRules)
+	SafetyStock  []SafetyStock   `json:"safety_stock"` // จำนวนที่กันไว้ไม่ขาย ตามสินค้า กลุ่มสินค้า หรือคลัง
+}
+
+// OpenOrderRules กำหนดว่ายอดจองของแต่ละบรรทัดยังค้างอยู่เท่าไร
+// บรรทัดถูกนับเฉพาะเมื่อหัวเอกสารใน ic_trans ยังไม่สำเร็จ (doc_success = 0) และไม่ถูกยกเลิก
+// แล้วหักจำนวนที่เอกสารใน FulfillmentFlags อ้างอิงบรรทัดนั้นไปแล้ว (ผ่าน RefDocColumn และ RefLineColumn) ไม่ต่ำกว่า 0
+type OpenOrderRules struct {
+	Disabled         bool   `json:"disabled"`          // true = นับทุกบรรทัดเต็มจำนวนโดยไม่ตรวจสถานะเอกสาร (แบบเดิม)
+	FulfillmentFlags []int  `json:"fulfillment_flags"` // trans_flag ของเอกสารที่ส่งของหรือแปลงจากใบจอง/ใบสั่งขาย
+	RefDocColumn     string `json:"ref_doc_column"`    // column ใน ic_trans_detail ของเอกสารที่ส่งของ ที่เก็บเลขที่ใบจอง/ใบสั่งขาย
+	RefLineColumn    string `json:"ref_line_column"`   // column ใน ic_trans_detail ของเอกสารที่ส่งของ ที่เก็บ line_number ของบรรทัดที่อ้างอิง
+}
+
+// sqlIdentifier ชื่อ column ที่ใส่ลงใน SQL ได้โดยตรง
+var sqlIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// DefaultOpenOrderRules ใบสั่งขาย (36) ตัดยอดของใบสั่งจองที่อ้างอิง และการขาย (44) ตัดยอดของใบสั่งขาย
+func DefaultOpenOrderRules() *OpenOrderRules {
+	return &OpenOrderRules{
+		FulfillmentFlags: []int{36, 44},
+		RefDocColumn:     "ref_doc_no",
+		RefLineColumn:    "ref_row",
+	}
+}
+
+// SafetyStock จำนวนที่กันไว้ไม่ขายของสินค้าที่ตรงกับทุก field ที่ระบุ (ไม่ระบุเลย = ค่าเริ่มต้นของทุกสินค้า)
+// ถ้าตรงหลายรายการ จะใช้รายการที่เจาะจงที่สุด (ic_code > group_code > wh_code)
+type SafetyStock struct {
+	IcCode    string  `json:"ic_code,omitempty"`
+	GroupCode string  `json:"group_code,omitempty"` // ic_inventory.group_main
+	WhCode    string  `json:"wh_code,omitempty"`
+	Qty       float64 `json:"qty"`
+}
+
+// DefaultReservationRules ยอดจองจากใบสั่งจอง (34) และใบสั่งขาย (36) ที่ยังไม่ถูกยกเลิก
+func DefaultReservationRules() *StockRules {
+	return &StockRules{
+		Movements: []StockRule{
+			{TransFlags: []int{34, 36}},
+		},
+	}
+}
+
+// NewAvailabilityConfig อ่านการตั้งค่า availability จาก smlmarketsync.json (ถ้าไม่มี section นี้จะไม่กัน safety stock)
+// การตั้งค่าที่ไม่ถูกต้องจะทำให้โปรแกรมหยุด เพราะยอดพร้อมขายที่คำนวณผิดจะถูกส่งขึ้น server
+func NewAvailabilityConfig() *AvailabilityConfig {
+	availability := &AvailabilityConfig{}
+	config, err := loadConfig()
+	if err != nil {
+		log.Printf("⚠️ Warning: %v (ใช้การตั้งค่า availability เริ่มต้น)", err)
+	} else if config.Availability != nil {
+		availability = config.Availability
+	}
+
+	if availability.Reservations == nil {
+		availability.Reservations = DefaultReservationRules()
+	}
+	if availability.OpenOrders == nil {
+		availability.OpenOrders = DefaultOpenOrderRules()
+	}
+	if err := availability.Validate(); err != nil {
+		log.Fatalf("❌ Error: availability ใน %s ไม่ถูกต้อง: %v\nโปรแกรมจบการทำงาน", configPath, err)
+	}
+	return availability
+}
+
+// Validate ตรวจกฎของยอดจองและ safety stock
+func (a *AvailabilityConfig) Validate() error {
+	if a.Reservations != nil {
+		if err := a.Reservations.Validate(); err != nil {
+			return fmt.Errorf("reservations: %v", err)
+		}
+	}
+	if a.OpenOrders != nil && !a.OpenOrders.Disabled {
+		if len(a.OpenOrders.FulfillmentFlags) == 0 {
+			return fmt.Errorf("open_orders: ต้องระบุ fulfillment_flags (หรือตั้ง disabled เป็น true)")
+		}
+		for name, column := range map[string]string{"ref_doc_column": a.OpenOrders.RefDocColumn, "ref_line_column": a.OpenOrders.RefLineColumn} {
+			if !sqlIdentifier.MatchString(column) {
+				return fmt.Errorf("open_orders: %s ต้องเป็นชื่อ column: %q", name, column)
+			}
+		}
+	}
+	for i, safety := range a.SafetyStock {
+		if safety.Qty < 0 {
+			return fmt.Errorf("safety_stock[%d]: qty ต้องไม่ติดลบ", i)
+		}
+	}
+	return nil
+}
+
+// CheckSchema ตรวจว่า ic_trans_detail มี column อ้างอิงของ open_orders จริง
+// ถ้าไม่มี (โครงสร้างฐานข้อมูล SML รุ่นอื่น) จะปิดการตัดยอดตาม open_orders พร้อมแจ้งเตือน แทนการให้ trigger
+// และคำสั่งคำนวณยอดล้มเหลว ซึ่งจะทำให้ทุกคำสั่งหยุดทำงานรวมถึง step ที่ไม่ได้ใช้ยอดพร้อมขาย
+func (a *AvailabilityConfig) CheckSchema(db *sql.DB) {
+	if a.Reservations == nil || a.OpenOrders == nil || a.OpenOrders.Disabled {
+		return
+	}
+
+	var missing []string
+	for _, column := range []string{a.OpenOrders.RefDocColumn, a.OpenOrders.RefLineColumn} {
+		var exists bool
+		err := db.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'ic_trans_detail' AND column_name = $1
+			)
+		`, column).Scan(&exists)
+		if err != nil {
+			log.Printf("⚠️ Warning: ตรวจสอบ column %s ของ ic_trans_detail ไม่ได้: %v", column, err)
+			return
+		}
+		if !exists {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("⚠️ Warning: ic_trans_detail ไม่มี column %s ของ availability.open_orders ใน %s (ยอดจองจะนับเต็มจำนวนโดยไม่ตัดยอดที่ส่งของแล้ว)",
+			strings.Join(missing, ", "), configPath)
+		a.OpenOrders.Disabled = true
+	}
+}
+
+// ReservedExpr คืน SQL expression ของจำนวนที่ยังถูกจองในแต่ละแถวของ ic_trans_detail (alias เช่น "itd")
+// ยอดจองของเอกสารที่ปิดแล้ว และจำนวนที่ส่งของไปแล้ว ไม่ถูกนับตาม OpenOrders
+// คำสั่งที่ใช้ expression นี้ต้องต่อ ReservedJoin ของ alias เดียวกันไว้ใน FROM
+// การปิดหรือยกเลิกเอกสารที่หัวเอกสารถูกบันทึกเข้าคิวโดย trigger ของ ic_trans (ดู CreateBalanceTrigger)
+func (a *AvailabilityConfig) ReservedExpr(alias string) string {
+	if a.Reservations == nil {
+		return "0"
+	}
+	reserved := a.Reservations.QuantityExpr(alias)
+	if a.OpenOrders == nil || a.OpenOrders.Disabled {
+		return reserved
+	}
+	return a.OpenOrders.remainingExpr(alias, reserved, a.Reservations.transFlags())
+}
+
+// ReservedJoin คืน LEFT JOIN ของจำนวนที่ส่งของแล้วต่อบรรทัดที่ ReservedExpr ใช้ (ว่างถ้าไม่ตัดยอดตาม OpenOrders)
+func (a *AvailabilityConfig) ReservedJoin(alias string) string {
+	if a.Reservations == nil || a.OpenOrders == nil || a.OpenOrders.Disabled {
+		return ""
+	}
+	return a.OpenOrders.fulfilledJoin(alias, a.Reservations.transFlags())
+}
+
+// fulfilledAlias ชื่อของ subquery จำนวนที่ส่งของแล้วของ alias
+func fulfilledAlias(alias string) string {
+	return alias + "_fulfilled"
+}
+
+// fulfilledJoin รวมจำนวนที่ส่งของแล้วของบรรทัดเดียวด้วย LEFT JOIN LATERAL ตาม doc_no, line_number และสินค้าของบรรทัดนั้น
+// subquery อ่านเฉพาะแถวของสินค้าเดียวกัน และไม่ทำงานเลยกับบรรทัดที่ trans_flag ไม่ใช่การจอง
+// รอบที่ส่งเฉพาะคู่ที่เปลี่ยนจึงไม่ต้องอ่าน ic_trans_detail ทั้งตาราง
+func (o *OpenOrderRules) fulfilledJoin(alias string, flags []int) string {
+	return fmt.Sprintf(`LEFT JOIN LATERAL (
+					SELECT SUM(ROUND((f.qty*f.stand_value) / f.divide_value, 2)) AS qty
+					FROM ic_trans_detail f
+					WHERE %[6]s
+					  AND f.item_code = %[1]s.item_code
+					  AND f.%[3]s = %[1]s.doc_no AND f.%[4]s = %[1]s.line_number
+					  AND %[5]s
+					  AND f.last_status = 0 AND f.divide_value <> 0
+				) %[2]s ON true`,
+		alias, fulfilledAlias(alias), o.RefDocColumn, o.RefLineColumn,
+		intCondition("f.trans_flag", o.FulfillmentFlags), intCondition(alias+".trans_flag", flags))
+}
+
+// remainingExpr ยอดจองคงค้างของบรรทัด: 0 ถ้าไม่ใช่เอกสารจองหรือเอกสารไม่เปิดอยู่ ไม่เช่นนั้น reserved - จำนวนที่ส่งของแล้ว (ไม่ต่ำกว่า 0)
+// ตรวจ trans_flag ก่อน เพื่อไม่ให้ค้นหัวเอกสารของบรรทัดที่ไม่ใช่การจอง
+func (o *OpenOrderRules) remainingExpr(alias, reserved string, flags []int) string {
+	return fmt.Sprintf(`CASE WHEN %[3]s AND EXISTS (
+					SELECT 1 FROM ic_trans it
+					WHERE it.doc_no = %[1]s.doc_no AND it.trans_flag = %[1]s.trans_flag
+					  AND it.doc_success = 0 AND it.last_status = 0
+				 )
+				 THEN GREATEST((%[2]s) - COALESCE(%[4]s.qty, 0), 0)
+				 ELSE 0
+			END`, alias, reserved, intCondition(alias+".trans_flag", flags), fulfilledAlias(alias))
+}
+
+// SafetyStockExpr คืน SQL expression ของ safety stock ของแต่ละสินค้า/คลัง จาก column ของรหัสสินค้า กลุ่มสินค้า และคลัง
+func (a *AvailabilityConfig) SafetyStockExpr(icCodeColumn, groupColumn, whCodeColumn string) string {
+	if len(a.SafetyStock) == 0 {
+		return "0"
+	}
+
+	// เรียงจากเจาะจงมากไปน้อย CASE จะเลือกรายการแรกที่ตรง
+	entries := append([]SafetyStock{}, a.SafetyStock...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].specificity() > entries[j].specificity()
+	})
+
+	var cases []string
+	fallback := ""
+	for _, safety := range entries {
+		qty := strconv.FormatFloat(safety.Qty, 'f', -1, 64)
+
+		var conditions []string
+		if safety.IcCode != "" {
+			conditions = append(conditions, fmt.Sprintf("%s = %s", icCodeColumn, quoteLiteral(safety.IcCode)))
+		}
+		if safety.GroupCode != "" {
+			conditions = append(conditions, fmt.Sprintf("%s = %s", groupColumn, quoteLiteral(safety.GroupCode)))
+		}
+		if safety.WhCode != "" {
+			conditions = append(conditions, fmt.Sprintf("%s = %s", whCodeColumn, quoteLiteral(safety.WhCode)))
+		}
+
+		if len(conditions) == 0 {
+			if fallback == "" {
+				fallback = qty
+			}
+			continue
+		}
+		cases = append(cases, fmt.Sprintf("WHEN %s THEN %s", strings.Join(conditions, " AND "), qty))
+	}
+
+	if fallback == "" {
+		fallback = "0"
+	}
+	if len(cases) == 0 {
+		return fallback
+	}
+	return fmt.Sprintf("(CASE %s ELSE %s END)", strings.Join(cases, " "), fallback)
+}
+
+// specificity น้ำหนักความเจาะจงของรายการ ic_code สำคัญกว่า group_code และ group_code สำคัญกว่า wh_code
+func (s SafetyStock) specificity() int {
+	weight := 0
+	if s.IcCode != "" {
+		weight += 4
+	}
+	if s.GroupCode != "" {
+		weight += 2
+	}
+	if s.WhCode != "" {
+		weight++
+	}
+	return weight
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReservedJoin(t *testing.T) {
+	// จำนวนที่ส่งของแล้วต้องถูกค้นเฉพาะบรรทัดที่อ้างอิง ไม่ใช่รวมทั้งตารางก่อน join
+	want := `LEFT JOIN LATERAL ( ` +
+		`SELECT SUM(ROUND((f.qty*f.stand_value) / f.divide_value, 2)) AS qty ` +
+		`FROM ic_trans_detail f ` +
+		`WHERE itd.trans_flag IN (34,36) ` +
+		`AND f.item_code = itd.item_code ` +
+		`AND f.ref_doc_no = itd.doc_no AND f.ref_row = itd.line_number ` +
+		`AND f.trans_flag IN (36,44) ` +
+		`AND f.last_status = 0 AND f.divide_value <> 0 ` +
+		`) itd_fulfilled ON true`
+
+	tests := []struct {
+		name         string
+		availability AvailabilityConfig
+		want         string
+	}{
+		{
+			name:         "default rules",
+			availability: AvailabilityConfig{Reservations: DefaultReservationRules(), OpenOrders: DefaultOpenOrderRules()},
+			want:         want,
+		},
+		{
+			name:         "open orders disabled",
+			availability: AvailabilityConfig{Reservations: DefaultReservationRules(), OpenOrders: &OpenOrderRules{Disabled: true}},
+			want:         "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(strings.Fields(tt.availability.ReservedJoin("itd")), " "); got != tt.want {
+				t.Errorf("ReservedJoin() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
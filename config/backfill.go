@@ -0,0 +1,197 @@
+package config
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SyncTable ตารางต้นทางที่ติดตามการเปลี่ยนแปลงผ่าน sml_market_sync
+type SyncTable struct {
+	TableID   int
+	TableName string
+	Snapshot  string // expression ของ snapshot แถว (alias t) แบบเดียวกับที่ trigger บันทึกใน new_data
+}
+
+// SyncTables ตารางทั้งหมดที่มี trigger บันทึกลง sml_market_sync เรียงตามลำดับที่ควร backfill
+// (สินค้าก่อน แล้วจึงเป็นราคา/บาร์โค้ดที่อ้างถึงสินค้า)
+var SyncTables = []SyncTable{
+	{TableID: 2, TableName: "ic_inventory", Snapshot: "to_jsonb(t)"},
+	{TableID: 1, TableName: "ic_inventory_price", Snapshot: "to_jsonb(t)"},
+	{TableID: 5, TableName: "ic_inventory_price_formula", Snapshot: "to_jsonb(t)"},
+	{TableID: 3, TableName: "ic_inventory_barcode", Snapshot: `to_jsonb(t) || jsonb_build_object(
+		'item_name', (SELECT name_1 FROM ic_inventory WHERE code = t.ic_code),
+		'unit_name', (SELECT name_1 FROM ic_unit WHERE code = t.unit_code))`},
+	{TableID: 4, TableName: "ar_customer", Snapshot: "to_jsonb(t)"},
+}
+
+// FindSyncTable ค้นหาตารางที่ติดตามจากชื่อตาราง
+func FindSyncTable(tableName string) (SyncTable, bool) {
+	for _, table := range SyncTables {
+		if table.TableName == tableName {
+			return table, true
+		}
+	}
+	return SyncTable{}, false
+}
+
+// BackfillOptions ตัวเลือกของการ backfill
+type BackfillOptions struct {
+	ChunkSize int           // จำนวน roworder ต่อ 1 transaction
+	Pause     time.Duration // หน่วงเวลาระหว่าง chunk เพื่อไม่ให้รบกวนการขายหน้าร้าน
+	Reset     bool          // เริ่มใหม่ตั้งแต่ต้น ไม่สนใจความคืบหน้าที่บันทึกไว้
+}
+
+// CreateBackfillTable สร้างตาราง sml_market_sync_backfill สำหรับเก็บความคืบหน้าของการ backfill
+func CreateBackfillTable(db *sql.DB) error {
+	// last_roworder = roworder สุดท้ายที่ถูกเพิ่มเข้า sml_market_sync แล้ว
+	// completed_at = เวลาที่ backfill ตารางนี้ครบ (NULL = ยังไม่ครบ)
+	query := `
+		CREATE TABLE IF NOT EXISTS sml_market_sync_backfill (
+			table_id INT PRIMARY KEY,
+			table_name VARCHAR(100) NOT NULL,
+			last_roworder INT NOT NULL DEFAULT 0,
+			total_rows INT NOT NULL DEFAULT 0,
+			started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			completed_at TIMESTAMP
+		)
+	`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถสร้างตาราง sml_market_sync_backfill: %v", err)
+	}
+
+	return nil
+}
+
+// BackfillSyncTable เพิ่ม roworder ทั้งหมดที่มีอยู่ในตารางต้นทางเข้า sml_market_sync เป็น active_code=2 (upsert)
+// แถวอาจมีอยู่บน server แล้ว จึงบันทึก snapshot เป็นทั้ง new_data และ old_data แบบเดียวกับ update
+// ถ้าแถวถูกลบก่อนส่งถึง server การรวมเหตุการณ์จะได้ delete ตาม old_data ไม่ใช่ตัดทิ้งแบบ insert ที่ถูกลบ
+// ทำทีละ chunk ตามลำดับ roworder โดยแต่ละ chunk และความคืบหน้าอยู่ใน transaction เดียวกัน
+// ถ้าหยุดกลางคัน การรันครั้งถัดไปจะทำต่อจาก roworder สุดท้ายที่บันทึกไว้
+func BackfillSyncTable(db *sql.DB, table SyncTable, options BackfillOptions) (int, error) {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = 5000
+	}
+
+	if options.Reset {
+		_, err := db.Exec("DELETE FROM sml_market_sync_backfill WHERE table_id = $1", table.TableID)
+		if err != nil {
+			return 0, fmt.Errorf("error resetting backfill progress of %s: %v", table.TableName, err)
+		}
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO sml_market_sync_backfill (table_id, table_name)
+		VALUES ($1, $2)
+		ON CONFLICT (table_id) DO NOTHING
+	`, table.TableID, table.TableName)
+	if err != nil {
+		return 0, fmt.Errorf("error initializing backfill progress of %s: %v", table.TableName, err)
+	}
+
+	var lastRowOrder, totalRows int
+	var completedAt sql.NullTime
+	err = db.QueryRow(`
+		SELECT last_roworder, total_rows, completed_at
+		FROM sml_market_sync_backfill
+		WHERE table_id = $1
+	`, table.TableID).Scan(&lastRowOrder, &totalRows, &completedAt)
+	if err != nil {
+		return 0, fmt.Errorf("error reading backfill progress of %s: %v", table.TableName, err)
+	}
+
+	if completedAt.Valid {
+		fmt.Printf("✅ %s: backfill ครบแล้วเมื่อ %s (%d รายการ) ใช้ --reset เพื่อเริ่มใหม่\n",
+			table.TableName, completedAt.Time.Format("2006-01-02 15:04:05"), totalRows)
+		return 0, nil
+	}
+	if lastRowOrder > 0 {
+		fmt.Printf("🔁 %s: ทำต่อจาก roworder %d (เพิ่มไปแล้ว %d รายการ)\n", table.TableName, lastRowOrder, totalRows)
+	}
+
+	// ชื่อตารางและ snapshot มาจาก SyncTables เท่านั้น ส่วนค่าอื่นส่งเป็น parameter
+	chunkQuery := fmt.Sprintf(`
+		WITH chunk AS (
+			SELECT t.roworder, %s AS snapshot FROM %s t
+			WHERE t.roworder > $2
+			ORDER BY t.roworder
+			LIMIT $3
+		), queued AS (
+			INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data, old_data)
+			SELECT $1, 2, roworder, snapshot, snapshot FROM chunk
+			RETURNING row_order_ref
+		)
+		SELECT COUNT(*), COALESCE(MAX(row_order_ref), 0) FROM queued
+	`, table.Snapshot, table.TableName)
+
+	added := 0
+	for chunkNum := 1; ; chunkNum++ {
+		count, maxRowOrder, err := backfillChunk(db, chunkQuery, table.TableID, lastRowOrder, options.ChunkSize)
+		if err != nil {
+			return added, fmt.Errorf("error backfilling %s after roworder %d: %v", table.TableName, lastRowOrder, err)
+		}
+
+		if count == 0 {
+			break
+		}
+
+		added += count
+		lastRowOrder = maxRowOrder
+		fmt.Printf("   📦 %s chunk %d: เพิ่ม %d รายการ (ถึง roworder %d, รวม %d รายการ)\n",
+			table.TableName, chunkNum, count, lastRowOrder, totalRows+added)
+
+		if count < options.ChunkSize {
+			break
+		}
+		if options.Pause > 0 {
+			time.Sleep(options.Pause)
+		}
+	}
+
+	_, err = db.Exec(`
+		UPDATE sml_market_sync_backfill
+		SET completed_at = NOW(), updated_at = NOW()
+		WHERE table_id = $1
+	`, table.TableID)
+	if err != nil {
+		return added, fmt.Errorf("error completing backfill progress of %s: %v", table.TableName, err)
+	}
+
+	fmt.Printf("✅ %s: backfill เสร็จสิ้น เพิ่มรอบนี้ %d รายการ (รวม %d รายการ)\n", table.TableName, added, totalRows+added)
+	return added, nil
+}
+
+// backfillChunk เพิ่ม roworder หนึ่ง chunk เข้า sml_market_sync และบันทึกความคืบหน้าใน transaction เดียวกัน
+func backfillChunk(db *sql.DB, chunkQuery string, tableID int, afterRowOrder int, chunkSize int) (int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var count, maxRowOrder int
+	err = tx.QueryRow(chunkQuery, tableID, afterRowOrder, chunkSize).Scan(&count, &maxRowOrder)
+	if err != nil {
+		return 0, 0, err
+	}
+	if count == 0 {
+		return 0, afterRowOrder, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE sml_market_sync_backfill
+		SET last_roworder = $2, total_rows = total_rows + $3, updated_at = NOW()
+		WHERE table_id = $1
+	`, tableID, maxRowOrder, count)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return count, maxRowOrder, nil
+}
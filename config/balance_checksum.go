@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultBalanceChecksumBuckets จำนวนกลุ่ม (bucket) ที่ใช้เทียบ checksum ของ ic_balance เมื่อไม่ได้ตั้งค่า
+const DefaultBalanceChecksumBuckets = 256
+
+// BalanceBucketExpr คืน SQL expression ที่แบ่ง ic_code ลงกลุ่ม 0..buckets-1 ตาม md5 ของ ic_code
+// ทั้ง local และ server ใช้ expression เดียวกัน ยอดทุกคลัง/หน่วยของสินค้าเดียวกันจึงอยู่กลุ่มเดียวกันทั้งสองฝั่ง
+func BalanceBucketExpr(icCodeColumn string, buckets int) string {
+	return fmt.Sprintf("(((('x' || substr(md5(%s), 1, 8))::bit(32)::int) & 2147483647) %% %d)", icCodeColumn, buckets)
+}
+
+// BalanceChecksumQuery คืนคำสั่งที่คำนวณ checksum ของแต่ละกลุ่มจาก source (ตารางหรือ subquery ที่มี column ตามชื่อที่ระบุ)
+// checksum คือ "จำนวนแถว:ผลรวม hash ของแต่ละแถว" โดย balance_qty และ available_qty ถูกปัดเป็น 3 ตำแหน่งตาม NUMERIC(18,3) ของ ic_balance
+// ผลรวมไม่ขึ้นกับลำดับแถว และใช้ NUMERIC จึงไม่ล้น แถวที่ key เป็น NULL หรือว่างจะไม่ถูกนับ
+// เหมือนที่ balanceCursor ข้ามแถวเหล่านี้ตอนส่ง (ไม่เช่นนั้นกลุ่มที่มีแถวเหล่านี้จะไม่ตรงกันทุกรอบ)
+func BalanceChecksumQuery(source, icCode, whCode, unitCode, balanceQty, availableQty string, buckets int) string {
+	rowText := fmt.Sprintf("%s || '|' || %s || '|' || %s || '|' || COALESCE(ROUND(%s::NUMERIC, 3)::TEXT, '') || '|' || COALESCE(ROUND(%s::NUMERIC, 3)::TEXT, '')",
+		icCode, whCode, unitCode, balanceQty, availableQty)
+	return fmt.Sprintf(`
+		SELECT bucket, COUNT(*)::TEXT || ':' || SUM(row_hash)::TEXT AS checksum
+		FROM (
+			SELECT %s AS bucket,
+				('x' || substr(md5(%s), 1, 15))::bit(60)::bigint AS row_hash
+			FROM %s
+			WHERE %s <> '' AND %s <> '' AND %s <> ''
+		) hashed
+		GROUP BY bucket
+	`, BalanceBucketExpr(icCode, buckets), rowText, source, icCode, whCode, unitCode)
+}
+
+// GetBalanceChecksums คำนวณ checksum ของ ic_balance บน server แยกตามกลุ่ม (กลุ่มที่ไม่มีแถวจะไม่อยู่ใน map)
+func (api *APIClient) GetBalanceChecksums(buckets int) (map[int]string, error) {
+	query := BalanceChecksumQuery("ic_balance", "ic_code", "wh_code", "unit_code", "balance_qty", "available_qty", buckets)
+	resp, err := api.ExecuteSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to get ic_balance checksums: %s", resp.Message)
+	}
+
+	checksums := make(map[int]string)
+	data, _ := resp.Data.([]interface{})
+	for _, row := range data {
+		rowMap, ok := row.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		bucket, err := strconv.Atoi(fmt.Sprintf("%v", rowMap["bucket"]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ic_balance checksum bucket %v: %v", rowMap["bucket"], err)
+		}
+		checksums[bucket] = fmt.Sprintf("%v", rowMap["checksum"])
+	}
+	return checksums, nil
+}
+
+// MismatchedBalanceBuckets คืนกลุ่มที่ checksum ของ local และ server ต่างกัน (รวมกลุ่มที่มีเพียงฝั่งเดียว) เรียงจากน้อยไปมาก
+func MismatchedBalanceBuckets(local, server map[int]string) []int {
+	var buckets []int
+	for bucket, checksum := range local {
+		if server[bucket] != checksum {
+			buckets = append(buckets, bucket)
+		}
+	}
+	for bucket := range server {
+		if _, ok := local[bucket]; !ok {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Ints(buckets)
+	return buckets
+}
+
+// BalanceBucketFilter คืนเงื่อนไขที่เลือกเฉพาะแถวของกลุ่มใน buckets
+func BalanceBucketFilter(icCodeColumn string, buckets []int, bucketCount int) string {
+	list := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		list[i] = strconv.Itoa(bucket)
+	}
+	return fmt.Sprintf("%s IN (%s)", BalanceBucketExpr(icCodeColumn, bucketCount), strings.Join(list, ","))
+}
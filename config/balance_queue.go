@@ -0,0 +1,253 @@
+package config
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultBalanceReconcileInterval ระยะเวลาระหว่างการเทียบ ic_balance ทั้งตาราง (full reconcile) เมื่อไม่ได้ตั้งค่า
+// balance.reconcile_interval_hours รอบอื่นจะส่งเฉพาะคู่ (ic_code, wh_code) ที่ trigger ของ ic_trans_detail บันทึกไว้
+const DefaultBalanceReconcileInterval = 24 * time.Hour
+
+// BalancePair คู่สินค้า/คลังที่ยอดคงเหลืออาจเปลี่ยน
+type BalancePair struct {
+	IcCode string
+	WhCode string
+}
+
+// CreateBalanceSyncTable สร้างตาราง sml_market_balance_sync (คิวของคู่สินค้า/คลังที่ต้องคำนวณยอดใหม่)
+// และ sml_market_balance_reconcile (เวลาที่เทียบทั้งตารางครั้งล่าสุด)
+func CreateBalanceSyncTable(db *sql.DB) error {
+	// คิวเป็นแบบ append-only: trigger เพิ่มแถวใหม่ทุกครั้งโดยไม่ล็อกแถวของคู่ที่มีอยู่แล้ว
+	// การขาย POS ของสินค้า/คลังเดียวกันพร้อมกันจึงไม่ต้องรอกัน คู่ที่ซ้ำถูกรวมตอน ClaimBalancePairs
+	// แถวที่เพิ่มระหว่างที่ run อื่นจองคู่นั้นอยู่ยังไม่ถูกจอง run ถัดไปจึงคำนวณใหม่ (ack ลบเฉพาะแถวที่ run นั้นจองไว้)
+	queries := []string{`
+		CREATE TABLE IF NOT EXISTS sml_market_balance_sync (
+			id BIGSERIAL PRIMARY KEY,
+			item_code VARCHAR(50) NOT NULL,
+			wh_code VARCHAR(50) NOT NULL,
+			changed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			claim_run_id VARCHAR(64),
+			claimed_at TIMESTAMP
+		)
+	`, `
+		DO $$
+		BEGIN
+			-- ตารางเดิมใช้ (item_code, wh_code) เป็น primary key ซึ่ง trigger ต้อง ON CONFLICT DO UPDATE
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'sml_market_balance_sync' AND column_name = 'id'
+			) THEN
+				ALTER TABLE sml_market_balance_sync DROP CONSTRAINT IF EXISTS sml_market_balance_sync_pkey;
+				ALTER TABLE sml_market_balance_sync ADD COLUMN id BIGSERIAL PRIMARY KEY;
+			END IF;
+		END
+		$$
+	`, `
+		CREATE INDEX IF NOT EXISTS sml_market_balance_sync_claim_idx ON sml_market_balance_sync (claim_run_id)
+	`, `
+		CREATE TABLE IF NOT EXISTS sml_market_balance_reconcile (
+			id INT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+			last_full_at TIMESTAMP NOT NULL
+		)
+	`}
+
+	for _, query := range queries {
+		_, err := db.Exec(query)
+		if err != nil {
+			return fmt.Errorf("ไม่สามารถสร้างตาราง sml_market_balance_sync: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ClaimBalancePairs จองแถวทั้งหมดในคิวให้กับ run นี้ (ใช้ SyncClaimLease เดียวกับ sml_market_sync)
+// แล้วคืนคู่สินค้า/คลังที่ไม่ซ้ำกัน เพราะ trigger เพิ่มแถวใหม่ทุกครั้งที่คู่นั้นเปลี่ยน
+func ClaimBalancePairs(db *sql.DB, runID string) ([]BalancePair, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE sml_market_balance_sync
+			SET claim_run_id = $1, claimed_at = NOW()
+			WHERE claim_run_id IS NULL OR claim_run_id = $1 OR claimed_at < NOW() - ($2 * INTERVAL '1 second')
+			RETURNING item_code, wh_code
+		)
+		SELECT DISTINCT item_code, wh_code FROM claimed
+		ORDER BY item_code, wh_code
+	`
+
+	rows, err := db.Query(query, runID, int(SyncClaimLease.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("error claiming sml_market_balance_sync rows: %v", err)
+	}
+	defer rows.Close()
+
+	var pairs []BalancePair
+	for rows.Next() {
+		var pair BalancePair
+		if err := rows.Scan(&pair.IcCode, &pair.WhCode); err != nil {
+			return nil, fmt.Errorf("error scanning claimed balance pair: %v", err)
+		}
+		pairs = append(pairs, pair)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating claimed balance pairs: %v", err)
+	}
+
+	if len(pairs) > 0 {
+		fmt.Printf("🔒 จองคู่สินค้า/คลังจาก sml_market_balance_sync ได้ %d รายการ (run: %s)\n", len(pairs), runID)
+	}
+	return pairs, nil
+}
+
+// AckBalancePairs ลบคู่ที่ส่งยอดสำเร็จแล้วออกจากคิว (เฉพาะแถวที่ยังถูกจองโดย runID นี้)
+func AckBalancePairs(db *sql.DB, runID string) error {
+	_, err := db.Exec("DELETE FROM sml_market_balance_sync WHERE claim_run_id = $1", runID)
+	if err != nil {
+		return fmt.Errorf("error acknowledging sml_market_balance_sync rows: %v", err)
+	}
+	return nil
+}
+
+// ReleaseBalancePairs ปลดการจองคู่ที่ส่งไม่สำเร็จ เพื่อให้ run ถัดไปคำนวณและส่งใหม่
+func ReleaseBalancePairs(db *sql.DB, runID string) error {
+	_, err := db.Exec("UPDATE sml_market_balance_sync SET claim_run_id = NULL, claimed_at = NULL WHERE claim_run_id = $1", runID)
+	if err != nil {
+		return fmt.Errorf("error releasing sml_market_balance_sync rows: %v", err)
+	}
+	return nil
+}
+
+// BalanceReconcileDue ตรวจว่าเทียบ ic_balance ทั้งตารางครั้งล่าสุดนานกว่า interval แล้วหรือยัง (ยังไม่เคยเทียบ = ถึงเวลา)
+func BalanceReconcileDue(db *sql.DB, interval time.Duration) (bool, error) {
+	var lastFullAt time.Time
+	err := db.QueryRow("SELECT last_full_at FROM sml_market_balance_reconcile WHERE id = 1").Scan(&lastFullAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading sml_market_balance_reconcile: %v", err)
+	}
+	return time.Since(lastFullAt) >= interval, nil
+}
+
+// MarkBalanceReconciled บันทึกเวลาที่เทียบ ic_balance ทั้งตารางสำเร็จ
+func MarkBalanceReconciled(db *sql.DB) error {
+	_, err := db.Exec(`
+		INSERT INTO sml_market_balance_reconcile (id, last_full_at) VALUES (1, NOW())
+		ON CONFLICT (id) DO UPDATE SET last_full_at = EXCLUDED.last_full_at
+	`)
+	if err != nil {
+		return fmt.Errorf("error updating sml_market_balance_reconcile: %v", err)
+	}
+	return nil
+}
+
+// SyncBalanceChanges ส่งยอดคงเหลือของคู่สินค้า/คลังที่เปลี่ยนแปลง ครั้งละ batchSize คู่ (0 = DefaultBalanceBatchSize)
+// แต่ละชุดลบแถวเดิมของคู่ในชุดแล้ว upsert ยอดที่คำนวณใหม่ของคู่นั้นใน balances ภายใน transaction เดียว
+// (คู่ที่ยอดเป็น 0 จะไม่อยู่ใน balances จึงถูกลบ) บน server จึงไม่มีช่วงที่เห็นคู่ที่กำลังส่งหายไป
+// ถ้าชุดใดล้มเหลว ชุดก่อนหน้าถูกบันทึกแล้ว ผู้เรียกส่งทุกคู่ซ้ำได้เพราะผลของการส่งซ้ำเหมือนเดิม
+func (api *APIClient) SyncBalanceChanges(pairs []BalancePair, balances []interface{}, batchSize int) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBalanceBatchSize
+	}
+
+	// จัดยอดคงเหลือตามคู่สินค้า/คลัง (sellable_units มีได้หลายหน่วยต่อคู่)
+	pairBalances := make(map[BalancePair][]interface{})
+	for _, item := range balances {
+		if itemMap, ok := item.(map[string]interface{}); ok {
+			values := balanceValues(itemMap)
+			pair := BalancePair{IcCode: values[0].(string), WhCode: values[1].(string)}
+			pairBalances[pair] = append(pairBalances[pair], item)
+		}
+	}
+
+	fmt.Printf("📤 กำลังส่งยอดคงเหลือที่เปลี่ยนแปลง: %d คู่สินค้า/คลัง, %d รายการ (ชุดละ %d คู่)\n", len(pairs), len(balances), batchSize)
+	for start := 0; start < len(pairs); start += batchSize {
+		end := start + batchSize
+		if end > len(pairs) {
+			end = len(pairs)
+		}
+
+		var chunkBalances []interface{}
+		for _, pair := range pairs[start:end] {
+			chunkBalances = append(chunkBalances, pairBalances[pair]...)
+			delete(pairBalances, pair)
+		}
+		if end == len(pairs) {
+			// ยอดที่ไม่ตรงกับคู่ใดไม่มีแถวเดิมให้ลบ จึงส่งไปกับชุดสุดท้าย
+			for _, items := range pairBalances {
+				chunkBalances = append(chunkBalances, items...)
+			}
+		}
+
+		if err := api.syncBalanceChunk(pairs[start:end], chunkBalances, batchSize); err != nil {
+			return fmt.Errorf("คู่สินค้า/คลังที่ %d-%d จาก %d: %w", start+1, end, len(pairs), err)
+		}
+	}
+	return nil
+}
+
+// syncBalanceChunk ลบแถวเดิมของ pairs แล้ว upsert balances ใน transaction เดียว
+func (api *APIClient) syncBalanceChunk(pairs []BalancePair, balances []interface{}, batchSize int) error {
+	tx := api.BeginTransaction()
+
+	var keys []string
+	var params queryParams
+	for _, pair := range pairs {
+		keys = append(keys, fmt.Sprintf("(%s::VARCHAR, %s::VARCHAR)", params.add(pair.IcCode), params.add(pair.WhCode)))
+	}
+	tx.ExecuteCommand(fmt.Sprintf(`
+		DELETE FROM ic_balance t
+		USING (VALUES %s) AS v(ic_code, wh_code)
+		WHERE t.ic_code = v.ic_code AND t.wh_code = v.wh_code
+	`, strings.Join(keys, ",")), params.values...)
+
+	upsertFormat := upsertQueryFormat("ic_balance", []string{"ic_code", "wh_code", "unit_code"}, balanceColumns)
+	for start := 0; start < len(balances); start += batchSize {
+		end := start + batchSize
+		if end > len(balances) {
+			end = len(balances)
+		}
+
+		var values []string
+		var params queryParams
+		for _, item := range balances[start:end] {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				values = append(values, params.row(balanceValues(itemMap)...))
+			}
+		}
+		if len(values) > 0 {
+			tx.ExecuteCommand(fmt.Sprintf(upsertFormat, strings.Join(values, ",")), params.values...)
+		}
+	}
+
+	return tx.CommitTransaction()
+}
+
+// balanceColumns column ของ ic_balance ตามลำดับค่าที่ balanceValues คืน
+var balanceColumns = []string{"ic_code", "wh_code", "unit_code", "balance_qty", "available_qty"}
+
+// balanceValues ดึงค่าของยอดคงเหลือตามลำดับ column ใน balanceColumns (รองรับทั้งชื่อ field ของ API และของ ic_balance)
+func balanceValues(item map[string]interface{}) []interface{} {
+	whCode := item["wh_code"]
+	if whCode == nil {
+		whCode = item["warehouse"]
+	}
+	unitCode := item["unit_code"]
+	if unitCode == nil {
+		unitCode = item["ic_unit_code"]
+	}
+	return []interface{}{
+		parseStringValue(item["ic_code"]),
+		parseStringValue(whCode),
+		parseStringValue(unitCode),
+		item["balance_qty"],
+		item["available_qty"],
+	}
+}
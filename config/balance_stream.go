@@ -0,0 +1,359 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// BalanceRowSource คืนยอดคงเหลือจาก local ทีละแถว (nil = หมดแล้ว)
+// แถวต้องเรียงตาม ic_code, wh_code, unit_code แบบ COLLATE "C" (ลำดับ byte เดียวกับการเทียบ string ของ Go)
+type BalanceRowSource func() (map[string]interface{}, error)
+
+// balanceKey key ของ ic_balance (ic_code, wh_code, unit_code)
+type balanceKey [3]string
+
+// compareBalanceKeys เทียบ key ตามลำดับ byte (ตรงกับ COLLATE "C")
+func compareBalanceKeys(a, b balanceKey) int {
+	for i := range a {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// SyncInventoryBalanceData เทียบยอดคงเหลือจาก source กับ ic_balance บน server แบบ merge-join แล้วส่งเฉพาะส่วนที่ต่างกัน
+// ทั้งสองฝั่งถูกอ่านตามลำดับ key พร้อมกัน (server ทีละหน้าด้วย SelectPages) และส่งการเปลี่ยนแปลงทุก batchSize รายการ
+// memory ที่ใช้จึงขึ้นกับขนาดหน้า, batchSize และ concurrency ของ pipeline ไม่ใช่ขนาดของตาราง
+// ระหว่างที่ batch ก่อนหน้ากำลังส่ง (ตาม api.pipeline ของ ic_balance) การเทียบหน้าถัดไปยังทำต่อได้
+// filter คือเงื่อนไข WHERE ของ ic_balance บน server (ว่าง = ทั้งตาราง) และต้องเลือกแถวชุดเดียวกับ source
+// ถ้าดึงข้อมูลจาก server ไม่ครบ จะคืน error โดยไม่ลบแถวที่ยังไม่ได้เทียบ
+func (api *APIClient) SyncInventoryBalanceData(source BalanceRowSource, filter string, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBalanceBatchSize
+	}
+	diff := &balanceDiff{api: api, batchSize: batchSize}
+	local := &balanceCursor{source: source}
+
+	err := api.SelectPages(PagedSelect{
+		Table:        "ic_balance",
+		Columns:      balanceColumns,
+		KeyColumns:   []string{"ic_code", "wh_code", "unit_code"},
+		KeyCollation: "C",
+		Filter:       filter,
+	}, func(rows []map[string]interface{}) error {
+		for _, serverRow := range rows {
+			serverValues := balanceValues(serverRow)
+			serverKey := balanceKey{parseStringValue(serverValues[0]), parseStringValue(serverValues[1]), parseStringValue(serverValues[2])}
+
+			// แถวของ local ที่ key น้อยกว่าไม่มีบน server - ต้อง insert
+			for {
+				item, key, err := local.peek()
+				if err != nil {
+					return err
+				}
+				if item == nil || compareBalanceKeys(key, serverKey) >= 0 {
+					break
+				}
+				diff.upsert(item, true)
+				local.advance()
+			}
+
+			item, key, err := local.peek()
+			if err != nil {
+				return err
+			}
+			if item != nil && compareBalanceKeys(key, serverKey) == 0 {
+				// มีทั้งสองฝั่ง - ส่งเมื่อจำนวนเปลี่ยน
+				localValues := balanceValues(item)
+				if balanceQtyChanged(serverValues[3], localValues[3]) || balanceQtyChanged(serverValues[4], localValues[4]) {
+					diff.upsert(item, false)
+				}
+				local.advance()
+			} else {
+				// มีบน server แต่ไม่มีใน local - ต้อง delete
+				diff.delete(serverKey)
+			}
+		}
+		diff.flushFull()
+		return diff.failed()
+	})
+	if err != nil {
+		diff.flush()
+		return diff.succeeded, fmt.Errorf("error comparing ic_balance with server: %w", err)
+	}
+
+	// แถวที่เหลือของ local ไม่มีบน server - ต้อง insert
+	for {
+		item, _, err := local.peek()
+		if err != nil {
+			diff.flush()
+			return diff.succeeded, err
+		}
+		if item == nil {
+			break
+		}
+		diff.upsert(item, true)
+		local.advance()
+		diff.flushFull()
+		if err := diff.failed(); err != nil {
+			diff.flush()
+			return diff.succeeded, fmt.Errorf("error syncing ic_balance: %w", err)
+		}
+	}
+	diff.flush()
+	if diff.err != nil {
+		return diff.succeeded, fmt.Errorf("error syncing ic_balance: %w", diff.err)
+	}
+
+	fmt.Printf("🎉 Sync balance เสร็จสิ้นทั้งหมด: %d รายการสำเร็จ (Delete: %d, Insert: %d, Update: %d, ไม่เปลี่ยน: %d)\n",
+		diff.succeeded, diff.deleted, diff.inserted, diff.updated, local.read-diff.inserted-diff.updated)
+	if len(diff.failures) > 0 {
+		return diff.succeeded, fmt.Errorf("sync balance ไม่สำเร็จ %d batch: %s", len(diff.failures), strings.Join(diff.failures, "; "))
+	}
+	return diff.succeeded, nil
+}
+
+// balanceCursor อ่าน BalanceRowSource ล่วงหน้าหนึ่งแถว ข้ามแถวที่ key ไม่ครบหรือซ้ำกับแถวก่อนหน้า
+type balanceCursor struct {
+	source BalanceRowSource
+	item   map[string]interface{}
+	key    balanceKey
+	last   *balanceKey
+	done   bool
+	read   int
+}
+
+// peek คืนแถวปัจจุบันโดยไม่เลื่อน (nil = หมดแล้ว)
+func (c *balanceCursor) peek() (map[string]interface{}, balanceKey, error) {
+	for c.item == nil && !c.done {
+		item, err := c.source()
+		if err != nil {
+			return nil, balanceKey{}, fmt.Errorf("error reading local balance: %v", err)
+		}
+		if item == nil {
+			c.done = true
+			break
+		}
+
+		values := balanceValues(item)
+		key := balanceKey{parseStringValue(values[0]), parseStringValue(values[1]), parseStringValue(values[2])}
+		if key[0] == "" || key[1] == "" || key[2] == "" {
+			// ข้าม record ที่มีข้อมูลไม่ครบ
+			continue
+		}
+		if c.last != nil {
+			if cmp := compareBalanceKeys(key, *c.last); cmp == 0 {
+				fmt.Printf("⚠️ ข้ามยอดคงเหลือที่ key ซ้ำ: %s|%s|%s\n", key[0], key[1], key[2])
+				continue
+			} else if cmp < 0 {
+				return nil, balanceKey{}, fmt.Errorf("local balance rows are not sorted at %s|%s|%s", key[0], key[1], key[2])
+			}
+		}
+
+		c.item = item
+		c.key = key
+		c.read++
+	}
+	return c.item, c.key, nil
+}
+
+// advance เลื่อนไปแถวถัดไป
+func (c *balanceCursor) advance() {
+	key := c.key
+	c.last = &key
+	c.item = nil
+}
+
+// balanceDiff สะสมการเปลี่ยนแปลงของ ic_balance แล้วส่งทีละ batchSize รายการผ่าน pipeline ของ ic_balance
+// batch ถูกส่งพร้อมกันได้ เพราะ merge-join ให้แต่ละ key เป็น insert, update หรือ delete เพียงครั้งเดียว
+// batch ที่ส่งพร้อมกันจึงไม่มี key ซ้ำกัน ผลของแต่ละ batch ถูกรวมภายใต้ mu และอ่านได้ครบหลัง flush
+type balanceDiff struct {
+	api       *APIClient
+	batchSize int
+	upserts   []map[string]interface{}
+	deletes   []balanceKey
+	pipeline  *batchPipeline
+
+	inserted int
+	updated  int
+	deleted  int
+
+	mu        sync.Mutex
+	succeeded int
+	failures  []string
+	err       error // ErrCircuitOpen - หยุดส่งรายการที่เหลือ
+}
+
+// upsert เพิ่มแถวที่ต้อง insert (inserted = true) หรือ update
+func (d *balanceDiff) upsert(item map[string]interface{}, inserted bool) {
+	d.upserts = append(d.upserts, item)
+	if inserted {
+		d.inserted++
+	} else {
+		d.updated++
+	}
+}
+
+// delete เพิ่ม key ที่ต้องลบ
+func (d *balanceDiff) delete(key balanceKey) {
+	d.deletes = append(d.deletes, key)
+	d.deleted++
+}
+
+// flushFull ส่งเฉพาะรายการที่สะสมครบ batchSize แล้ว (ไม่รอผล)
+func (d *balanceDiff) flushFull() {
+	if len(d.deletes) >= d.batchSize {
+		d.flushDeletes()
+	}
+	if len(d.upserts) >= d.batchSize {
+		d.flushUpserts()
+	}
+}
+
+// flush ส่งรายการที่สะสมไว้ทั้งหมดแล้วรอจนทุก batch เสร็จ
+func (d *balanceDiff) flush() {
+	d.flushDeletes()
+	d.flushUpserts()
+	if d.pipeline != nil {
+		d.pipeline.wait()
+		d.pipeline = nil
+	}
+}
+
+// failed คืน error ที่ทำให้ต้องหยุดส่ง (nil = ส่งต่อได้)
+func (d *balanceDiff) failed() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// stopped ตรวจว่าต้องหยุดส่ง (circuit breaker เปิด) โดยทิ้งรายการที่สะสมไว้ให้ full reconcile รอบหน้าเทียบใหม่
+func (d *balanceDiff) stopped() bool {
+	if d.failed() == nil {
+		return false
+	}
+	d.upserts = nil
+	d.deletes = nil
+	return true
+}
+
+// flushDeletes ลบ key ที่สะสมไว้ด้วยคำสั่ง DELETE ... USING (VALUES ...) ครั้งละ batchSize รายการ
+func (d *balanceDiff) flushDeletes() {
+	if len(d.deletes) == 0 || d.stopped() {
+		return
+	}
+	deletes := d.deletes
+	d.deletes = nil
+
+	for start := 0; start < len(deletes); start += d.batchSize {
+		end := start + d.batchSize
+		if end > len(deletes) {
+			end = len(deletes)
+		}
+
+		var keys []string
+		var params queryParams
+		for _, key := range deletes[start:end] {
+			keys = append(keys, fmt.Sprintf("(%s::VARCHAR, %s::VARCHAR, %s::VARCHAR)",
+				params.add(key[0]), params.add(key[1]), params.add(key[2])))
+		}
+		d.submit("delete", end-start, fmt.Sprintf(`
+			DELETE FROM ic_balance t
+			USING (VALUES %s) AS v(ic_code, wh_code, unit_code)
+			WHERE t.ic_code = v.ic_code AND t.wh_code = v.wh_code AND t.unit_code = v.unit_code
+		`, strings.Join(keys, ",")), params.values)
+	}
+}
+
+// flushUpserts ส่งแถวที่สะสมไว้ด้วย upsert หลายแถวต่อคำสั่ง ครั้งละ batchSize รายการ
+func (d *balanceDiff) flushUpserts() {
+	if len(d.upserts) == 0 || d.stopped() {
+		return
+	}
+	upserts := d.upserts
+	d.upserts = nil
+
+	// ปลายทางที่รองรับ bulk load (PostgreSQL โดยตรง) ส่งทั้งชุดด้วย COPY
+	if bulk, ok := d.api.target.(BulkUpserter); ok && d.api.tx == nil {
+		rows := make([][]interface{}, len(upserts))
+		for i, item := range upserts {
+			rows[i] = balanceValues(item)
+		}
+		d.run(func() {
+			resp, err := bulk.BulkUpsert("ic_balance", []string{"ic_code", "wh_code", "unit_code"}, balanceColumns, rows)
+			if err == nil && !resp.Success {
+				err = fmt.Errorf("%s", resp.Message)
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if err != nil {
+				fmt.Printf("❌ ERROR: upsert balance ด้วย COPY %d รายการล้มเหลว: %v\n", len(rows), err)
+				d.failures = append(d.failures, fmt.Sprintf("copy upsert (%d รายการ): %v", len(rows), err))
+				return
+			}
+			d.succeeded += len(rows)
+			fmt.Printf("⏳ upsert balance ด้วย COPY สำเร็จ: %d รายการ\n", len(rows))
+		})
+		return
+	}
+
+	upsertFormat := upsertQueryFormat("ic_balance", []string{"ic_code", "wh_code", "unit_code"}, balanceColumns)
+	for start := 0; start < len(upserts); start += d.batchSize {
+		end := start + d.batchSize
+		if end > len(upserts) {
+			end = len(upserts)
+		}
+
+		var values []string
+		var params queryParams
+		for _, item := range upserts[start:end] {
+			values = append(values, params.row(balanceValues(item)...))
+		}
+		d.submit("upsert", end-start, fmt.Sprintf(upsertFormat, strings.Join(values, ",")), params.values)
+	}
+}
+
+// run ส่งงานเข้า pipeline ของ ic_balance (สร้างเมื่อใช้ครั้งแรก) งานที่ถึงคิวหลังต้องหยุดส่งจะถูกข้าม
+func (d *balanceDiff) run(job func()) {
+	if d.pipeline == nil {
+		d.pipeline = d.api.pipeline("ic_balance")
+	}
+	d.pipeline.submit(func() {
+		if d.failed() != nil {
+			return
+		}
+		job()
+	})
+}
+
+// submit ส่งคำสั่งของ batch หนึ่ง (count รายการ) แล้วบันทึกผล batch ที่ล้มเหลวจะไม่หยุด batch อื่น
+// ยกเว้นเมื่อ circuit breaker เปิด จะหยุดส่ง batch ที่เหลือทั้งหมด
+func (d *balanceDiff) submit(label string, count int, query string, params []interface{}) {
+	d.run(func() {
+		resp, err := d.api.ExecuteCommand(query, params...)
+		if err == nil && !resp.Success {
+			err = fmt.Errorf("%s", resp.Message)
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if errors.Is(err, ErrCircuitOpen) {
+			if d.err == nil {
+				fmt.Printf("❌ ERROR: หยุดส่ง balance ที่เหลือ: %v\n", err)
+				d.err = err
+			}
+			d.failures = append(d.failures, fmt.Sprintf("%s %d รายการ: %v", label, count, err))
+			return
+		}
+		if err != nil {
+			fmt.Printf("❌ ERROR: %s balance batch %d รายการล้มเหลว: %v\n", label, count, err)
+			d.failures = append(d.failures, fmt.Sprintf("%s batch (%d รายการ): %v", label, count, err))
+			return
+		}
+		d.succeeded += count
+		fmt.Printf("⏳ %s balance batch สำเร็จ: %d รายการ (รวม %d รายการ)\n", label, count, d.succeeded)
+	})
+}
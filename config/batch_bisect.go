@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// batchRow แถวหนึ่งของคำสั่ง INSERT หลายแถว
+// item คือรายการต้นฉบับ (ใช้บันทึกผลตาม row_order_ref) ส่วน values คือค่าตามลำดับ column
+type batchRow struct {
+	item   interface{}
+	values []interface{}
+}
+
+// executeBatchBisect ส่งคำสั่ง INSERT หลายแถวในครั้งเดียว queryFormat ต้องมี %s หนึ่งตำแหน่งสำหรับ VALUES
+// ถ้า server ปฏิเสธ batch (เช่น barcode ซ้ำ หรือชื่อยาวเกิน) จะแบ่งครึ่งแล้วส่งใหม่จนเหลือแถวที่ผิดจริง
+// แถวที่ถูกต้องจะถูกบันทึกตามปกติ ส่วนแถวที่ผิดจะถูกบันทึกลง result พร้อมข้อความ error จาก server
+// ถ้าติดต่อ server ไม่ได้ (ไม่มี response) จะไม่แบ่งต่อ เพราะทุกแถวก็จะล้มเหลวเหมือนกัน
+// ถ้า circuit breaker เปิดอยู่ แถวจะถูกบันทึกเป็น skipped (ดู SyncResult.markError)
+// คืนค่าจำนวนแถวที่บันทึกสำเร็จ
+func (api *APIClient) executeBatchBisect(queryFormat string, rows []batchRow, result *SyncResult) int {
+	if len(rows) == 0 {
+		return 0
+	}
+	if result.stopped != nil {
+		result.markError(batchRowItems(rows), result.stopped)
+		return 0
+	}
+
+	var values []string
+	var params queryParams
+	for _, row := range rows {
+		values = append(values, params.row(row.values...))
+	}
+
+	resp, err := api.ExecuteCommand(fmt.Sprintf(queryFormat, strings.Join(values, ",")), params.values...)
+	if err == nil && resp.Success {
+		return len(rows)
+	}
+
+	message := ""
+	if resp != nil {
+		message = resp.Message
+		if message == "" {
+			message = resp.Error
+		}
+	}
+	if message == "" && err != nil {
+		message = err.Error()
+	}
+
+	if errors.Is(err, ErrCircuitOpen) {
+		// คำขอไม่ได้ถูกส่ง รายการจึงยังไม่ได้ส่ง ไม่ใช่ถูกปฏิเสธ
+		result.markError(batchRowItems(rows), err)
+		return 0
+	}
+	if resp == nil || len(rows) == 1 {
+		result.markFailed(batchRowItems(rows), message)
+		return 0
+	}
+
+	mid := len(rows) / 2
+	fmt.Printf("   🔍 batch %d รายการถูกปฏิเสธ (%s) แบ่งเป็น %d + %d รายการเพื่อหาแถวที่ผิด\n",
+		len(rows), message, mid, len(rows)-mid)
+	return api.executeBatchBisect(queryFormat, rows[:mid], result) +
+		api.executeBatchBisect(queryFormat, rows[mid:], result)
+}
+
+func batchRowItems(rows []batchRow) []interface{} {
+	items := make([]interface{}, len(rows))
+	for i, row := range rows {
+		items[i] = row.item
+	}
+	return items
+}
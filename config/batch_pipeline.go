@@ -0,0 +1,232 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PipelineLimits ขีดจำกัดการส่ง batch ไปยังตารางหนึ่งบน server
+type PipelineLimits struct {
+	Concurrency       int     `json:"concurrency"`         // จำนวน batch ที่ส่งพร้อมกันสูงสุด
+	RequestsPerSecond float64 `json:"requests_per_second"` // จำนวนคำขอต่อวินาทีสูงสุด (0 = ไม่จำกัด)
+	Burst             int     `json:"burst"`               // จำนวนคำขอที่ส่งติดกันได้ก่อนถูกจำกัด (0 = concurrency)
+}
+
+// APIPipelineConfig ขีดจำกัดการส่ง batch (section "api.pipeline" ใน smlmarketsync.json)
+// Targets ระบุตามชื่อตาราง (เช่น "ic_balance") field ที่เป็น 0 ใช้ค่าจาก Default
+type APIPipelineConfig struct {
+	Default PipelineLimits            `json:"default"` // SMLMARKETSYNC_API_PIPELINE_CONCURRENCY, SMLMARKETSYNC_API_PIPELINE_REQUESTS_PER_SECOND
+	Targets map[string]PipelineLimits `json:"targets"`
+}
+
+// limits ขีดจำกัดของตาราง target
+func (p APIPipelineConfig) limits(target string) PipelineLimits {
+	limits := p.Default
+	if override, ok := p.Targets[target]; ok {
+		if override.Concurrency > 0 {
+			limits.Concurrency = override.Concurrency
+		}
+		if override.RequestsPerSecond > 0 {
+			limits.RequestsPerSecond = override.RequestsPerSecond
+		}
+		if override.Burst > 0 {
+			limits.Burst = override.Burst
+		}
+	}
+	if limits.Burst <= 0 {
+		limits.Burst = limits.Concurrency
+	}
+	return limits
+}
+
+// validate ตรวจขีดจำกัดของทุกตาราง
+func (p APIPipelineConfig) validate() error {
+	if p.Default.Concurrency < 1 {
+		return fmt.Errorf("pipeline.default.concurrency ต้องไม่น้อยกว่า 1")
+	}
+	check := func(name string, limits PipelineLimits) error {
+		if limits.Concurrency < 0 || limits.RequestsPerSecond < 0 || limits.Burst < 0 {
+			return fmt.Errorf("pipeline.%s: concurrency, requests_per_second และ burst ต้องไม่ติดลบ", name)
+		}
+		return nil
+	}
+	if err := check("default", p.Default); err != nil {
+		return err
+	}
+	for target, limits := range p.Targets {
+		if err := check("targets."+target, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimiter token bucket: เติม token ตาม rate ต่อวินาที เก็บได้ไม่เกิน burst ทุกคำขอใช้ 1 token
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait รอจนมี token (limiter เป็น nil = ไม่จำกัด)
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// จอง token ไว้ก่อน (ติดลบได้) ผู้รอคนถัดไปจึงรอต่อคิวอย่างถูกต้อง
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// pipelineLimiters rate limiter ของแต่ละตาราง ใช้ร่วมกันทุก pipeline ของ client (รวมถึง client ของ transaction)
+type pipelineLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+func (p *pipelineLimiters) get(target string, limits PipelineLimits) *rateLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.limiters == nil {
+		p.limiters = make(map[string]*rateLimiter)
+	}
+	limiter, ok := p.limiters[target]
+	if !ok {
+		limiter = newRateLimiter(limits.RequestsPerSecond, limits.Burst)
+		p.limiters[target] = limiter
+	}
+	return limiter
+}
+
+// batchPipeline ส่ง batch ของตารางหนึ่งด้วย worker ไม่เกิน concurrency ตัว และไม่เกิน requests_per_second
+// submit จะรอเมื่อคิวเต็ม memory ที่ใช้จึงไม่เกินจำนวน batch ที่รอส่งตามขนาดคิว
+// batch ที่ส่งพร้อมกันต้องไม่มี key ซ้ำกัน ถ้ามีการเปลี่ยนแปลงของ key เดียวกันตามลำดับต้อง wait ก่อนส่งชุดถัดไป
+// client ของ transaction ใช้ worker เดียวและไม่จำกัดอัตรา (คำสั่งถูกเก็บตามลำดับเดิมแล้วส่งตอน commit)
+type batchPipeline struct {
+	limiter *rateLimiter
+	jobs    chan func()
+	wg      sync.WaitGroup
+}
+
+// pipeline สร้าง batchPipeline ของตาราง target (ต้องเรียก wait เมื่อส่งครบแล้ว)
+func (api *APIClient) pipeline(target string) *batchPipeline {
+	limits := api.config.Pipeline.limits(target)
+	workers := limits.Concurrency
+	var limiter *rateLimiter
+	if api.tx != nil {
+		workers = 1
+	} else {
+		limiter = api.limiters.get(target, limits)
+	}
+
+	p := &batchPipeline{limiter: limiter, jobs: make(chan func(), workers)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				p.limiter.wait()
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// submit ส่งงานเข้าคิว (รอถ้าคิวเต็ม)
+func (p *batchPipeline) submit(job func()) {
+	p.jobs <- job
+}
+
+// wait รอให้ทุกงานที่ส่งเข้าคิวเสร็จ (ใช้ pipeline ต่อไม่ได้)
+func (p *batchPipeline) wait() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// runBatches แบ่ง items เป็น batch ละ batchSize แล้วเรียก send(b, start, end, batchResult) ของทุก batch ผ่าน pipeline ของ target
+// send ของแต่ละ batch อาจถูกเรียกพร้อมกัน จึงบันทึกรายการที่ไม่สำเร็จลง batchResult ของตัวเอง
+// แล้วรวมเข้า result ตามลำดับ batch หลังทุก batch เสร็จ คืนค่าผลรวมของจำนวนที่ send คืน
+// เมื่อ circuit breaker เปิด (result หรือ batch ใดบันทึกด้วย markError) batch ที่เหลือจะไม่ถูกส่ง
+// รายการของ batch เหล่านั้นถูกบันทึกเป็น skipped เพื่อปลดการจองไว้ส่งรอบหน้า
+func (api *APIClient) runBatches(target string, items []interface{}, batchSize int, result *SyncResult, send func(b, start, end int, batchResult *SyncResult) int) int {
+	total := len(items)
+	if result.stopped != nil {
+		result.markError(items, result.stopped)
+		return 0
+	}
+
+	batchCount := (total + batchSize - 1) / batchSize
+	counts := make([]int, batchCount)
+	results := make([]*SyncResult, batchCount)
+
+	var mu sync.Mutex
+	var stopped error
+	p := api.pipeline(target)
+	for b := 0; b < batchCount; b++ {
+		start := b * batchSize
+		end := start + batchSize
+		if end > total {
+			end = total
+		}
+		b := b
+		results[b] = newSyncResult()
+		p.submit(func() {
+			mu.Lock()
+			err := stopped
+			mu.Unlock()
+			if err != nil {
+				results[b].markError(items[start:end], err)
+				return
+			}
+
+			counts[b] = send(b, start, end, results[b])
+			if results[b].stopped != nil {
+				mu.Lock()
+				if stopped == nil {
+					fmt.Printf("❌ ERROR: หยุดส่ง batch ที่เหลือของ %s: %v\n", target, results[b].stopped)
+					stopped = results[b].stopped
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	p.wait()
+
+	sum := 0
+	for b := range results {
+		sum += counts[b]
+		result.merge(results[b])
+	}
+	return sum
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		drain   int           // จำนวนคำขอก่อนหน้า
+		elapsed time.Duration // เวลาที่ผ่านไปก่อนคำขอสุดท้าย
+		want    float64       // token ที่เหลือหลังคำขอสุดท้าย
+	}{
+		{name: "starts with a full bucket", rate: 10, burst: 3, want: 2},
+		{name: "zero burst holds one token", rate: 10, burst: 0, want: 0},
+		{name: "refills by elapsed time", rate: 10, burst: 5, drain: 5, elapsed: 200 * time.Millisecond, want: 1},
+		{name: "refill is capped at burst", rate: 10, burst: 2, drain: 2, elapsed: 10 * time.Second, want: 1},
+		{name: "empty bucket reserves a token ahead", rate: 100, burst: 1, drain: 1, want: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(tt.rate, tt.burst)
+			for i := 0; i < tt.drain; i++ {
+				limiter.wait()
+			}
+			limiter.last = time.Now().Add(-tt.elapsed)
+			limiter.wait()
+			if math.Abs(limiter.tokens-tt.want) > 0.01 {
+				t.Errorf("tokens = %.3f, want %.3f", limiter.tokens, tt.want)
+			}
+		})
+	}
+
+	if limiter := newRateLimiter(0, 5); limiter != nil {
+		t.Errorf("newRateLimiter(0, 5) = %+v, want nil (no limit)", limiter)
+	}
+}
+
+func TestRunBatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		refs        []int
+		concurrency int
+		stopped     bool // result ถูกหยุดด้วย ErrCircuitOpen ก่อนเรียก
+		openAt      int  // batch ที่พบ circuit breaker เปิด (-1 = ไม่มี)
+		wantSent    []int
+		wantCount   int
+		wantFailed  map[int]string
+		wantSkipped []int
+	}{
+		{
+			// batch หลังเสร็จก่อน แต่ผลของ batch หลังต้องทับ batch ก่อนเมื่อ row_order_ref ซ้ำกัน
+			name:        "counts are summed and results merged in batch order",
+			refs:        []int{1, 2, 3, 4, 3, 6},
+			concurrency: 3,
+			openAt:      -1,
+			wantSent:    []int{0, 1, 2},
+			wantCount:   3,
+			wantFailed:  map[int]string{1: "batch 0", 3: "batch 2"},
+		},
+		{
+			name:        "open circuit stops the remaining batches",
+			refs:        []int{2, 4, 6, 8, 10, 12},
+			concurrency: 1,
+			openAt:      1,
+			wantSent:    []int{0, 1},
+			wantCount:   2,
+			wantFailed:  map[int]string{},
+			wantSkipped: []int{6, 8, 10, 12},
+		},
+		{
+			name:        "stopped result sends nothing",
+			refs:        []int{2, 4, 6},
+			concurrency: 2,
+			stopped:     true,
+			openAt:      -1,
+			wantFailed:  map[int]string{},
+			wantSkipped: []int{2, 4, 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultAPIConfig()
+			config.Pipeline = APIPipelineConfig{Default: PipelineLimits{Concurrency: tt.concurrency}}
+			api := &APIClient{config: config, limiters: &pipelineLimiters{}}
+
+			items := make([]interface{}, len(tt.refs))
+			for i, ref := range tt.refs {
+				items[i] = ref
+			}
+			result := newSyncResult()
+			if tt.stopped {
+				result.markError(nil, fmt.Errorf("%w: test", ErrCircuitOpen))
+			}
+
+			var mu sync.Mutex
+			var sent []int
+			batchCount := (len(items) + 1) / 2
+			count := api.runBatches("t", items, 2, result, func(b, start, end int, batchResult *SyncResult) int {
+				mu.Lock()
+				sent = append(sent, b)
+				mu.Unlock()
+				// ให้ batch หลังเสร็จก่อน
+				time.Sleep(time.Duration(batchCount-b) * 5 * time.Millisecond)
+
+				if b == tt.openAt {
+					batchResult.markError(items[start:end], fmt.Errorf("%w: test", ErrCircuitOpen))
+					return 0
+				}
+				sentCount := 0
+				for _, item := range items[start:end] {
+					if item.(int)%2 == 1 {
+						batchResult.markFailed([]interface{}{item}, fmt.Sprintf("batch %d", b))
+					} else {
+						sentCount++
+					}
+				}
+				return sentCount
+			})
+
+			sort.Ints(sent)
+			var skipped []int
+			for ref := range result.skippedRefs {
+				skipped = append(skipped, ref)
+			}
+			sort.Ints(skipped)
+
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Errorf("sent batches = %v, want %v", sent, tt.wantSent)
+			}
+			if count != tt.wantCount {
+				t.Errorf("runBatches() = %d, want %d", count, tt.wantCount)
+			}
+			if !reflect.DeepEqual(result.failedRefs, tt.wantFailed) {
+				t.Errorf("failed = %v, want %v", result.failedRefs, tt.wantFailed)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+			if wantStopped := tt.stopped || tt.openAt >= 0; (result.stopped != nil) != wantStopped {
+				t.Errorf("stopped = %v, want stopped %v", result.stopped, wantStopped)
+			}
+		})
+	}
+}
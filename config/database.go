@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -18,28 +22,102 @@ type DatabaseConfig struct {
 	DBName   string `json:"dbname"`
 }
 
+// BalanceConfig การตั้งค่าการ sync ic_balance (section "balance" ใน smlmarketsync.json)
+type BalanceConfig struct {
+	BatchSize         int  `json:"batch_size"`          // จำนวนแถวต่อคำสั่ง upsert/delete (0 = DefaultBalanceBatchSize)
+	ChecksumBuckets   int  `json:"checksum_buckets"`    // จำนวนกลุ่มที่ใช้เทียบ checksum ตอน full reconcile (0 = DefaultBalanceChecksumBuckets)
+	SellableUnits     bool `json:"sellable_units"`      // ส่งยอดของทุกหน่วยที่มีบาร์โค้ด (แปลงจาก unit_standard ตาม ic_unit_use) นอกจาก unit_standard
+	FloorPartialUnits bool `json:"floor_partial_units"` // ปัด available_qty ของหน่วยที่ไม่ใช่ unit_standard ลงเป็นจำนวนเต็ม (ไม่ขายแพ็คที่ไม่ครบ)
+	// ReconcileIntervalHours ระยะเวลาระหว่าง full reconcile เป็นชั่วโมง (0 = DefaultBalanceReconcileInterval)
+	// SMLMARKETSYNC_BALANCE_RECONCILE_INTERVAL_HOURS
+	ReconcileIntervalHours int `json:"reconcile_interval_hours"`
+}
+
+// balanceEnvPrefix prefix ของ environment variable ที่แทนค่าใน section "balance"
+const balanceEnvPrefix = "SMLMARKETSYNC_BALANCE_"
+
+// DefaultBalanceBatchSize จำนวนแถวต่อคำสั่งของ ic_balance เมื่อไม่ได้ตั้งค่า
+const DefaultBalanceBatchSize = 500
+
 type Config struct {
-	Database DatabaseConfig `json:"database"`
+	Database     DatabaseConfig      `json:"database"`
+	Balance      BalanceConfig       `json:"balance"`
+	StockRules   *StockRules         `json:"stock_rules"`
+	Availability *AvailabilityConfig `json:"availability"`
+	Warehouses   *WarehouseConfig    `json:"warehouses"`
+	Target       *TargetConfig       `json:"target"`
+	API          *APIConfig          `json:"api"`
 }
 
-func NewDatabaseConfig() *DatabaseConfig {
-	// อ่านไฟล์ smlmarketsync.json
-	configPath := "smlmarketsync.json"
+// configPath ไฟล์การตั้งค่าของโปรแกรม
+const configPath = "smlmarketsync.json"
+
+// loadConfig อ่านและแปลงไฟล์ smlmarketsync.json
+func loadConfig() (*Config, error) {
 	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		log.Fatalf("❌ Error: ไม่สามารถอ่านไฟล์ %s: %v\nโปรแกรมจบการทำงาน", configPath, err)
+		return nil, fmt.Errorf("ไม่สามารถอ่านไฟล์ %s: %v", configPath, err)
 	}
 
 	var config Config
 	err = json.Unmarshal(data, &config)
 	if err != nil {
-		log.Fatalf("❌ Error: ไม่สามารถแปลงไฟล์ JSON: %v\nโปรแกรมจบการทำงาน", err)
+		return nil, fmt.Errorf("ไม่สามารถแปลงไฟล์ JSON: %v", err)
+	}
+	return &config, nil
+}
+
+func NewDatabaseConfig() *DatabaseConfig {
+	// อ่านไฟล์ smlmarketsync.json
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("❌ Error: %v\nโปรแกรมจบการทำงาน", err)
 	}
 
 	log.Printf("✅ โหลดการตั้งค่าจาก smlmarketsync.json สำเร็จ: %s:%d", config.Database.Host, config.Database.Port)
 	return &config.Database
 }
 
+// NewBalanceConfig อ่านการตั้งค่า balance จาก smlmarketsync.json (ถ้าไม่มี section นี้จะใช้ค่าเริ่มต้น)
+// แล้วแทนด้วย environment variable ที่ตั้งไว้
+func NewBalanceConfig() *BalanceConfig {
+	balance := &BalanceConfig{BatchSize: DefaultBalanceBatchSize, ChecksumBuckets: DefaultBalanceChecksumBuckets}
+	config, err := loadConfig()
+	if err != nil {
+		log.Printf("⚠️ Warning: %v (ใช้การตั้งค่า balance เริ่มต้น)", err)
+	} else {
+		if config.Balance.BatchSize > 0 {
+			balance.BatchSize = config.Balance.BatchSize
+		}
+		if config.Balance.ChecksumBuckets > 0 {
+			balance.ChecksumBuckets = config.Balance.ChecksumBuckets
+		}
+		balance.SellableUnits = config.Balance.SellableUnits
+		balance.FloorPartialUnits = config.Balance.FloorPartialUnits
+		balance.ReconcileIntervalHours = config.Balance.ReconcileIntervalHours
+	}
+
+	if value, ok := os.LookupEnv(balanceEnvPrefix + "RECONCILE_INTERVAL_HOURS"); ok {
+		hours, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("❌ Error: %sRECONCILE_INTERVAL_HOURS ต้องเป็นจำนวนเต็ม: %q\nโปรแกรมจบการทำงาน", balanceEnvPrefix, value)
+		}
+		balance.ReconcileIntervalHours = hours
+	}
+	if balance.ReconcileIntervalHours < 0 {
+		log.Fatalf("❌ Error: balance.reconcile_interval_hours ไม่ถูกต้อง: ต้องไม่ติดลบ (0 = %v)\nโปรแกรมจบการทำงาน", DefaultBalanceReconcileInterval)
+	}
+	return balance
+}
+
+// ReconcileInterval ระยะเวลาระหว่างการเทียบ ic_balance ทั้งตาราง
+func (b *BalanceConfig) ReconcileInterval() time.Duration {
+	if b.ReconcileIntervalHours == 0 {
+		return DefaultBalanceReconcileInterval
+	}
+	return time.Duration(b.ReconcileIntervalHours) * time.Hour
+}
+
 func (config *DatabaseConfig) Connect() (*sql.DB, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		config.Host, config.Port, config.User, config.Password, config.DBName)
@@ -81,13 +159,19 @@ func CreateSyncTable(db *sql.DB) error {
 	// table_id 1=ic_inventory_price
 	// active_code 1=insert, 2=update, 3=delete
 	// row_order_ref = roworder จำนวนในตาราง
+	// claim_run_id, claimed_at = run ที่กำลังส่งข้อมูลแถวนี้อยู่ (NULL = ยังไม่มีใครจอง)
+	// new_data, old_data = snapshot ของแถว (NEW/OLD ของ trigger) ณ เวลาที่เกิดการเปลี่ยนแปลง
 
 	query := `
 		CREATE TABLE IF NOT EXISTS sml_market_sync (
 			id SERIAL PRIMARY KEY,
 			table_id INT NOT NULL,
 			active_code INT DEFAULT 0,
-			row_order_ref INT DEFAULT 0
+			row_order_ref INT DEFAULT 0,
+			claim_run_id VARCHAR(64),
+			claimed_at TIMESTAMP,
+			new_data JSONB,
+			old_data JSONB
 		)
 	`
 
@@ -99,6 +183,24 @@ func CreateSyncTable(db *sql.DB) error {
 	return nil
 }
 
+// EnsureSyncTableColumns เพิ่ม column ที่ใช้จองแถว (claim) และ snapshot ของแถว ให้ตาราง sml_market_sync ที่สร้างไว้ก่อนหน้า
+func EnsureSyncTableColumns(db *sql.DB) error {
+	query := `
+		ALTER TABLE sml_market_sync ADD COLUMN IF NOT EXISTS claim_run_id VARCHAR(64);
+		ALTER TABLE sml_market_sync ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMP;
+		ALTER TABLE sml_market_sync ADD COLUMN IF NOT EXISTS new_data JSONB;
+		ALTER TABLE sml_market_sync ADD COLUMN IF NOT EXISTS old_data JSONB;
+		CREATE INDEX IF NOT EXISTS sml_market_sync_claim_idx ON sml_market_sync (table_id, claim_run_id);
+	`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถปรับปรุงตาราง sml_market_sync: %v", err)
+	}
+
+	return nil
+}
+
 // TriggerExists ตรวจสอบว่า trigger สำหรับตารางที่กำหนดมีอยู่หรือไม่
 func TriggerExists(db *sql.DB, tableName string) bool {
 	query := `
@@ -133,12 +235,13 @@ func PriceTriggerExists(db *sql.DB) bool {
 		return false
 	}
 
-	// ตรวจสอบ function ที่ชื่อ log_price_changes
+	// ตรวจสอบ function ที่ชื่อ log_price_changes (เวอร์ชันที่เก็บ snapshot ของแถว)
 	functionQuery := `
 		SELECT EXISTS (
 			SELECT 1 FROM information_schema.routines 
 			WHERE routine_type = 'FUNCTION'
 			AND routine_name = 'log_price_changes'
+			AND routine_definition LIKE '%to_jsonb%'
 		)
 	`
 	var functionExists bool
@@ -168,12 +271,13 @@ func InventoryTriggerExists(db *sql.DB) bool {
 		return false
 	}
 
-	// ตรวจสอบ function ที่ชื่อ log_inventory_changes
+	// ตรวจสอบ function ที่ชื่อ log_inventory_changes (เวอร์ชันที่เก็บ snapshot ของแถว)
 	functionQuery := `
 		SELECT EXISTS (
 			SELECT 1 FROM information_schema.routines 
 			WHERE routine_type = 'FUNCTION'
 			AND routine_name = 'log_inventory_changes'
+			AND routine_definition LIKE '%to_jsonb%'
 		)
 	`
 	var functionExists bool
@@ -203,12 +307,13 @@ func InventoryBarcodeTriggerExists(db *sql.DB) bool {
 		return false
 	}
 
-	// ตรวจสอบ function ที่ชื่อ log_inventory_barcode_changes
+	// ตรวจสอบ function ที่ชื่อ log_inventory_barcode_changes (เวอร์ชันที่เก็บ snapshot ของแถว)
 	functionQuery := `
 		SELECT EXISTS (
 			SELECT 1 FROM information_schema.routines 
 			WHERE routine_type = 'FUNCTION'
 			AND routine_name = 'log_inventory_barcode_changes'
+			AND routine_definition LIKE '%to_jsonb%'
 		)
 	`
 	var functionExists bool
@@ -230,18 +335,18 @@ func CreatePriceTrigger(db *sql.DB) error {
 		BEGIN
 			IF TG_OP = 'INSERT' THEN
 				-- บันทึกข้อมูลการเพิ่มราคา หลัง Insert
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (1, 1, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data)
+				VALUES (1, 1, NEW.roworder, to_jsonb(NEW));
 				
 			ELSIF TG_OP = 'UPDATE' THEN
 				-- บันทึกข้อมูลการอัพเดทราคา
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (1, 2, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data, old_data)
+				VALUES (1, 2, NEW.roworder, to_jsonb(NEW), to_jsonb(OLD));
 				
 			ELSIF TG_OP = 'DELETE' THEN
 				-- บันทึกข้อมูลการลบราคา
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (1, 3, OLD.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, old_data)
+				VALUES (1, 3, OLD.roworder, to_jsonb(OLD));
 			END IF;
 			
 			RETURN NULL; 
@@ -279,18 +384,18 @@ func CreateInventoryTrigger(db *sql.DB) error {
 		BEGIN
 			IF TG_OP = 'INSERT' THEN
 				-- บันทึกข้อมูลการเพิ่มสินค้า หลัง Insert
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (2, 1, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data)
+				VALUES (2, 1, NEW.roworder, to_jsonb(NEW));
 				
 			ELSIF TG_OP = 'UPDATE' THEN
 				-- บันทึกข้อมูลการอัพเดทสินค้า
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (2, 2, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data, old_data)
+				VALUES (2, 2, NEW.roworder, to_jsonb(NEW), to_jsonb(OLD));
 
 			ELSIF TG_OP = 'DELETE' THEN
 				-- บันทึกข้อมูลการลบสินค้า
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (2, 3, OLD.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, old_data)
+				VALUES (2, 3, OLD.roworder, to_jsonb(OLD));
 			END IF;
 			
 			RETURN NULL; 
@@ -327,18 +432,22 @@ func CreateInventoryBarcodeTrigger(db *sql.DB) error {
 		BEGIN
 			IF TG_OP = 'INSERT' THEN
 				-- บันทึกข้อมูลการเพิ่มข้อมูลบาร์โค้ด หลัง Insert
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (3, 1, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data)
+				VALUES (3, 1, NEW.roworder, to_jsonb(NEW) || jsonb_build_object(
+						'item_name', (SELECT name_1 FROM ic_inventory WHERE code = NEW.ic_code),
+						'unit_name', (SELECT name_1 FROM ic_unit WHERE code = NEW.unit_code)));
 				
 			ELSIF TG_OP = 'UPDATE' THEN
 				-- บันทึกข้อมูลการอัพเดทข้อมูลบาร์โค้ด
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (3, 2, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data, old_data)
+				VALUES (3, 2, NEW.roworder, to_jsonb(NEW) || jsonb_build_object(
+						'item_name', (SELECT name_1 FROM ic_inventory WHERE code = NEW.ic_code),
+						'unit_name', (SELECT name_1 FROM ic_unit WHERE code = NEW.unit_code)), to_jsonb(OLD));
 				
 			ELSIF TG_OP = 'DELETE' THEN
 				-- บันทึกข้อมูลการลบข้อมูลบาร์โค้ด
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (3, 3, OLD.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, old_data)
+				VALUES (3, 3, OLD.roworder, to_jsonb(OLD));
 			END IF;
 			
 			RETURN NULL; 
@@ -384,12 +493,13 @@ func CustomerTriggerExists(db *sql.DB) bool {
 		return false
 	}
 
-	// ตรวจสอบ function ที่ชื่อ log_customer_changes
+	// ตรวจสอบ function ที่ชื่อ log_customer_changes (เวอร์ชันที่เก็บ snapshot ของแถว)
 	functionQuery := `
 		SELECT EXISTS (
 			SELECT 1 FROM information_schema.routines 
 			WHERE routine_type = 'FUNCTION'
 			AND routine_name = 'log_customer_changes'
+			AND routine_definition LIKE '%to_jsonb%'
 		)
 	`
 	var functionExists bool
@@ -411,18 +521,18 @@ func CreateCustomerTrigger(db *sql.DB) error {
 		BEGIN
 			IF TG_OP = 'INSERT' THEN
 				-- บันทึกข้อมูลการเพิ่มลูกค้า หลัง Insert
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (4, 1, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data)
+				VALUES (4, 1, NEW.roworder, to_jsonb(NEW));
 				
 			ELSIF TG_OP = 'UPDATE' THEN
 				-- บันทึกข้อมูลการอัพเดทลูกค้า
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (4, 2, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data, old_data)
+				VALUES (4, 2, NEW.roworder, to_jsonb(NEW), to_jsonb(OLD));
 				
 			ELSIF TG_OP = 'DELETE' THEN
 				-- บันทึกข้อมูลการลบลูกค้า
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (4, 3, OLD.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, old_data)
+				VALUES (4, 3, OLD.roworder, to_jsonb(OLD));
 			END IF;
 			
 			RETURN NULL; 
@@ -468,12 +578,13 @@ func PriceFormulaTriggerExists(db *sql.DB) bool {
 		return false
 	}
 
-	// ตรวจสอบ function ที่ชื่อ log_price_formula_changes
+	// ตรวจสอบ function ที่ชื่อ log_price_formula_changes (เวอร์ชันที่เก็บ snapshot ของแถว)
 	functionQuery := `
 		SELECT EXISTS (
 			SELECT 1 FROM information_schema.routines 
 			WHERE routine_type = 'FUNCTION'
 			AND routine_name = 'log_price_formula_changes'
+			AND routine_definition LIKE '%to_jsonb%'
 		)
 	`
 	var functionExists bool
@@ -495,18 +606,18 @@ func CreatePriceFormulaTrigger(db *sql.DB) error {
 		BEGIN
 			IF TG_OP = 'INSERT' THEN
 				-- บันทึกข้อมูลการเพิ่มสูตรราคา หลัง Insert
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (5, 1, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data)
+				VALUES (5, 1, NEW.roworder, to_jsonb(NEW));
 				
 			ELSIF TG_OP = 'UPDATE' THEN
 				-- บันทึกข้อมูลการอัพเดทสูตรราคา
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (5, 2, NEW.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, new_data, old_data)
+				VALUES (5, 2, NEW.roworder, to_jsonb(NEW), to_jsonb(OLD));
 				
 			ELSIF TG_OP = 'DELETE' THEN
 				-- บันทึกข้อมูลการลบสูตรราคา
-				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref)
-				VALUES (5, 3, OLD.roworder);
+				INSERT INTO sml_market_sync (table_id, active_code, row_order_ref, old_data)
+				VALUES (5, 3, OLD.roworder, to_jsonb(OLD));
 			END IF;
 			
 			RETURN NULL; 
@@ -533,3 +644,243 @@ func CreatePriceFormulaTrigger(db *sql.DB) error {
 
 	return nil
 }
+
+// balanceTriggerColumns column ของ ic_trans_detail ที่ใช้คำนวณยอดคงเหลือและยอดจอง
+// การแก้ column อื่นของแถว (เช่น หมายเหตุ) ไม่ทำให้ยอดเปลี่ยน trigger จึงไม่บันทึกคู่สินค้า/คลัง
+var balanceTriggerColumns = []string{
+	"item_code", "wh_code", "qty", "calc_flag", "stand_value", "divide_value",
+	"trans_flag", "inquiry_type", "is_pos", "doc_ref", "doc_no", "line_number",
+	"last_status", "item_type", "is_doc_copy",
+}
+
+// balanceTrigger column ที่ trigger ของ ic_trans_detail ติดตาม ตาม availability ที่ใช้คำนวณยอดพร้อมขาย
+type balanceTrigger struct {
+	columns []string // column ที่ UPDATE แล้ว trigger ทำงาน
+	refDoc  string   // column เลขที่ใบจอง/ใบสั่งขายที่แถวส่งของอ้างอิง (ว่าง = ไม่ตัดยอดตาม open_orders)
+	refLine string   // column line_number ของบรรทัดที่อ้างอิง
+}
+
+// newBalanceTrigger รวม column อ้างอิงใบจอง/ใบสั่งขายของ availability.open_orders (ถ้าเปิดใช้) เข้ากับ balanceTriggerColumns
+func newBalanceTrigger(availability *AvailabilityConfig) balanceTrigger {
+	trigger := balanceTrigger{columns: append([]string{}, balanceTriggerColumns...)}
+	if availability == nil || availability.Reservations == nil || availability.OpenOrders == nil || availability.OpenOrders.Disabled {
+		return trigger
+	}
+
+	trigger.refDoc = availability.OpenOrders.RefDocColumn
+	trigger.refLine = availability.OpenOrders.RefLineColumn
+	seen := make(map[string]bool)
+	for _, column := range trigger.columns {
+		seen[column] = true
+	}
+	for _, column := range []string{trigger.refDoc, trigger.refLine} {
+		if !seen[column] {
+			seen[column] = true
+			trigger.columns = append(trigger.columns, column)
+		}
+	}
+	return trigger
+}
+
+// marker ข้อความใน log_balance_changes ที่บอกว่า function ถูกสร้างตาม column อ้างอิงใด
+// BalanceTriggerExists ใช้ตรวจว่าต้องสร้าง function ใหม่เมื่อการตั้งค่า open_orders เปลี่ยน
+func (t balanceTrigger) marker() string {
+	if t.refDoc == "" {
+		return "balance refs: none"
+	}
+	return fmt.Sprintf("balance refs: %s/%s", t.refDoc, t.refLine)
+}
+
+// BalanceTriggerExists ตรวจสอบว่า trigger และ function ของ ic_trans_detail และ ic_trans (ยอดคงเหลือ) มีอยู่หรือไม่
+// trigger ของ ic_trans_detail ต้องติดตาม UPDATE ของทุก column ที่ availability ใช้ และ function ต้องตรงกับ column อ้างอิงของ open_orders
+func BalanceTriggerExists(db *sql.DB, availability *AvailabilityConfig) bool {
+	trigger := newBalanceTrigger(availability)
+
+	// ตรวจสอบ column ที่ trigger ชื่อ balance_changes_trigger ติดตาม (trigger เดิมที่ทำงานทุก UPDATE จะไม่มีแถว)
+	rows, err := db.Query(`
+		SELECT event_object_column FROM information_schema.triggered_update_columns
+		WHERE event_object_table = 'ic_trans_detail'
+		AND trigger_name = 'balance_changes_trigger'
+	`)
+	if err != nil {
+		log.Printf("❌ เกิดข้อผิดพลาดในการตรวจสอบ balance trigger: %v", err)
+		return false
+	}
+	defer rows.Close()
+
+	triggerColumns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			log.Printf("❌ เกิดข้อผิดพลาดในการตรวจสอบ balance trigger: %v", err)
+			return false
+		}
+		triggerColumns[column] = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("❌ เกิดข้อผิดพลาดในการตรวจสอบ balance trigger: %v", err)
+		return false
+	}
+	for _, column := range trigger.columns {
+		if !triggerColumns[column] {
+			return false
+		}
+	}
+
+	// ตรวจสอบ trigger ของหัวเอกสาร ic_trans ที่ชื่อ balance_doc_changes_trigger
+	docTriggerQuery := `
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.triggers 
+			WHERE event_object_table = 'ic_trans'
+			AND trigger_name = 'balance_doc_changes_trigger'
+		)
+	`
+	var docTriggerExists bool
+	err = db.QueryRow(docTriggerQuery).Scan(&docTriggerExists)
+	if err != nil {
+		log.Printf("❌ เกิดข้อผิดพลาดในการตรวจสอบ balance trigger ของ ic_trans: %v", err)
+		return false
+	}
+
+	// ตรวจสอบ function ที่ชื่อ log_balance_changes (เวอร์ชันที่ตรงกับ column อ้างอิงปัจจุบัน) และ log_balance_doc_changes
+	functionQuery := `
+		SELECT
+			EXISTS (
+				SELECT 1 FROM information_schema.routines 
+				WHERE routine_type = 'FUNCTION'
+				AND routine_name = 'log_balance_changes'
+				AND routine_definition LIKE '%' || $1 || '%'
+			),
+			EXISTS (
+				SELECT 1 FROM information_schema.routines 
+				WHERE routine_type = 'FUNCTION'
+				AND routine_name = 'log_balance_doc_changes'
+			)
+	`
+	var functionExists, docFunctionExists bool
+	err = db.QueryRow(functionQuery, trigger.marker()).Scan(&functionExists, &docFunctionExists)
+	if err != nil {
+		log.Printf("❌ เกิดข้อผิดพลาดในการตรวจสอบ balance function: %v", err)
+		return false
+	}
+
+	return docTriggerExists && functionExists && docFunctionExists
+}
+
+// CreateBalanceTrigger สร้าง trigger ที่บันทึกคู่ (item_code, wh_code) ที่ยอดคงเหลือหรือยอดพร้อมขายอาจเปลี่ยน
+//   - ic_trans_detail: คู่ของแถวที่เพิ่ม ลบ หรือแก้ column ที่ใช้คำนวณยอด และคู่ของบรรทัดใบจองที่แถวส่งของอ้างอิง
+//     (ส่งของจากคลังอื่น ยอดจองของคลังเดิมก็เปลี่ยน)
+//   - ic_trans: คู่ของทุกบรรทัดในเอกสารที่ถูกปิด (doc_success) หรือยกเลิก (last_status) ที่หัวเอกสาร
+func CreateBalanceTrigger(db *sql.DB, availability *AvailabilityConfig) error {
+	trigger := newBalanceTrigger(availability)
+	for _, column := range trigger.columns {
+		if !sqlIdentifier.MatchString(column) {
+			return fmt.Errorf("ชื่อ column ของ balance trigger ไม่ถูกต้อง: %q", column)
+		}
+	}
+
+	// คู่ของบรรทัดใบจองที่แถวส่งของอ้างอิง (เฉพาะเมื่อตัดยอดจองตาม open_orders)
+	refQuery := ""
+	if trigger.refDoc != "" {
+		refQuery = fmt.Sprintf(`
+			IF TG_OP IN ('INSERT', 'UPDATE') AND COALESCE(NEW.%[1]s, '') <> '' THEN
+				INSERT INTO sml_market_balance_sync (item_code, wh_code)
+				SELECT r.item_code, COALESCE(r.wh_code, '') FROM ic_trans_detail r
+				WHERE r.doc_no = NEW.%[1]s AND r.line_number = NEW.%[2]s AND r.item_code = NEW.item_code;
+			END IF;
+			IF TG_OP IN ('UPDATE', 'DELETE') AND COALESCE(OLD.%[1]s, '') <> '' THEN
+				INSERT INTO sml_market_balance_sync (item_code, wh_code)
+				SELECT r.item_code, COALESCE(r.wh_code, '') FROM ic_trans_detail r
+				WHERE r.doc_no = OLD.%[1]s AND r.line_number = OLD.%[2]s AND r.item_code = OLD.item_code;
+			END IF;
+`, trigger.refDoc, trigger.refLine)
+	}
+
+	// 1. สร้างฟังก์ชัน trigger
+	// เพิ่มแถวใหม่ในคิวเสมอ (ไม่มี unique key) เพื่อไม่ให้ transaction ที่แก้สินค้า/คลังเดียวกันต้องรอล็อกของแถวในคิว
+	createFunctionQuery := fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION log_balance_changes()
+		RETURNS TRIGGER AS $$
+		BEGIN
+			-- %s
+			IF TG_OP IN ('INSERT', 'UPDATE') THEN
+				-- คู่สินค้า/คลังของแถวใหม่
+				IF NEW.item_code IS NOT NULL THEN
+					INSERT INTO sml_market_balance_sync (item_code, wh_code)
+					VALUES (NEW.item_code, COALESCE(NEW.wh_code, ''));
+				END IF;
+			END IF;
+
+			IF TG_OP = 'DELETE' THEN
+				-- คู่สินค้า/คลังของแถวที่ถูกลบ
+				IF OLD.item_code IS NOT NULL THEN
+					INSERT INTO sml_market_balance_sync (item_code, wh_code)
+					VALUES (OLD.item_code, COALESCE(OLD.wh_code, ''));
+				END IF;
+			ELSIF TG_OP = 'UPDATE' THEN
+				-- คู่สินค้า/คลังเดิม เมื่อแถวถูกย้ายไปสินค้า/คลังอื่น
+				IF OLD.item_code IS NOT NULL
+					AND (OLD.item_code IS DISTINCT FROM NEW.item_code OR OLD.wh_code IS DISTINCT FROM NEW.wh_code) THEN
+					INSERT INTO sml_market_balance_sync (item_code, wh_code)
+					VALUES (OLD.item_code, COALESCE(OLD.wh_code, ''));
+				END IF;
+			END IF;
+%s
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+	`, trigger.marker(), refQuery)
+
+	_, err := db.Exec(createFunctionQuery)
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถสร้างฟังก์ชัน balance trigger: %v", err)
+	}
+
+	// 2. สร้าง trigger ที่ใช้ฟังก์ชันข้างต้น
+	createTriggerQuery := fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS balance_changes_trigger ON ic_trans_detail;
+		CREATE TRIGGER balance_changes_trigger
+		AFTER INSERT OR DELETE OR UPDATE OF %s ON ic_trans_detail
+		FOR EACH ROW EXECUTE FUNCTION log_balance_changes();
+	`, strings.Join(trigger.columns, ", "))
+
+	_, err = db.Exec(createTriggerQuery)
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถสร้าง balance trigger: %v", err)
+	}
+
+	// 3. การปิดหรือยกเลิกเอกสารที่หัวเอกสารไม่ทำให้ ic_trans_detail เปลี่ยน แต่ทำให้ยอดจองของทุกบรรทัดเปลี่ยน
+	createDocFunctionQuery := `
+		CREATE OR REPLACE FUNCTION log_balance_doc_changes()
+		RETURNS TRIGGER AS $$
+		BEGIN
+			IF OLD.doc_success IS DISTINCT FROM NEW.doc_success OR OLD.last_status IS DISTINCT FROM NEW.last_status THEN
+				INSERT INTO sml_market_balance_sync (item_code, wh_code)
+				SELECT DISTINCT d.item_code, COALESCE(d.wh_code, '') FROM ic_trans_detail d
+				WHERE d.doc_no = NEW.doc_no AND d.trans_flag = NEW.trans_flag AND d.item_code IS NOT NULL;
+			END IF;
+
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+	`
+
+	_, err = db.Exec(createDocFunctionQuery)
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถสร้างฟังก์ชัน balance trigger ของ ic_trans: %v", err)
+	}
+
+	createDocTriggerQuery := `
+		DROP TRIGGER IF EXISTS balance_doc_changes_trigger ON ic_trans;
+		CREATE TRIGGER balance_doc_changes_trigger
+		AFTER UPDATE OF doc_success, last_status ON ic_trans
+		FOR EACH ROW EXECUTE FUNCTION log_balance_doc_changes();
+	`
+
+	_, err = db.Exec(createDocTriggerQuery)
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถสร้าง balance trigger ของ ic_trans: %v", err)
+	}
+
+	return nil
+}
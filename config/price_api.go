@@ -2,8 +2,6 @@ package config
 
 import (
 	"fmt"
-	"strings"
-	"time"
 )
 
 // CreatePriceTable สร้างตาราง ic_inventory_price
@@ -33,138 +31,128 @@ func (api *APIClient) CreatePriceTable() error {
 	if err != nil {
 		// Try to continue even if there's an error, the table might already exist
 		fmt.Printf("⚠️ Warning: Error creating price table, continuing anyway: %v\n", err)
-		return nil
-	}
-
-	if !resp.Success {
+	} else if !resp.Success {
 		// Try to continue even if there's an error, the table might already exist
 		fmt.Printf("⚠️ Warning: Failed to create price table, continuing anyway: %s\n", resp.Message)
-		return nil
+	}
+
+	// upsert ใช้ natural key เป็น target ของ ON CONFLICT จึงต้องมี unique index
+	if err := api.ensureNaturalKey("ic_inventory_price", priceNaturalKey); err != nil {
+		return fmt.Errorf("error ensuring natural key on ic_inventory_price: %v", err)
 	}
 
 	return nil
 }
 
-// SyncPriceData ซิงค์ข้อมูลราคาสินค้าแบบ batch (แยกเป็นการเพิ่มและลบ)
-// activeCode = 2 จะถูกประมวลผลแบบ: ลบก่อน แล้ว insert ใหม่
-func (api *APIClient) SyncPriceData(syncIds []int, inserts []interface{}, updates []interface{}, deletes []interface{}) {
-	if len(inserts) == 0 && len(updates) == 0 && len(deletes) == 0 && len(syncIds) == 0 {
+// SyncPriceData ซิงค์ข้อมูลราคาสินค้าแบบ batch
+// inserts และ updates จะถูก upsert ตาม priceNaturalKey (INSERT ... ON CONFLICT DO UPDATE)
+// deletes จะถูกลบตาม priceNaturalKey จาก snapshot ของแถวก่อนลบ (รายการที่ไม่มี snapshot ลบตาม row_order_ref)
+// คืนค่า SyncResult ที่บอกว่า row_order_ref ไหน API ไม่ยืนยัน
+func (api *APIClient) SyncPriceData(inserts []interface{}, updates []interface{}, deletes []interface{}) *SyncResult {
+	result := newSyncResult()
+	if len(inserts) == 0 && len(updates) == 0 && len(deletes) == 0 {
 		fmt.Println("ℹ️ ไม่มีข้อมูลที่ต้องดำเนินการ")
-		return
+		return result
 	}
 
-	// 1. ลบข้อมูลจาก sml_market_sync ด้วย syncIds
-	if len(syncIds) > 0 {
-		_, err := api.deleteFromTable("sml_market_sync", "id", toInterfaceSlice(syncIds), false)
-		if err != nil {
-			fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลจาก sml_market_sync ได้: %v\n", err)
-			// Continue anyway
-		} else {
-			fmt.Println("✅ ลบข้อมูลจาก sml_market_sync เรียบร้อยแล้ว")
-		}
-	} else {
-		fmt.Println("✅ ไม่มีข้อมูลที่ต้องลบจาก sml_market_sync")
-	}
-
-	// 2. ลบข้อมูลจาก ic_inventory_price ที่ไม่ต้องการ (รวม activeCode = 3 และ activeCode = 2)
+	// 1. ลบข้อมูลจาก ic_inventory_price ที่ถูกลบที่ต้นทาง (activeCode = 3)
 	if len(deletes) > 0 {
 		fmt.Println("🗑️ กำลังลบข้อมูลจาก ic_inventory_price")
 
-		// รวบรวม row_order_ref สำหรับการลบ
-		var rowOrderRefs []interface{}
-		for _, item := range deletes {
-			rowOrderRefs = append(rowOrderRefs, fmt.Sprintf("%v", item))
-		}
-
-		if len(rowOrderRefs) > 0 {
-			_, err := api.deleteFromTable("ic_inventory_price", "row_order_ref", rowOrderRefs, false)
-			if err != nil {
-				fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลจาก ic_inventory_price ได้: %v\n", err)
-				// Continue anyway
-			} else {
-				fmt.Println("✅ ลบข้อมูลจาก ic_inventory_price เรียบร้อยแล้ว")
-			}
+		// ลบตาม natural key เพราะแถวบน server อาจถูก upsert ด้วย row_order_ref ของแถวอื่นที่ key เดียวกัน
+		byKey, byRowOrderRef := splitDeletesByKey(deletes, "ic_code")
+		api.deleteNaturalKeys("ic_inventory_price", priceNaturalKey, priceColumns, naturalKeyDeleteRows(byKey, prepPriceDataValues, result), result)
+		_, err := api.deleteFromTable("ic_inventory_price", "row_order_ref", byRowOrderRef, false, result)
+		if err != nil {
+			fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลจาก ic_inventory_price ได้: %v\n", err)
+			// Continue anyway
 		} else {
-			fmt.Println("⚠️ ไม่พบ row_order_ref ที่ต้องการลบ")
+			fmt.Println("✅ ลบข้อมูลจาก ic_inventory_price เรียบร้อยแล้ว")
 		}
 	} else {
 		fmt.Println("✅ ไม่มีข้อมูลที่ต้องลบจาก ic_inventory_price")
 	}
 
-	// 3. ประมวลผล inserts แบบ batch (รวมข้อมูลจาก activeCode = 1 และ activeCode = 2)
-	insertCount := 0
-	if len(inserts) > 0 {
-		count, err := api.processPriceBatch(inserts, 100)
+	// 2. upsert ข้อมูลแบบ batch (รวมข้อมูลจาก activeCode = 1 และ activeCode = 2)
+	upserts := make([]interface{}, 0, len(inserts)+len(updates))
+	upserts = append(upserts, inserts...)
+	upserts = append(upserts, updates...)
+	upsertCount := 0
+	if len(upserts) > 0 {
+		count, err := api.processPriceBatch(upserts, api.upsertBatchSize(100), result)
 		if err != nil {
-			fmt.Printf("⚠️ Warning: ไม่สามารถเพิ่มข้อมูลใหม่ได้: %v\n", err)
+			fmt.Printf("⚠️ Warning: ไม่สามารถเพิ่ม/แก้ไขข้อมูลได้: %v\n", err)
 			// Continue anyway
 		} else {
-			insertCount = count
+			upsertCount = count
 		}
 	} else {
-		fmt.Println("✅ ไม่มีข้อมูลใหม่ที่ต้องเพิ่ม")
+		fmt.Println("✅ ไม่มีข้อมูลที่ต้องเพิ่มหรือแก้ไข")
 	}
 
 	// สรุปผลการดำเนินการ
 	fmt.Printf("\n📊 สรุปการซิงค์ราคาสินค้า sml_market_sync:\n")
-	fmt.Printf("   - ลบข้อมูล: %d รายการ\n", len(syncIds))
 	fmt.Printf("   - ลบข้อมูล: %d รายการ\n", len(deletes))
-	fmt.Printf("   - เพิ่มข้อมูลใหม่: %d/%d รายการ\n", insertCount, len(inserts))
-	fmt.Printf("   - หมายเหตุ: activeCode = 2 จะถูกลบก่อน แล้ว insert ใหม่\n")
+	fmt.Printf("   - เพิ่ม/แก้ไขข้อมูล: %d/%d รายการ\n", upsertCount, len(upserts))
+	fmt.Printf("   - ส่งไม่สำเร็จ (จะส่งใหม่ตามรอบ retry): %d รายการ\n", result.FailedCount())
+	return result
 }
 
-// SyncInventoryData ซิงค์ข้อมูลสินค้าแบบ batch (แยกเป็นการเพิ่มและลบ)
-// activeCode = 2 จะถูกประมวลผลแบบ: ลบก่อน แล้ว insert ใหม่
-func (api *APIClient) SyncInventoryData(inserts []interface{}, updates []interface{}, deletes []interface{}) {
+// SyncInventoryData ซิงค์ข้อมูลสินค้าแบบ batch
+// inserts และ updates จะถูก upsert ตาม code (INSERT ... ON CONFLICT DO UPDATE) ส่วน deletes จะถูกลบตาม code เดิม
+// คืนค่า SyncResult ที่บอกว่า row_order_ref ไหน API ไม่ยืนยัน
+func (api *APIClient) SyncInventoryData(inserts []interface{}, updates []interface{}, deletes []interface{}) *SyncResult {
+	result := newSyncResult()
 	if len(inserts) == 0 && len(updates) == 0 && len(deletes) == 0 {
 		fmt.Println("ℹ️ ไม่มีข้อมูลที่ต้องดำเนินการ")
-		return
+		return result
 	}
 
-	// ลบข้อมูลจาก ic_inventory ที่ไม่ต้องการ (รวม activeCode = 3 และ activeCode = 2)
+	// ลบข้อมูลจาก ic_inventory ที่ถูกลบที่ต้นทาง (activeCode = 3)
 	if len(deletes) > 0 {
 		fmt.Println("🗑️ กำลังลบข้อมูลจาก ic_inventory")
 
-		// รวบรวม barcode สำหรับการลบ
-		var rowOrderRef []interface{}
-		for _, item := range deletes {
-			rowOrderRef = append(rowOrderRef, fmt.Sprintf("%v", item))
-		}
+		// ลบตาม code เดิมจาก snapshot (ic_inventory บน server ใช้ code เป็น key)
+		// รายการที่ไม่มี snapshot จะลบตาม row_order_ref
+		byCode, byRowOrderRef := splitDeletesByKey(deletes, "code")
 
-		if len(rowOrderRef) > 0 {
-			_, err := api.deleteFromTable("ic_inventory", "row_order_ref", rowOrderRef, true)
-			if err != nil {
-				fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลจาก ic_inventory ได้: %v\n", err)
-				// Continue anyway
-			} else {
-				fmt.Println("✅ ลบข้อมูลจาก ic_inventory เรียบร้อยแล้ว")
-			}
+		_, err := api.deleteFromTable("ic_inventory", "code", byCode, true, result)
+		if err == nil {
+			_, err = api.deleteFromTable("ic_inventory", "row_order_ref", byRowOrderRef, false, result)
+		}
+		if err != nil {
+			fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลจาก ic_inventory ได้: %v\n", err)
+			// Continue anyway
 		} else {
-			fmt.Println("⚠️ ไม่พบ code ที่ต้องการลบ")
+			fmt.Println("✅ ลบข้อมูลจาก ic_inventory เรียบร้อยแล้ว")
 		}
 	} else {
 		fmt.Println("✅ ไม่มีข้อมูลที่ต้องลบจาก ic_inventory")
 	}
 
-	// ประมวลผล inserts แบบ batch (รวมข้อมูลจาก activeCode = 1 และ activeCode = 2)
-	insertCount := 0
-	if len(inserts) > 0 {
-		count, err := api.processInventoryInsertBatch(inserts, 100)
+	// upsert ข้อมูลแบบ batch (รวมข้อมูลจาก activeCode = 1 และ activeCode = 2)
+	upserts := make([]interface{}, 0, len(inserts)+len(updates))
+	upserts = append(upserts, inserts...)
+	upserts = append(upserts, updates...)
+	upsertCount := 0
+	if len(upserts) > 0 {
+		count, err := api.processInventoryUpsertBatch(upserts, api.upsertBatchSize(100), result)
 		if err != nil {
-			fmt.Printf("⚠️ Warning: ไม่สามารถเพิ่มข้อมูลใหม่ได้: %v\n", err)
+			fmt.Printf("⚠️ Warning: ไม่สามารถเพิ่ม/แก้ไขข้อมูลได้: %v\n", err)
 			// Continue anyway
 		} else {
-			insertCount = count
+			upsertCount = count
 		}
 	} else {
-		fmt.Println("✅ ไม่มีข้อมูลใหม่ที่ต้องเพิ่ม")
+		fmt.Println("✅ ไม่มีข้อมูลที่ต้องเพิ่มหรือแก้ไข")
 	}
 
 	// สรุปผลการดำเนินการ
 	fmt.Printf("\n📊 สรุปการซิงค์สินค้า ic_inventory:\n")
 	fmt.Printf("   - ลบข้อมูล: %d รายการ\n", len(deletes))
-	fmt.Printf("   - เพิ่มข้อมูลใหม่: %d/%d รายการ\n", insertCount, len(inserts))
-	fmt.Printf("   - หมายเหตุ: activeCode = 2 จะถูกลบก่อน แล้ว insert ใหม่\n")
+	fmt.Printf("   - เพิ่ม/แก้ไขข้อมูล: %d/%d รายการ\n", upsertCount, len(upserts))
+	fmt.Printf("   - ส่งไม่สำเร็จ (จะส่งใหม่ตามรอบ retry): %d รายการ\n", result.FailedCount())
+	return result
 }
 
 // CreatePriceFormulaTable สร้างตาราง ic_inventory_price_formula
@@ -196,250 +184,159 @@ func (api *APIClient) CreatePriceFormulaTable() error {
 	if err != nil {
 		// Try to continue even if there's an error, the table might already exist
 		fmt.Printf("⚠️ Warning: Error creating price formula table, continuing anyway: %v\n", err)
-		return nil
-	}
-
-	if !resp.Success {
+	} else if !resp.Success {
 		// Try to continue even if there's an error, the table might already exist
 		fmt.Printf("⚠️ Warning: Failed to create price formula table, continuing anyway: %s\n", resp.Message)
-		return nil
+	}
+
+	// upsert ใช้ natural key เป็น target ของ ON CONFLICT จึงต้องมี unique index
+	if err := api.ensureNaturalKey("ic_inventory_price_formula", priceFormulaNaturalKey); err != nil {
+		return fmt.Errorf("error ensuring natural key on ic_inventory_price_formula: %v", err)
 	}
 
 	return nil
 }
 
-// SyncPriceFormulaData ซิงค์ข้อมูลสูตรราคาสินค้าแบบ batch (แยกเป็นการเพิ่มและลบ)
-// activeCode = 2 จะถูกประมวลผลแบบ: ลบก่อน แล้ว insert ใหม่
-func (api *APIClient) SyncPriceFormulaData(syncIds []int, inserts []interface{}, updates []interface{}, deletes []interface{}) {
-	if len(inserts) == 0 && len(updates) == 0 && len(deletes) == 0 && len(syncIds) == 0 {
+// SyncPriceFormulaData ซิงค์ข้อมูลสูตรราคาสินค้าแบบ batch
+// inserts และ updates จะถูก upsert ตาม priceFormulaNaturalKey (INSERT ... ON CONFLICT DO UPDATE)
+// deletes จะถูกลบตาม priceFormulaNaturalKey จาก snapshot ของแถวก่อนลบ (รายการที่ไม่มี snapshot ลบตาม row_order_ref)
+// คืนค่า SyncResult ที่บอกว่า row_order_ref ไหน API ไม่ยืนยัน
+func (api *APIClient) SyncPriceFormulaData(inserts []interface{}, updates []interface{}, deletes []interface{}) *SyncResult {
+	result := newSyncResult()
+	if len(inserts) == 0 && len(updates) == 0 && len(deletes) == 0 {
 		fmt.Println("ℹ️ ไม่มีข้อมูลสูตรราคาที่ต้องดำเนินการ")
-		return
+		return result
 	}
 
-	// 1. ลบข้อมูลจาก sml_market_sync ด้วย syncIds
-	if len(syncIds) > 0 {
-		_, err := api.deleteFromTable("sml_market_sync", "id", toInterfaceSlice(syncIds), false)
-		if err != nil {
-			fmt.Printf("⚠️ Warning: ไม่สามารถลบข้อมูลจาก sml_market_sync ได้: %v\n", err)
-		}
-	}
-
-	// 2. Handle deletes (ลบข้อมูลบน server)
+	// 1. Handle deletes (ลบข้อมูลบน server)
 	if len(deletes) > 0 {
 		fmt.Printf("🗑️ กำลังลบข้อมูลสูตรราคาสินค้า %d รายการ\n", len(deletes))
-		api.executeBatchDeletePriceFormula(deletes)
+		api.executeBatchDeletePriceFormula(deletes, result)
 	}
 
-	// 3. Handle inserts (เพิ่มข้อมูลใหม่)
-	if len(inserts) > 0 {
-		fmt.Printf("📝 กำลังเพิ่มข้อมูลสูตรราคาสินค้า %d รายการ\n", len(inserts))
-		api.executeBatchInsertPriceFormula(inserts)
-	}
-
-	// 4. Handle updates (อัพเดทข้อมูล)
-	if len(updates) > 0 {
-		fmt.Printf("🔄 กำลังอัพเดทข้อมูลสูตรราคาสินค้า %d รายการ\n", len(updates))
-		api.executeBatchUpdatePriceFormula(updates)
+	// 2. Handle inserts/updates (เพิ่มหรือแก้ไขข้อมูลตาม natural key)
+	upserts := make([]interface{}, 0, len(inserts)+len(updates))
+	upserts = append(upserts, inserts...)
+	upserts = append(upserts, updates...)
+	if len(upserts) > 0 {
+		fmt.Printf("📝 กำลังเพิ่ม/แก้ไขข้อมูลสูตรราคาสินค้า %d รายการ\n", len(upserts))
+		api.executeBatchUpsertPriceFormula(upserts, result)
 	}
 
 	fmt.Println("✅ ซิงค์ข้อมูลสูตรราคาสินค้าเสร็จสิ้น")
+	return result
 }
 
-// executeBatchDeletePriceFormula ลบข้อมูลสูตรราคาสินค้าแบบ batch
-func (api *APIClient) executeBatchDeletePriceFormula(deletes []interface{}) error {
+// executeBatchDeletePriceFormula ลบข้อมูลสูตรราคาสินค้าแบบ batch ตาม natural key (หรือ row_order_ref ถ้าไม่มี snapshot)
+func (api *APIClient) executeBatchDeletePriceFormula(deletes []interface{}, result *SyncResult) error {
 	if len(deletes) == 0 {
 		return nil
 	}
 
-	success, err := api.deleteFromTable("ic_inventory_price_formula", "row_order_ref", deletes, true)
+	byKey, byRowOrderRef := splitDeletesByKey(deletes, "ic_code")
+	rows := naturalKeyDeleteRows(byKey, func(item map[string]interface{}) ([]interface{}, error) {
+		return priceFormulaValues(item), nil
+	}, result)
+	success := api.deleteNaturalKeys("ic_inventory_price_formula", priceFormulaNaturalKey, priceFormulaColumns, rows, result)
+
+	deleted, err := api.deleteFromTable("ic_inventory_price_formula", "row_order_ref", byRowOrderRef, true, result)
 	if err != nil {
 		fmt.Printf("❌ Error deleting price formula data: %v\n", err)
 		return err
 	}
 
-	fmt.Printf("✅ ลบข้อมูลสูตรราคาสินค้าสำเร็จ: %d รายการ\n", success)
+	fmt.Printf("✅ ลบข้อมูลสูตรราคาสินค้าสำเร็จ: %d รายการ\n", success+deleted)
 	return nil
 }
 
-// executeBatchInsertPriceFormula เพิ่มข้อมูลสูตรราคาสินค้าแบบ batch
-func (api *APIClient) executeBatchInsertPriceFormula(inserts []interface{}) error {
+// executeBatchUpsertPriceFormula เพิ่มหรือแก้ไขข้อมูลสูตรราคาสินค้าแบบ batch ตาม natural key
+// สูตรที่ SML ลบแล้วสร้างใหม่ (row_order_ref เปลี่ยน) จะ update แถวเดิม ส่วนแถวของ key เก่าที่ถูกแก้ไขจะถูกลบออกก่อน
+func (api *APIClient) executeBatchUpsertPriceFormula(inserts []interface{}, result *SyncResult) error {
 	if len(inserts) == 0 {
 		return nil
 	}
 
-	const batchSize = 50 // ลดขนาด batch เพราะ field เยอะ
-	totalInserted := 0
-
-	for i := 0; i < len(inserts); i += batchSize {
-		end := i + batchSize
-		if end > len(inserts) {
-			end = len(inserts)
-		}
-
-		currentBatch := inserts[i:end]
-		var values []string
-		for _, item := range currentBatch {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				// รับค่าเฉพาะ field ที่ต้องการ
-				rowOrderRef := fmt.Sprintf("%v", itemMap["row_order_ref"])
-				icCode := fmt.Sprintf("%v", itemMap["ic_code"])
-				unitCode := fmt.Sprintf("%v", itemMap["unit_code"])
-				saleType := fmt.Sprintf("%v", itemMap["sale_type"])
-				price0 := fmt.Sprintf("%v", itemMap["price_0"])
-				price1 := fmt.Sprintf("%v", itemMap["price_1"])
-				price2 := fmt.Sprintf("%v", itemMap["price_2"])
-				price3 := fmt.Sprintf("%v", itemMap["price_3"])
-				price4 := fmt.Sprintf("%v", itemMap["price_4"])
-				price5 := fmt.Sprintf("%v", itemMap["price_5"])
-				price6 := fmt.Sprintf("%v", itemMap["price_6"])
-				price7 := fmt.Sprintf("%v", itemMap["price_7"])
-				price8 := fmt.Sprintf("%v", itemMap["price_8"])
-				price9 := fmt.Sprintf("%v", itemMap["price_9"])
-				taxType := fmt.Sprintf("%v", itemMap["tax_type"])
-				priceCurrency := fmt.Sprintf("%v", itemMap["price_currency"])
-				currencyCode := fmt.Sprintf("%v", itemMap["currency_code"])
-
-				// Escape single quotes for string fields
-				icCode = strings.ReplaceAll(icCode, "'", "''")
-				unitCode = strings.ReplaceAll(unitCode, "'", "''")
-				price0 = strings.ReplaceAll(price0, "'", "''")
-				price1 = strings.ReplaceAll(price1, "'", "''")
-				price2 = strings.ReplaceAll(price2, "'", "''")
-				price3 = strings.ReplaceAll(price3, "'", "''")
-				price4 = strings.ReplaceAll(price4, "'", "''")
-				price5 = strings.ReplaceAll(price5, "'", "''")
-				price6 = strings.ReplaceAll(price6, "'", "''")
-				price7 = strings.ReplaceAll(price7, "'", "''")
-				price8 = strings.ReplaceAll(price8, "'", "''")
-				price9 = strings.ReplaceAll(price9, "'", "''")
-				currencyCode = strings.ReplaceAll(currencyCode, "'", "''")
-
-				value := fmt.Sprintf("(%s, '%s', '%s', %s, '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s', %s, %s, '%s')",
-					rowOrderRef, icCode, unitCode, saleType, price0, price1, price2, price3, price4, price5, price6, price7, price8, price9, taxType, priceCurrency, currencyCode)
-				values = append(values, value)
-			}
+	var allRows []batchRow
+	for _, item := range inserts {
+		if itemMap, ok := item.(map[string]interface{}); ok {
+			// รับค่าเฉพาะ field ที่ต้องการ
+			allRows = append(allRows, batchRow{item: itemMap, values: priceFormulaValues(itemMap)})
 		}
+	}
+	unique, items := latestByKey(allRows, priceFormulaColumns, priceFormulaNaturalKey)
 
-		if len(values) > 0 {
-			query := fmt.Sprintf(`
-				INSERT INTO ic_inventory_price_formula (row_order_ref, ic_code, unit_code, sale_type, price_0, price_1, price_2, price_3, 
-				price_4, price_5, price_6, price_7, price_8, price_9, tax_type, price_currency, currency_code)
-				VALUES %s
-			`, strings.Join(values, ","))
-
-			resp, err := api.ExecuteCommand(query)
-			if err != nil {
-				fmt.Printf("❌ Error inserting price formula batch %d-%d: %v\n", i+1, end, err)
-				continue
-			}
+	batchSize := api.upsertBatchSize(50) // ค่าเริ่มต้นเล็กกว่าตารางอื่นเพราะ field เยอะ
 
-			if !resp.Success {
-				fmt.Printf("❌ Failed to insert price formula batch %d-%d: %s\n", i+1, end, resp.Message)
-				continue
-			}
+	totalInserted := api.runBatches("ic_inventory_price_formula", items, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
+		rows := unique[start:end]
 
-			totalInserted += len(values)
-			fmt.Printf("   ✅ เพิ่มข้อมูลสูตรราคาสินค้า batch สำเร็จ: %d รายการ\n", len(values))
+		// ลบสูตรของ key เก่าที่ row_order_ref เดียวกันไม่ตรงกับ key ใหม่
+		if err := api.deleteStaleNaturalKeys("ic_inventory_price_formula", priceFormulaNaturalKey, priceFormulaColumns, rows); err != nil {
+			fmt.Printf("❌ Failed to delete stale price formula keys of batch %d-%d: %v\n", start+1, end, err)
+			batchResult.markError(batchRowItems(rows), err)
+			return 0
 		}
 
-		time.Sleep(100 * time.Millisecond)
-	}
+		inserted := api.upsertRows("ic_inventory_price_formula", priceFormulaNaturalKey.conflictTarget(), priceFormulaColumns, rows, batchResult)
+		if inserted < len(rows) {
+			fmt.Printf("❌ Failed to insert price formula batch %d-%d: %d of %d rows rejected\n", start+1, end, len(rows)-inserted, len(rows))
+		} else {
+			fmt.Printf("   ✅ เพิ่มข้อมูลสูตรราคาสินค้า batch สำเร็จ: %d รายการ\n", inserted)
+		}
+		return inserted
+	})
 
 	fmt.Printf("✅ เพิ่มข้อมูลสูตรราคาสินค้าเรียบร้อยแล้ว: %d รายการ\n", totalInserted)
 	return nil
 }
 
-// executeBatchUpdatePriceFormula อัพเดทข้อมูลสูตรราคาสินค้าแบบ batch
-func (api *APIClient) executeBatchUpdatePriceFormula(updates []interface{}) error {
-	if len(updates) == 0 {
-		return nil
-	}
-
-	totalUpdated := 0
-	for i, item := range updates {
-		if itemMap, ok := item.(map[string]interface{}); ok {
-			rowOrderRef := fmt.Sprintf("%v", itemMap["row_order_ref"])
-			icCode := fmt.Sprintf("%v", itemMap["ic_code"])
-			unitCode := fmt.Sprintf("%v", itemMap["unit_code"])
-			saleType := fmt.Sprintf("%v", itemMap["sale_type"])
-			price0 := fmt.Sprintf("%v", itemMap["price_0"])
-			price1 := fmt.Sprintf("%v", itemMap["price_1"])
-			price2 := fmt.Sprintf("%v", itemMap["price_2"])
-			price3 := fmt.Sprintf("%v", itemMap["price_3"])
-			price4 := fmt.Sprintf("%v", itemMap["price_4"])
-			price5 := fmt.Sprintf("%v", itemMap["price_5"])
-			price6 := fmt.Sprintf("%v", itemMap["price_6"])
-			price7 := fmt.Sprintf("%v", itemMap["price_7"])
-			price8 := fmt.Sprintf("%v", itemMap["price_8"])
-			price9 := fmt.Sprintf("%v", itemMap["price_9"])
-			taxType := fmt.Sprintf("%v", itemMap["tax_type"])
-			priceCurrency := fmt.Sprintf("%v", itemMap["price_currency"])
-			currencyCode := fmt.Sprintf("%v", itemMap["currency_code"])
-
-			// Escape single quotes for string fields
-			icCode = strings.ReplaceAll(icCode, "'", "''")
-			unitCode = strings.ReplaceAll(unitCode, "'", "''")
-			price0 = strings.ReplaceAll(price0, "'", "''")
-			price1 = strings.ReplaceAll(price1, "'", "''")
-			price2 = strings.ReplaceAll(price2, "'", "''")
-			price3 = strings.ReplaceAll(price3, "'", "''")
-			price4 = strings.ReplaceAll(price4, "'", "''")
-			price5 = strings.ReplaceAll(price5, "'", "''")
-			price6 = strings.ReplaceAll(price6, "'", "''")
-			price7 = strings.ReplaceAll(price7, "'", "''")
-			price8 = strings.ReplaceAll(price8, "'", "''")
-			price9 = strings.ReplaceAll(price9, "'", "''")
-			currencyCode = strings.ReplaceAll(currencyCode, "'", "''")
-
-			updateQuery := fmt.Sprintf(`
-				UPDATE ic_inventory_price_formula 
-				SET ic_code = '%s', unit_code = '%s', sale_type = %s, price_0 = '%s', price_1 = '%s', price_2 = '%s', 
-				    price_3 = '%s', price_4 = '%s', price_5 = '%s', price_6 = '%s', price_7 = '%s', 
-				    price_8 = '%s', price_9 = '%s', tax_type = %s, price_currency = %s, 
-				    currency_code = '%s'
-				WHERE row_order_ref = %s
-			`, icCode, unitCode, saleType, price0, price1, price2, price3, price4, price5, price6, price7,
-				price8, price9, taxType, priceCurrency, currencyCode, rowOrderRef)
-
-			resp, err := api.ExecuteCommand(updateQuery)
-			if err != nil {
-				fmt.Printf("❌ Error updating price formula record %d: %v\n", i+1, err)
-				continue
-			}
-
-			if !resp.Success {
-				fmt.Printf("❌ Failed to update price formula record %d: %s\n", i+1, resp.Message)
-				continue
-			}
-
-			totalUpdated++
-		}
+// priceFormulaColumns column ของ ic_inventory_price_formula ตามลำดับค่าที่ priceFormulaValues คืน
+var priceFormulaColumns = []string{
+	"row_order_ref", "ic_code", "unit_code", "sale_type",
+	"price_0", "price_1", "price_2", "price_3", "price_4", "price_5", "price_6", "price_7", "price_8", "price_9",
+	"tax_type", "price_currency", "currency_code",
+}
 
-		if (i+1)%100 == 0 {
-			fmt.Printf("   ⏳ อัพเดทข้อมูลสูตรราคาสินค้าแล้ว: %d/%d รายการ\n", i+1, len(updates))
-		}
-	}
+// priceFormulaNaturalKey column ที่ระบุสูตรราคาหนึ่งรายการใน SML (ไม่ขึ้นกับ row_order_ref)
+var priceFormulaNaturalKey = naturalKey{
+	index:   "ic_inventory_price_formula_natural_key",
+	columns: []string{"ic_code", "unit_code", "sale_type", "tax_type", "price_currency", "currency_code"},
+	nulls:   map[string]string{"price_currency": "0"},
+}
 
-	fmt.Printf("✅ อัพเดทข้อมูลสูตรราคาสินค้าเรียบร้อยแล้ว: %d รายการ\n", totalUpdated)
-	return nil
+// priceFormulaValues ดึงค่าของสูตรราคาตามลำดับ column ใน priceFormulaColumns
+func priceFormulaValues(item map[string]interface{}) []interface{} {
+	values := []interface{}{
+		item["row_order_ref"],
+		parseStringValue(item["ic_code"]),
+		parseStringValue(item["unit_code"]),
+		item["sale_type"],
+	}
+	for i := 0; i <= 9; i++ {
+		values = append(values, parseStringValue(item[fmt.Sprintf("price_%d", i)]))
+	}
+	return append(values,
+		item["tax_type"],
+		item["price_currency"],
+		parseStringValue(item["currency_code"]))
 }
 
 // Helper functions สำหรับ price sync
-func parseFloatValue(value interface{}) string {
+func parseFloatValue(value interface{}) interface{} {
 	if value == nil {
-		return "0"
+		return 0
 	}
 
 	switch v := value.(type) {
 	case float64:
-		return fmt.Sprintf("%.6f", v)
+		return v
 	case string:
 		if v == "" || v == "<nil>" {
-			return "0"
+			return 0
 		}
 		return v
 	default:
-		return fmt.Sprintf("%v", v)
+		return v
 	}
 }
 
@@ -450,295 +347,274 @@ func parseStringValue(value interface{}) string {
 	return fmt.Sprintf("%v", value)
 }
 
-func nullableDate(dateStr string) string {
+// nullableDate คืนค่า nil (NULL) เมื่อไม่มีวันที่
+func nullableDate(dateStr string) interface{} {
 	if dateStr == "" || dateStr == "<nil>" {
-		return "NULL"
+		return nil
 	}
-	return fmt.Sprintf("'%s'", dateStr)
+	return dateStr
+}
+
+// priceColumns column ของ ic_inventory_price ตามลำดับค่าที่ prepPriceDataValues คืน
+var priceColumns = []string{
+	"row_order_ref", "ic_code", "unit_code", "from_qty", "to_qty", "from_date", "to_date",
+	"sale_type", "sale_price1", "status", "price_type", "cust_code",
+	"sale_price2", "cust_group_1", "price_mode",
+}
+
+// priceNaturalKey column ที่ระบุราคาหนึ่งรายการใน SML (สินค้า หน่วย ช่วงจำนวน ช่วงวันที่ และเงื่อนไขของราคา)
+// ราคาและสถานะไม่อยู่ใน key การแก้ราคาจึง upsert ทับแถวเดิมบน server แทนการลบแล้วเพิ่มแถวใหม่
+// ราคาที่ไม่กำหนดช่วงวันที่ส่ง from_date/to_date เป็น NULL
+var priceNaturalKey = naturalKey{
+	index: "ic_inventory_price_natural_key_v3",
+	columns: []string{
+		"ic_code", "unit_code", "from_qty", "to_qty", "from_date", "to_date",
+		"sale_type", "price_type", "cust_code", "cust_group_1", "price_mode",
+	},
+	nulls:    map[string]string{"from_date": "'-infinity'::DATE", "to_date": "'infinity'::DATE"},
+	previous: []string{"ic_inventory_price_natural_key", "ic_inventory_price_natural_key_v2"},
 }
 
-// prepPriceDataValues เตรียมข้อมูลราคาสินค้าให้อยู่ในรูปแบบที่พร้อมสำหรับคำสั่ง SQL
-func prepPriceDataValues(item map[string]interface{}) (string, error) {
+// prepPriceDataValues เตรียมค่าของราคาสินค้าตามลำดับ column ใน priceColumns
+func prepPriceDataValues(item map[string]interface{}) ([]interface{}, error) {
 	// ตรวจสอบว่ามีข้อมูลจำเป็นครบหรือไม่
 	if item["ic_code"] == nil || item["unit_code"] == nil {
-		return "", fmt.Errorf("ไม่มี ic_code หรือ unit_code")
+		return nil, fmt.Errorf("ไม่มี ic_code หรือ unit_code")
 	}
 
 	// ดึง row_order_ref สำหรับการอ้างอิง
-	rowOrderRef := ""
-	if item["row_order_ref"] != nil {
-		rowOrderRef = fmt.Sprintf("%v", item["row_order_ref"])
-	} else {
-		return "", fmt.Errorf("ไม่มี row_order_ref")
+	rowOrderRef, ok := itemRowOrderRef(item)
+	if !ok {
+		return nil, fmt.Errorf("ไม่มี row_order_ref")
 	}
 
-	// แปลงข้อมูลเป็นรูปแบบสำหรับ SQL
-	icCode := fmt.Sprintf("%v", item["ic_code"])
-	unitCode := fmt.Sprintf("%v", item["unit_code"])
-	fromQty := parseFloatValue(item["from_qty"])
-	toQty := parseFloatValue(item["to_qty"])
-	fromDate := parseStringValue(item["from_date"])
-	toDate := parseStringValue(item["to_date"])
-	saleType := parseStringValue(item["sale_type"])
-	salePrice1 := parseFloatValue(item["sale_price1"])
-	status := parseStringValue(item["status"])
-	priceType := parseStringValue(item["price_type"])
-	custCode := parseStringValue(item["cust_code"])
-	salePrice2 := parseFloatValue(item["sale_price2"])
-	custGroup1 := parseStringValue(item["cust_group_1"])
-	priceMode := parseStringValue(item["price_mode"])
-
-	// Escape single quotes
-	icCode = strings.ReplaceAll(icCode, "'", "''")
-	unitCode = strings.ReplaceAll(unitCode, "'", "''")
-	saleType = strings.ReplaceAll(saleType, "'", "''")
-	status = strings.ReplaceAll(status, "'", "''")
-	priceType = strings.ReplaceAll(priceType, "'", "''")
-	custCode = strings.ReplaceAll(custCode, "'", "''")
-	custGroup1 = strings.ReplaceAll(custGroup1, "'", "''")
-	priceMode = strings.ReplaceAll(priceMode, "'", "''")
-
-	// Format the values for SQL
-	fromDateStr := nullableDate(fromDate)
-	toDateStr := nullableDate(toDate)
-
-	value := fmt.Sprintf("(%s, '%s', '%s', %s, %s, %s, %s, '%s', %s, '%s', '%s', '%s', %s, '%s', '%s')",
+	return []interface{}{
 		rowOrderRef,
-		icCode,
-		unitCode,
-		fromQty,
-		toQty,
-		fromDateStr,
-		toDateStr,
-		saleType,
-		salePrice1,
-		status,
-		priceType,
-		custCode,
-		salePrice2,
-		custGroup1,
-		priceMode)
-
-	return value, nil
+		parseStringValue(item["ic_code"]),
+		parseStringValue(item["unit_code"]),
+		parseFloatValue(item["from_qty"]),
+		parseFloatValue(item["to_qty"]),
+		nullableDate(parseStringValue(item["from_date"])),
+		nullableDate(parseStringValue(item["to_date"])),
+		parseStringValue(item["sale_type"]),
+		parseFloatValue(item["sale_price1"]),
+		parseStringValue(item["status"]),
+		parseStringValue(item["price_type"]),
+		parseStringValue(item["cust_code"]),
+		parseFloatValue(item["sale_price2"]),
+		parseStringValue(item["cust_group_1"]),
+		parseStringValue(item["price_mode"]),
+	}, nil
+}
+
+// splitDeletesByKey แยกรายการลบเป็นกลุ่มที่มี natural key (จาก snapshot ของแถวก่อนลบ) และกลุ่มที่มีแค่ row_order_ref
+func splitDeletesByKey(deletes []interface{}, keyColumn string) ([]interface{}, []interface{}) {
+	var byKey, byRowOrderRef []interface{}
+	for _, item := range deletes {
+		if itemMap, ok := item.(map[string]interface{}); ok && parseStringValue(itemMap[keyColumn]) != "" {
+			byKey = append(byKey, item)
+		} else {
+			byRowOrderRef = append(byRowOrderRef, item)
+		}
+	}
+	return byKey, byRowOrderRef
+}
+
+// naturalKeyDeleteRows เตรียมค่าของรายการลบที่มี snapshot ตามลำดับ column ของตาราง สำหรับ deleteNaturalKeys
+// รายการที่เตรียมค่าไม่ได้ถูกบันทึกลง result
+func naturalKeyDeleteRows(deletes []interface{}, values func(map[string]interface{}) ([]interface{}, error), result *SyncResult) []batchRow {
+	var rows []batchRow
+	for _, item := range deletes {
+		itemMap := item.(map[string]interface{})
+		rowValues, err := values(itemMap)
+		if err != nil {
+			fmt.Printf("⚠️ ข้ามรายการลบ: %v - %v\n", err, itemMap)
+			result.markFailed([]interface{}{itemMap}, err.Error())
+			continue
+		}
+		rows = append(rows, batchRow{item: itemMap, values: rowValues})
+	}
+	return rows
+}
+
+// deleteKeyValue อ่านค่า key ของรายการลบ รายการเป็นได้ทั้ง map หรือค่า key ตรง ๆ
+func deleteKeyValue(item interface{}, column string) interface{} {
+	if itemMap, ok := item.(map[string]interface{}); ok {
+		return itemMap[column]
+	}
+	return item
 }
 
 // deleteFromTable ลบข้อมูลจากตารางที่ระบุ (แบบ batch เพื่อป้องกัน query ยาว)
-func (api *APIClient) deleteFromTable(tableName string, idColumn string, ids []interface{}, idIsString bool) (int, error) {
+// ids เป็น row_order_ref หรือ map ที่มีทั้ง row_order_ref และ idColumn เพราะ batch ที่ล้มเหลวจะถูกบันทึกลง result ตาม row_order_ref
+func (api *APIClient) deleteFromTable(tableName string, idColumn string, ids []interface{}, idIsString bool, result *SyncResult) (int, error) {
 	if len(ids) == 0 {
 		return 0, nil
 	}
 
 	fmt.Printf("🗑️ กำลังลบข้อมูลจากตาราง %s: %d รายการ\n", tableName, len(ids))
 
-	batchSize := 1000 // ลบครั้งละ 1,000 รายการเพื่อป้องกัน query ยาว
-	totalDeleted := 0
+	batchSize := api.deleteBatchSize(1000) // ค่าเริ่มต้นลบครั้งละ 1,000 รายการเพื่อป้องกัน query ยาว
 	batchCount := (len(ids) + batchSize - 1) / batchSize
 
-	for b := 0; b < batchCount; b++ {
-		start := b * batchSize
-		end := start + batchSize
-		if end > len(ids) {
-			end = len(ids)
-		}
-
+	totalDeleted := api.runBatches(tableName, ids, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
 		currentBatch := ids[start:end]
 		fmt.Printf("   🗑️ ลบ batch ที่ %d/%d (รายการ %d-%d) จากทั้งหมด %d รายการ\n",
 			b+1, batchCount, start+1, end, len(ids))
 
-		// สร้างคำสั่ง DELETE สำหรับ batch นี้
-		deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE %s IN (", tableName, idColumn)
-
-		for i, id := range currentBatch {
+		// สร้างคำสั่ง DELETE สำหรับ batch นี้ (ชื่อตารางและ column มาจากโค้ด ส่วน id ส่งเป็น parameter)
+		var params queryParams
+		batchIds := make([]interface{}, len(currentBatch))
+		for i, item := range currentBatch {
+			id := deleteKeyValue(item, idColumn)
 			if idIsString {
-				// หากเป็น string ต้องใส่เครื่องหมาย quotes
-				deleteQuery += fmt.Sprintf("'%v'", id)
+				batchIds[i] = fmt.Sprintf("%v", id)
 			} else {
-				// หากเป็นตัวเลข ไม่ต้องใส่เครื่องหมาย quotes
-				deleteQuery += fmt.Sprintf("%v", id)
-			}
-
-			if i < len(currentBatch)-1 {
-				deleteQuery += ","
+				batchIds[i] = id
 			}
 		}
-		deleteQuery += ")"
+		deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)", tableName, idColumn, params.list(batchIds))
 
 		// ทำการลบข้อมูลสำหรับ batch นี้
-		resp, err := api.ExecuteCommand(deleteQuery)
+		resp, err := api.ExecuteCommand(deleteQuery, params.values...)
 		if err != nil {
 			fmt.Printf("❌ ERROR: ไม่สามารถลบข้อมูลจาก %s (batch %d) ได้: %v\n", tableName, b+1, err)
-			continue
+			batchResult.markError(currentBatch, err)
+			return 0
 		}
 
 		if !resp.Success {
 			fmt.Printf("❌ ERROR: ลบข้อมูลจาก %s (batch %d) ล้มเหลว: %s\n", tableName, b+1, resp.Message)
-			continue
+			batchResult.markFailed(currentBatch, resp.Message)
+			return 0
 		}
 
-		totalDeleted += len(currentBatch)
 		fmt.Printf("   ✅ ลบข้อมูล batch %d สำเร็จ: %d รายการ\n", b+1, len(currentBatch))
-
-		// หน่วงเวลาเล็กน้อยระหว่าง batch
-		if b < batchCount-1 {
-			time.Sleep(100 * time.Millisecond)
-		}
-	}
+		return len(currentBatch)
+	})
 
 	fmt.Printf("✅ ลบข้อมูลจาก %s เรียบร้อยแล้ว: %d จาก %d รายการ\n", tableName, totalDeleted, len(ids))
 	return totalDeleted, nil
 }
 
-// processPriceBatch ประมวลผลข้อมูลราคาสินค้าเป็น batch (เฉพาะ INSERT)
-func (api *APIClient) processPriceBatch(data []interface{}, batchSize int) (int, error) {
+// processPriceBatch ประมวลผลข้อมูลราคาสินค้าเป็น batch (upsert ตาม priceNaturalKey)
+// ราคาที่ SML ลบแล้วสร้างใหม่ (row_order_ref เปลี่ยน) จะ update แถวเดิม ส่วนแถวของ key เก่าที่ถูกแก้ไขจะถูกลบออกก่อน
+func (api *APIClient) processPriceBatch(data []interface{}, batchSize int, result *SyncResult) (int, error) {
 	if len(data) == 0 {
 		return 0, nil
 	}
 
-	fmt.Printf("🔄 กำลังเพิ่มข้อมูล: %d รายการ (batch ละ %d รายการ)\n", len(data), batchSize)
-
-	totalProcessed := 0
-	batchCount := (len(data) + batchSize - 1) / batchSize
-
-	for b := 0; b < batchCount; b++ {
-		start := b * batchSize
-		end := start + batchSize
-		if end > len(data) {
-			end = len(data)
-		}
-
-		currentBatch := data[start:end]
-		fmt.Printf("   📦 ประมวลผล batch ที่ %d/%d (รายการ %d-%d) จากทั้งหมด %d รายการ\n",
-			b+1, batchCount, start+1, end, len(data))
-
-		// เตรียมข้อมูลสำหรับ batch
-		var batchValues []string
-
-		for _, item := range currentBatch {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				value, err := prepPriceDataValues(itemMap)
-				if err != nil {
-					fmt.Printf("⚠️ ข้ามรายการ: %v - %v\n", err, itemMap)
-					continue
-				}
-				batchValues = append(batchValues, value)
-			} else {
-				fmt.Printf("⚠️ ข้ามรายการที่ไม่ใช่ map: %v\n", item)
-			}
-		}
-
-		// ทำการเพิ่มข้อมูลเป็น batch
-		if len(batchValues) > 0 {
-			query := fmt.Sprintf(`
-				INSERT INTO ic_inventory_price (
-					row_order_ref, ic_code, unit_code, from_qty, to_qty, from_date, to_date, 
-					sale_type, sale_price1, status, price_type, cust_code, 
-					sale_price2, cust_group_1, price_mode
-				)
-				VALUES %s;`,
-				strings.Join(batchValues, ","))
-
-			resp, err := api.ExecuteCommand(query)
+	// เตรียมข้อมูลทั้งหมดก่อนแบ่ง batch เพื่อให้ key ซ้ำถูกตัดออกข้าม batch ด้วย
+	var allRows []batchRow
+	for _, item := range data {
+		if itemMap, ok := item.(map[string]interface{}); ok {
+			values, err := prepPriceDataValues(itemMap)
 			if err != nil {
-				fmt.Printf("❌ ERROR: ไม่สามารถเพิ่มข้อมูล (batch %d) ได้: %v\n", b+1, err)
+				fmt.Printf("⚠️ ข้ามรายการ: %v - %v\n", err, itemMap)
+				result.markFailed([]interface{}{itemMap}, err.Error())
 				continue
 			}
+			allRows = append(allRows, batchRow{item: itemMap, values: values})
+		} else {
+			fmt.Printf("⚠️ ข้ามรายการที่ไม่ใช่ map: %v\n", item)
+		}
+	}
+	unique, items := latestByKey(allRows, priceColumns, priceNaturalKey)
 
-			if !resp.Success {
-				fmt.Printf("❌ ERROR: เพิ่มข้อมูล (batch %d) ล้มเหลว: %s\n", b+1, resp.Message)
-				continue
-			}
+	fmt.Printf("🔄 กำลังเพิ่มข้อมูล: %d รายการ (batch ละ %d รายการ)\n", len(unique), batchSize)
 
-			totalProcessed += len(batchValues)
-			fmt.Printf("   ✅ เพิ่มข้อมูล batch %d สำเร็จ: %d รายการ\n", b+1, len(batchValues))
+	batchCount := (len(unique) + batchSize - 1) / batchSize
+
+	totalProcessed := api.runBatches("ic_inventory_price", items, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
+		rows := unique[start:end]
+		fmt.Printf("   📦 ประมวลผล batch ที่ %d/%d (รายการ %d-%d) จากทั้งหมด %d รายการ\n",
+			b+1, batchCount, start+1, end, len(unique))
+
+		// ลบราคาของ key เก่าที่ row_order_ref เดียวกันไม่ตรงกับ key ใหม่
+		if err := api.deleteStaleNaturalKeys("ic_inventory_price", priceNaturalKey, priceColumns, rows); err != nil {
+			fmt.Printf("❌ ERROR: ไม่สามารถลบราคาของ key เก่าของ batch %d ได้: %v\n", b+1, err)
+			batchResult.markError(batchRowItems(rows), err)
+			return 0
 		}
 
-		// หน่วงเวลาเล็กน้อยระหว่าง batch
-		if b < batchCount-1 {
-			time.Sleep(100 * time.Millisecond)
+		// ทำการเพิ่มข้อมูลเป็น batch (ถ้า server ปฏิเสธจะแบ่งครึ่งเพื่อหาแถวที่ผิด)
+		inserted := api.upsertRows("ic_inventory_price", priceNaturalKey.conflictTarget(), priceColumns, rows, batchResult)
+		if inserted < len(rows) {
+			fmt.Printf("❌ ERROR: เพิ่มข้อมูล (batch %d) ไม่สำเร็จ %d จาก %d รายการ\n", b+1, len(rows)-inserted, len(rows))
+		} else {
+			fmt.Printf("   ✅ เพิ่มข้อมูล batch %d สำเร็จ: %d รายการ\n", b+1, inserted)
 		}
-	}
+		return inserted
+	})
 
 	fmt.Printf("✅ เพิ่มข้อมูลเรียบร้อยแล้ว: %d จาก %d รายการ\n", totalProcessed, len(data))
 	return totalProcessed, nil
 }
 
-// processInventoryInsertBatch ประมวลผลข้อมูลสินค้าเป็น batch (เฉพาะ INSERT)
-func (api *APIClient) processInventoryInsertBatch(data []interface{}, batchSize int) (int, error) {
+// processInventoryUpsertBatch ประมวลผลข้อมูลสินค้าเป็น batch (upsert ตาม code)
+// ถ้า code ของ row_order_ref เดิมถูกแก้ไข จะลบแถวของ code เก่าออกก่อน
+func (api *APIClient) processInventoryUpsertBatch(data []interface{}, batchSize int, result *SyncResult) (int, error) {
 	if len(data) == 0 {
 		return 0, nil
 	}
 
 	fmt.Printf("🔄 กำลังเพิ่มข้อมูลสินค้า: %d รายการ (batch ละ %d รายการ)\n", len(data), batchSize)
 
-	totalProcessed := 0
 	batchCount := (len(data) + batchSize - 1) / batchSize
 
-	for b := 0; b < batchCount; b++ {
-		start := b * batchSize
-		end := start + batchSize
-		if end > len(data) {
-			end = len(data)
-		}
-
+	totalProcessed := api.runBatches("ic_inventory", data, batchSize, result, func(b, start, end int, batchResult *SyncResult) int {
 		currentBatch := data[start:end]
 		fmt.Printf("   📦 ประมวลผล batch ที่ %d/%d (รายการ %d-%d) จากทั้งหมด %d รายการ\n",
 			b+1, batchCount, start+1, end, len(data))
 
 		// เตรียมข้อมูลสำหรับ batch
-		var batchValues []string
+		var rows []batchRow
 
 		for _, item := range currentBatch {
 			if itemMap, ok := item.(map[string]interface{}); ok {
-				value, err := prepInventoryDataValues(itemMap)
+				values, err := prepInventoryDataValues(itemMap)
 				if err != nil {
 					fmt.Printf("⚠️ ข้ามรายการ: %v - %v\n", err, itemMap)
+					batchResult.markFailed([]interface{}{itemMap}, err.Error())
 					continue
 				}
-				batchValues = append(batchValues, value)
+				rows = append(rows, batchRow{item: itemMap, values: values})
 			} else {
 				fmt.Printf("⚠️ ข้ามรายการที่ไม่ใช่ map: %v\n", item)
 			}
 		}
 
-		// ทำการเพิ่มข้อมูลเป็น batch
-		if len(batchValues) > 0 {
-			query := fmt.Sprintf(`
-				INSERT INTO ic_inventory (
-					code,name,unit_standard_code,item_type,row_order_ref
-				)
-				VALUES %s`,
-				strings.Join(batchValues, ","))
-
-			resp, err := api.ExecuteCommand(query)
-			if err != nil {
-				fmt.Printf("❌ ERROR: ไม่สามารถเพิ่มข้อมูลสินค้า (batch %d) ได้: %v\n", b+1, err)
-				continue
-			}
-
-			if !resp.Success {
-				fmt.Printf("❌ ERROR: เพิ่มข้อมูลสินค้า (batch %d) ล้มเหลว: %s\n", b+1, resp.Message)
-				continue
-			}
-
-			totalProcessed += len(batchValues)
-			fmt.Printf("   ✅ เพิ่มข้อมูลสินค้า batch %d สำเร็จ: %d รายการ\n", b+1, len(batchValues))
+		// ทำการ upsert ข้อมูลเป็น batch (ถ้า server ปฏิเสธจะแบ่งครึ่งเพื่อหาแถวที่ผิด)
+		if len(rows) == 0 {
+			return 0
+		}
+		if err := api.deleteStaleKeys("ic_inventory", "code", rows, 0, 4); err != nil {
+			fmt.Printf("❌ ERROR: ไม่สามารถลบ code เก่าของ batch %d ได้: %v\n", b+1, err)
+			batchResult.markError(batchRowItems(rows), err)
+			return 0
 		}
 
-		// หน่วงเวลาเล็กน้อยระหว่าง batch
-		if b < batchCount-1 {
-			time.Sleep(100 * time.Millisecond)
+		inserted := api.upsertRows("ic_inventory", []string{"code"}, inventoryColumns, rows, batchResult)
+		if inserted < len(rows) {
+			fmt.Printf("❌ ERROR: เพิ่มข้อมูลสินค้า (batch %d) ไม่สำเร็จ %d จาก %d รายการ\n", b+1, len(rows)-inserted, len(rows))
+		} else {
+			fmt.Printf("   ✅ เพิ่มข้อมูลสินค้า batch %d สำเร็จ: %d รายการ\n", b+1, inserted)
 		}
-	}
+		return inserted
+	})
 
 	fmt.Printf("✅ เพิ่มข้อมูลสินค้าเรียบร้อยแล้ว: %d จาก %d รายการ\n", totalProcessed, len(data))
 	return totalProcessed, nil
 }
 
-// prepInventoryDataValues เตรียมข้อมูลสินค้าให้อยู่ในรูปแบบที่พร้อมสำหรับคำสั่ง SQL
-func prepInventoryDataValues(item map[string]interface{}) (string, error) {
+// inventoryColumns column ของ ic_inventory ตามลำดับค่าที่ prepInventoryDataValues คืน
+var inventoryColumns = []string{"code", "name", "unit_standard_code", "item_type", "row_order_ref"}
+
+// prepInventoryDataValues เตรียมค่าของสินค้าตามลำดับ column ใน inventoryColumns
+func prepInventoryDataValues(item map[string]interface{}) ([]interface{}, error) {
 	// ตรวจสอบว่ามีข้อมูลจำเป็นครบหรือไม่
 	if item["code"] == nil {
-		return "", fmt.Errorf("ไม่มี code")
+		return nil, fmt.Errorf("ไม่มี code")
 	}
 
 	// แปลงข้อมูลเป็นรูปแบบสำหรับ SQL
@@ -783,22 +659,5 @@ func prepInventoryDataValues(item map[string]interface{}) (string, error) {
 		}
 	}
 
-	// Escape single quotes
-	code = strings.ReplaceAll(code, "'", "''")
-	name = strings.ReplaceAll(name, "'", "''")
-	unitStandardCode = strings.ReplaceAll(unitStandardCode, "'", "''")
-
-	value := fmt.Sprintf("('%s', '%s', '%s', %d, %d)",
-		code, name, unitStandardCode, itemType, rowOrderRef)
-
-	return value, nil
-}
-
-// toInterfaceSlice แปลง slice ของ int เป็น slice ของ interface{}
-func toInterfaceSlice(ints []int) []interface{} {
-	result := make([]interface{}, len(ints))
-	for i, v := range ints {
-		result[i] = v
-	}
-	return result
+	return []interface{}{code, name, unitStandardCode, itemType, rowOrderRef}, nil
 }
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryParams สะสมค่า parameter ของคำสั่ง SQL และคืน placeholder $n ตามลำดับที่เพิ่ม
+type queryParams struct {
+	values []interface{}
+}
+
+// add เพิ่มค่า parameter หนึ่งค่า แล้วคืน placeholder ของค่านั้น
+func (p *queryParams) add(value interface{}) string {
+	p.values = append(p.values, value)
+	return "$" + strconv.Itoa(len(p.values))
+}
+
+// row เพิ่มค่าหลายค่าเป็นหนึ่งแถว คืนค่าในรูปแบบ ($1, $2, ...) สำหรับ VALUES
+func (p *queryParams) row(values ...interface{}) string {
+	placeholders := make([]string, len(values))
+	for i, value := range values {
+		placeholders[i] = p.add(value)
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")"
+}
+
+// list เพิ่มค่าหลายค่า คืนค่า placeholder คั่นด้วย comma สำหรับ IN (...)
+func (p *queryParams) list(values []interface{}) string {
+	placeholders := make([]string, len(values))
+	for i, value := range values {
+		placeholders[i] = p.add(value)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// quoteLiteral แปลงข้อความเป็น string literal ของ SQL (escape single quote)
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// paramsUnsupported ตรวจว่า server ไม่รู้จัก params และรันคำสั่งที่มี $n ตรง ๆ
+func paramsUnsupported(resp *QueryResponse, err error) bool {
+	var messages []string
+	if err != nil {
+		messages = append(messages, err.Error())
+	}
+	if resp != nil {
+		messages = append(messages, resp.Message, resp.Error)
+	}
+
+	for _, message := range messages {
+		message = strings.ToLower(message)
+		if strings.Contains(message, "there is no parameter $") ||
+			strings.Contains(message, "bind message supplies 0 parameters") ||
+			strings.Contains(message, "unknown field \"params\"") {
+			return true
+		}
+	}
+	return false
+}
+
+// interpolateParams แทนที่ placeholder $n ด้วยค่า literal ของ SQL
+// ใช้กับ server ที่รับเฉพาะคำสั่ง SQL แบบข้อความ โดยข้าม $n ที่อยู่ใน string, quoted identifier,
+// comment แบบ -- และ /* */ (ซ้อนกันได้) และ dollar-quoted string ($$...$$ หรือ $tag$...$tag$)
+func interpolateParams(query string, params []interface{}) string {
+	var out strings.Builder
+	out.Grow(len(query))
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			// คัดลอก string literal หรือ quoted identifier ทั้งก้อน ('' และ "" คือ escape)
+			j := i + 1
+			for j < len(query) {
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j < len(query) {
+				j++
+			}
+			out.WriteString(query[i:j])
+			i = j
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = len(query) - i
+			}
+			out.WriteString(query[i : i+j])
+			i += j
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			// block comment ของ PostgreSQL ซ้อนกันได้ จึงนับระดับจนปิดครบ
+			j, depth := i+2, 1
+			for j < len(query) && depth > 0 {
+				switch {
+				case query[j] == '/' && j+1 < len(query) && query[j+1] == '*':
+					depth++
+					j += 2
+				case query[j] == '*' && j+1 < len(query) && query[j+1] == '/':
+					depth--
+					j += 2
+				default:
+					j++
+				}
+			}
+			out.WriteString(query[i:j])
+			i = j
+		case c == '$' && i > 0 && isIdentifierByte(query[i-1]):
+			// $ ที่ต่อจากชื่อ (เช่น col$1) เป็นส่วนหนึ่งของ identifier ไม่ใช่ placeholder
+			out.WriteByte(c)
+			i++
+		case c == '$' && dollarQuoteTag(query[i:]) != "":
+			// คัดลอก dollar-quoted string ทั้งก้อนจนถึง tag ปิดเดียวกัน
+			tag := dollarQuoteTag(query[i:])
+			j := strings.Index(query[i+len(tag):], tag)
+			if j < 0 {
+				j = len(query)
+			} else {
+				j = i + len(tag) + j + len(tag)
+			}
+			out.WriteString(query[i:j])
+			i = j
+		case c == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			n, _ := strconv.Atoi(query[i+1 : j])
+			if n >= 1 && n <= len(params) {
+				out.WriteString(sqlLiteral(params[n-1]))
+			} else {
+				out.WriteString(query[i:j])
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+
+	return out.String()
+}
+
+// dollarQuoteTag คืน tag เปิดของ dollar-quoted string ($$ หรือ $tag$) ที่ต้น query หรือข้อความว่างถ้าไม่ใช่
+// tag ขึ้นต้นด้วยตัวเลขไม่ได้ $1 จึงเป็น placeholder เสมอ
+func dollarQuoteTag(query string) string {
+	for j := 1; j < len(query); j++ {
+		c := query[j]
+		switch {
+		case c == '$':
+			return query[:j+1]
+		case c >= '0' && c <= '9':
+			if j == 1 {
+				return ""
+			}
+		case !isIdentifierByte(c):
+			return ""
+		}
+	}
+	return ""
+}
+
+// isIdentifierByte ตรวจว่าเป็นตัวอักษรที่อยู่ในชื่อแบบไม่มี quote ได้ (รวม byte ของตัวอักษรที่ไม่ใช่ ASCII)
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// sqlLiteral แปลงค่าเป็น literal ของ SQL
+func sqlLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return quoteLiteral(v)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case int:
+		return strconv.Itoa(v)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return quoteLiteral(v.Format(time.RFC3339Nano))
+	default:
+		return quoteLiteral(fmt.Sprintf("%v", v))
+	}
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		params []interface{}
+		want   string
+	}{
+		{
+			name:   "values",
+			query:  "INSERT INTO t VALUES ($1, $2, $3, $4, $5)",
+			params: []interface{}{"O'Brien", 12, 1.5, nil, true},
+			want:   "INSERT INTO t VALUES ('O''Brien', 12, 1.5, NULL, TRUE)",
+		},
+		{
+			name:   "placeholder numbers above nine",
+			query:  "SELECT $1, $10, $11",
+			params: []interface{}{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			want:   "SELECT 1, 10, $11",
+		},
+		{
+			name:   "string literal and quoted identifier",
+			query:  `SELECT '$1 it''s', "col$1" FROM t WHERE a = $1`,
+			params: []interface{}{"x"},
+			want:   `SELECT '$1 it''s', "col$1" FROM t WHERE a = 'x'`,
+		},
+		{
+			name:   "line comment",
+			query:  "SELECT $1 -- not $1\nFROM t",
+			params: []interface{}{1},
+			want:   "SELECT 1 -- not $1\nFROM t",
+		},
+		{
+			name:   "block comment",
+			query:  "SELECT /* $1 */ $1",
+			params: []interface{}{1},
+			want:   "SELECT /* $1 */ 1",
+		},
+		{
+			name:   "nested block comment",
+			query:  "SELECT /* outer /* $1 */ still $1 */ $1",
+			params: []interface{}{1},
+			want:   "SELECT /* outer /* $1 */ still $1 */ 1",
+		},
+		{
+			name:   "dollar quoted body",
+			query:  "DO $$ BEGIN PERFORM $1; END $$; SELECT $1",
+			params: []interface{}{1},
+			want:   "DO $$ BEGIN PERFORM $1; END $$; SELECT 1",
+		},
+		{
+			name:   "tagged dollar quote containing another tag",
+			query:  "SELECT $fn$ it's $$ $1 $$ $fn$, $1",
+			params: []interface{}{"x"},
+			want:   "SELECT $fn$ it's $$ $1 $$ $fn$, 'x'",
+		},
+		{
+			name:   "dollar inside identifier",
+			query:  "SELECT col$1 FROM t WHERE a = $1",
+			params: []interface{}{2},
+			want:   "SELECT col$1 FROM t WHERE a = 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interpolateParams(tt.query, tt.params); got != tt.want {
+				t.Errorf("interpolateParams() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// newParamsServer จำลอง server รุ่นเก่าที่ไม่รู้จัก params (รันคำสั่งที่มี $n ตรง ๆ) และไม่มี transaction endpoint
+// แล้วเก็บ query ที่ได้รับ
+func newParamsServer(t *testing.T, queries *[]string) *httpTarget {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == TransactionEndpoint {
+			http.NotFound(w, r)
+			return
+		}
+		var request QueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		*queries = append(*queries, request.Query)
+		response := QueryResponse{Success: true}
+		if len(request.Params) > 0 || strings.Contains(request.Query, "= $1") {
+			response = QueryResponse{Success: false, Message: "there is no parameter $1"}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+
+	config := DefaultAPIConfig()
+	config.BaseURL = server.URL
+	config.Retry.MaxAttempts = 1
+	return newHTTPTarget(config)
+}
+
+func TestHTTPTargetFallsBackToInlineParams(t *testing.T) {
+	var queries []string
+	target := newParamsServer(t, &queries)
+
+	for i := 0; i < 2; i++ {
+		resp, err := target.Command("DELETE FROM t WHERE a = $1", []interface{}{"x"})
+		if err != nil || !resp.Success {
+			t.Fatalf("Command() = %+v, %v", resp, err)
+		}
+	}
+
+	// ครั้งแรกส่ง params แล้วสลับเป็นข้อความ ครั้งถัดไปส่งเป็นข้อความเลย
+	want := []string{"DELETE FROM t WHERE a = $1", "DELETE FROM t WHERE a = 'x'", "DELETE FROM t WHERE a = 'x'"}
+	if strings.Join(queries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("queries =\n%s\nwant\n%s", strings.Join(queries, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestHTTPTargetTxSendsParameterizedStatements(t *testing.T) {
+	var requests []TransactionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != TransactionEndpoint {
+			t.Errorf("path = %s, want %s", r.URL.Path, TransactionEndpoint)
+		}
+		var request TransactionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests = append(requests, request)
+		json.NewEncoder(w).Encode(QueryResponse{Success: true})
+	}))
+	t.Cleanup(server.Close)
+
+	config := DefaultAPIConfig()
+	config.BaseURL = server.URL
+	config.Retry.MaxAttempts = 1
+	resp, err := newHTTPTarget(config).Tx([]TxStatement{
+		{Query: "DELETE FROM t WHERE a = $1", Params: []interface{}{"it's"}},
+		{Bulk: &BulkRows{Table: "t", KeyColumns: []string{"a"}, Columns: []string{"a", "b"}, Rows: [][]interface{}{{"x", 1}}}},
+	})
+	if err != nil || !resp.Success {
+		t.Fatalf("Tx() = %+v, %v", resp, err)
+	}
+
+	if len(requests) != 1 || len(requests[0].Statements) != 2 {
+		t.Fatalf("requests = %+v, want one request with 2 statements", requests)
+	}
+	first := requests[0].Statements[0]
+	if first.Query != "DELETE FROM t WHERE a = $1" || !reflect.DeepEqual(first.Params, []interface{}{"it's"}) {
+		t.Errorf("statement 1 = %+v, want the query with params unchanged", first)
+	}
+	bulk := requests[0].Statements[1]
+	if !strings.Contains(bulk.Query, "VALUES ($1, $2)") || !reflect.DeepEqual(bulk.Params, []interface{}{"x", float64(1)}) {
+		t.Errorf("statement 2 = %+v, want a parameterized multi-row upsert", bulk)
+	}
+}
+
+func TestHTTPTargetTxFallsBackToDoBlock(t *testing.T) {
+	var queries []string
+	target := newParamsServer(t, &queries)
+
+	for i := 0; i < 2; i++ {
+		resp, err := target.Tx([]TxStatement{
+			{Query: "DELETE FROM t WHERE a = $1 /* $2 */;", Params: []interface{}{"x"}},
+			{Query: "INSERT INTO t (a) VALUES ($1)", Params: []interface{}{"it's $$"}},
+			{Query: "SELECT $tag$ $1 $tag$"},
+		})
+		if err != nil || !resp.Success {
+			t.Fatalf("Tx() = %+v, %v", resp, err)
+		}
+	}
+
+	// ครั้งแรกได้ 404 จาก transaction endpoint แล้วสลับเป็น DO block ครั้งถัดไปส่งเป็น DO block เลย
+	want := "DO $sml_market_sync_tx$\nBEGIN\n" +
+		"DELETE FROM t WHERE a = 'x' /* $2 */;\n" +
+		"INSERT INTO t (a) VALUES ('it''s $$');\n" +
+		"SELECT $tag$ $1 $tag$;\n" +
+		"END\n$sml_market_sync_tx$"
+	if len(queries) != 2 || queries[0] != want || queries[1] != want {
+		t.Errorf("queries = %q, want 2 x %q", queries, want)
+	}
+}
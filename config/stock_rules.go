@@ -0,0 +1,208 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StockRules กฎที่กำหนดว่าการเคลื่อนไหวใดใน ic_trans_detail นับเป็นยอดคงเหลือ (section "stock_rules" ใน smlmarketsync.json)
+// แถวถูกนับเมื่อตรงกับ Movements อย่างน้อยหนึ่งกฎ และไม่ตรงกับ Exclude กฎใดเลย
+// Exclude ที่นี่ใช้กับทุก movement ส่วน StockRule.Exclude ใช้กับ movement นั้นเท่านั้น
+type StockRules struct {
+	Movements []StockRule `json:"movements"`
+	Exclude   []StockRule `json:"exclude"`
+}
+
+// StockRule เงื่อนไขของการเคลื่อนไหวหนึ่งแบบ ทุก field ที่ระบุต้องตรงพร้อมกัน (field ที่ไม่ระบุ = ไม่ตรวจ)
+type StockRule struct {
+	TransFlags       []int  `json:"trans_flags,omitempty"`        // trans_flag ที่ตรงกับกฎนี้
+	InquiryTypes     []int  `json:"inquiry_types,omitempty"`      // inquiry_type ที่ตรงกับกฎนี้
+	InquiryTypeBelow *int   `json:"inquiry_type_below,omitempty"` // inquiry_type น้อยกว่าค่านี้
+	QtySign          string `json:"qty_sign,omitempty"`           // "positive" (qty > 0) หรือ "negative" (qty < 0)
+	IsPos            *int   `json:"is_pos,omitempty"`             // ค่าของ is_pos
+	HasDocRef        *bool  `json:"has_doc_ref,omitempty"`        // true = doc_ref ไม่ว่าง, false = doc_ref ว่าง
+
+	Exclude []StockRule `json:"exclude,omitempty"` // แถวที่ตรงกับกฎนี้แต่ไม่นับ (เฉพาะ movements)
+}
+
+// DefaultStockRules กฎเดิมของ SML ที่ใช้เมื่อไม่ได้ตั้งค่า stock_rules
+// (รับเข้า/ขายออก/โอน/ปรับปรุง โดยไม่นับรายการ POS ขาออกที่อ้างอิงเอกสารอื่น)
+// SQL เดิมเขียนเป็น (รับเข้า) OR (ขายออก) AND NOT (POS) ซึ่ง AND ผูกกับกลุ่มขายออกเท่านั้น
+// exclude ของ POS จึงอยู่ในแต่ละกฎขาออก ไม่ใช่ StockRules.Exclude
+func DefaultStockRules() *StockRules {
+	intPtr := func(v int) *int { return &v }
+	boolPtr := func(v bool) *bool { return &v }
+	posDocRef := []StockRule{{HasDocRef: boolPtr(true), IsPos: intPtr(1)}}
+	return &StockRules{
+		Movements: []StockRule{
+			{TransFlags: []int{70, 54, 60, 58, 310, 12}},
+			{TransFlags: []int{66}, QtySign: "positive"},
+			{TransFlags: []int{14}, InquiryTypes: []int{0}},
+			{TransFlags: []int{48}, InquiryTypeBelow: intPtr(2)},
+			{TransFlags: []int{56, 68, 72, 44}, Exclude: posDocRef},
+			{TransFlags: []int{66}, QtySign: "negative", Exclude: posDocRef},
+			{TransFlags: []int{46}, InquiryTypes: []int{0, 2}, Exclude: posDocRef},
+			{TransFlags: []int{16}, InquiryTypes: []int{0, 2}, Exclude: posDocRef},
+			{TransFlags: []int{311}, InquiryTypes: []int{0}, Exclude: posDocRef},
+		},
+	}
+}
+
+// NewStockRules อ่านกฎจาก smlmarketsync.json (ถ้าไม่มี section นี้จะใช้ DefaultStockRules)
+// กฎที่ไม่ถูกต้องจะทำให้โปรแกรมหยุด เพราะยอดคงเหลือที่คำนวณผิดจะถูกส่งขึ้น server
+func NewStockRules() *StockRules {
+	config, err := loadConfig()
+	if err != nil {
+		log.Printf("⚠️ Warning: %v (ใช้กฎการนับยอดคงเหลือเริ่มต้น)", err)
+		return DefaultStockRules()
+	}
+	if config.StockRules == nil {
+		return DefaultStockRules()
+	}
+	if err := config.StockRules.Validate(); err != nil {
+		log.Fatalf("❌ Error: stock_rules ใน %s ไม่ถูกต้อง: %v\nโปรแกรมจบการทำงาน", configPath, err)
+	}
+	return config.StockRules
+}
+
+// Validate ตรวจว่ากฎสร้าง SQL ได้และมีความหมาย
+func (r *StockRules) Validate() error {
+	if len(r.Movements) == 0 {
+		return fmt.Errorf("movements ต้องมีอย่างน้อยหนึ่งกฎ")
+	}
+	for i, rule := range r.Movements {
+		if len(rule.TransFlags) == 0 {
+			return fmt.Errorf("movements[%d]: ต้องระบุ trans_flags", i)
+		}
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("movements[%d]: %v", i, err)
+		}
+		if err := validateExcludes(rule.Exclude); err != nil {
+			return fmt.Errorf("movements[%d].%v", i, err)
+		}
+	}
+	return validateExcludes(r.Exclude)
+}
+
+// validateExcludes ตรวจกฎ exclude (ต้องมีเงื่อนไข และไม่มี exclude ซ้อน)
+func validateExcludes(rules []StockRule) error {
+	for i, rule := range rules {
+		if len(rule.conditions("t")) == 0 {
+			return fmt.Errorf("exclude[%d]: ต้องระบุเงื่อนไขอย่างน้อยหนึ่งอย่าง", i)
+		}
+		if len(rule.Exclude) > 0 {
+			return fmt.Errorf("exclude[%d]: ระบุ exclude ซ้อนใน exclude ไม่ได้", i)
+		}
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("exclude[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// QuantityExpr คืน SQL expression ของจำนวนที่นับเป็นยอดคงเหลือของแต่ละแถว (ยังไม่คูณ calc_flag)
+// alias คือชื่อย่อของ ic_trans_detail ในคำสั่ง เช่น "itd"
+func (r *StockRules) QuantityExpr(alias string) string {
+	condition := anyRule(r.Movements, alias)
+	if len(r.Exclude) > 0 {
+		condition += " AND NOT " + anyRule(r.Exclude, alias)
+	}
+
+	return fmt.Sprintf(`CASE WHEN %s
+				 THEN ROUND((%[2]s.qty*%[2]s.stand_value) / %[2]s.divide_value, 2)
+				 ELSE 0
+			END`, condition, alias)
+}
+
+// transFlags trans_flag ทั้งหมดที่ Movements อาจนับ (เรียงจากน้อยไปมาก ไม่ซ้ำ)
+func (r *StockRules) transFlags() []int {
+	seen := make(map[int]bool)
+	var flags []int
+	for _, rule := range r.Movements {
+		for _, flag := range rule.TransFlags {
+			if !seen[flag] {
+				seen[flag] = true
+				flags = append(flags, flag)
+			}
+		}
+	}
+	sort.Ints(flags)
+	return flags
+}
+
+// anyRule คืนเงื่อนไขที่เป็นจริงเมื่อแถวตรงกับกฎใดกฎหนึ่งใน rules
+func anyRule(rules []StockRule, alias string) string {
+	var exprs []string
+	for _, rule := range rules {
+		exprs = append(exprs, rule.expr(alias))
+	}
+	return "(" + strings.Join(exprs, " OR ") + ")"
+}
+
+// expr คืนเงื่อนไขของกฎในวงเล็บ รวมถึง exclude ของกฎนี้
+func (rule StockRule) expr(alias string) string {
+	condition := strings.Join(rule.conditions(alias), " AND ")
+	if len(rule.Exclude) > 0 {
+		condition += " AND NOT " + anyRule(rule.Exclude, alias)
+	}
+	return "(" + condition + ")"
+}
+
+// validate ตรวจค่าของแต่ละ field ในกฎ
+func (rule StockRule) validate() error {
+	if len(rule.InquiryTypes) > 0 && rule.InquiryTypeBelow != nil {
+		return fmt.Errorf("ระบุได้เพียงอย่างเดียวระหว่าง inquiry_types และ inquiry_type_below")
+	}
+	switch rule.QtySign {
+	case "", "positive", "negative":
+	default:
+		return fmt.Errorf("qty_sign ต้องเป็น \"positive\" หรือ \"negative\" (ได้ %q)", rule.QtySign)
+	}
+	return nil
+}
+
+// conditions คืนเงื่อนไข SQL ของแต่ละ field ที่ระบุในกฎ (ค่าทั้งหมดเป็นตัวเลขหรือค่าคงที่ จึงใส่ลงใน SQL ได้โดยตรง)
+func (rule StockRule) conditions(alias string) []string {
+	var conditions []string
+	if len(rule.TransFlags) > 0 {
+		conditions = append(conditions, intCondition(alias+".trans_flag", rule.TransFlags))
+	}
+	if len(rule.InquiryTypes) > 0 {
+		conditions = append(conditions, intCondition(alias+".inquiry_type", rule.InquiryTypes))
+	}
+	if rule.InquiryTypeBelow != nil {
+		conditions = append(conditions, fmt.Sprintf("%s.inquiry_type < %d", alias, *rule.InquiryTypeBelow))
+	}
+	switch rule.QtySign {
+	case "positive":
+		conditions = append(conditions, alias+".qty > 0")
+	case "negative":
+		conditions = append(conditions, alias+".qty < 0")
+	}
+	if rule.IsPos != nil {
+		conditions = append(conditions, fmt.Sprintf("%s.is_pos = %d", alias, *rule.IsPos))
+	}
+	if rule.HasDocRef != nil {
+		if *rule.HasDocRef {
+			conditions = append(conditions, alias+".doc_ref <> ''")
+		} else {
+			conditions = append(conditions, fmt.Sprintf("COALESCE(%s.doc_ref, '') = ''", alias))
+		}
+	}
+	return conditions
+}
+
+// intCondition คืน column = ค่า หรือ column IN (...) เมื่อมีหลายค่า
+func intCondition(column string, values []int) string {
+	if len(values) == 1 {
+		return fmt.Sprintf("%s = %d", column, values[0])
+	}
+	list := make([]string, len(values))
+	for i, value := range values {
+		list[i] = strconv.Itoa(value)
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(list, ","))
+}
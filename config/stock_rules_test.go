@@ -0,0 +1,99 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultStockRulesQuantityExpr(t *testing.T) {
+	// เงื่อนไขเดิมใน SQL ของ balance_sync.go และ product.go ก่อนมี stock_rules เขียนเป็น
+	// ((รับเข้า) OR (ขายออก) AND NOT (POS)) ซึ่ง AND ผูกกับกลุ่มขายออกเท่านั้น
+	// รายการรับเข้าของ POS ที่อ้างอิงเอกสาร (เช่น รับคืน) จึงยังถูกนับ
+	const pos = `AND NOT ((itd.is_pos = 1 AND itd.doc_ref <> ''))`
+	want := `CASE WHEN (` +
+		`(itd.trans_flag IN (70,54,60,58,310,12)) OR (itd.trans_flag = 66 AND itd.qty > 0) ` +
+		`OR (itd.trans_flag = 14 AND itd.inquiry_type = 0) OR (itd.trans_flag = 48 AND itd.inquiry_type < 2) ` +
+		`OR (itd.trans_flag IN (56,68,72,44) ` + pos + `) OR (itd.trans_flag = 66 AND itd.qty < 0 ` + pos + `) ` +
+		`OR (itd.trans_flag = 46 AND itd.inquiry_type IN (0,2) ` + pos + `) OR (itd.trans_flag = 16 AND itd.inquiry_type IN (0,2) ` + pos + `) ` +
+		`OR (itd.trans_flag = 311 AND itd.inquiry_type = 0 ` + pos + `)) ` +
+		`THEN ROUND((itd.qty*itd.stand_value) / itd.divide_value, 2) ELSE 0 END`
+
+	rules := DefaultStockRules()
+	if err := rules.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if got := strings.Join(strings.Fields(rules.QuantityExpr("itd")), " "); got != want {
+		t.Errorf("QuantityExpr() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStockRulesValidate(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	movement := StockRule{TransFlags: []int{70}}
+
+	tests := []struct {
+		name  string
+		rules StockRules
+		want  string // ข้อความที่ error ต้องมี (ว่าง = ต้องไม่มี error)
+	}{
+		{
+			name:  "minimal rules",
+			rules: StockRules{Movements: []StockRule{movement}},
+		},
+		{
+			name:  "no movements",
+			rules: StockRules{},
+			want:  "movements ต้องมีอย่างน้อยหนึ่งกฎ",
+		},
+		{
+			name:  "movement without trans_flags",
+			rules: StockRules{Movements: []StockRule{movement, {InquiryTypes: []int{0}}}},
+			want:  "movements[1]: ต้องระบุ trans_flags",
+		},
+		{
+			name:  "unknown qty_sign",
+			rules: StockRules{Movements: []StockRule{{TransFlags: []int{66}, QtySign: "plus"}}},
+			want:  "movements[0]: qty_sign",
+		},
+		{
+			name:  "inquiry_types with inquiry_type_below",
+			rules: StockRules{Movements: []StockRule{{TransFlags: []int{48}, InquiryTypes: []int{0}, InquiryTypeBelow: intPtr(2)}}},
+			want:  "movements[0]: ระบุได้เพียงอย่างเดียว",
+		},
+		{
+			name:  "empty exclude rule",
+			rules: StockRules{Movements: []StockRule{movement}, Exclude: []StockRule{{}}},
+			want:  "exclude[0]: ต้องระบุเงื่อนไข",
+		},
+		{
+			name:  "empty exclude in a movement",
+			rules: StockRules{Movements: []StockRule{movement, {TransFlags: []int{56}, Exclude: []StockRule{{}}}}},
+			want:  "movements[1].exclude[0]: ต้องระบุเงื่อนไข",
+		},
+		{
+			name:  "nested exclude",
+			rules: StockRules{Movements: []StockRule{movement}, Exclude: []StockRule{{IsPos: intPtr(1), Exclude: []StockRule{{IsPos: intPtr(0)}}}}},
+			want:  "exclude[0]: ระบุ exclude ซ้อน",
+		},
+		{
+			name:  "unknown qty_sign in exclude",
+			rules: StockRules{Movements: []StockRule{movement}, Exclude: []StockRule{{IsPos: intPtr(1), QtySign: "zero"}}},
+			want:  "exclude[0]: qty_sign",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
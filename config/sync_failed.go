@@ -0,0 +1,263 @@
+package config
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"smlmarketsync/types"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// SyncFailedRetryBase ระยะเวลารอก่อนส่งใหม่ครั้งแรก จะเพิ่มเป็นสองเท่าทุกครั้งที่ล้มเหลว
+	SyncFailedRetryBase = 1 * time.Minute
+	// SyncFailedRetryMax ระยะเวลารอสูงสุดระหว่างการส่งใหม่
+	SyncFailedRetryMax = 6 * time.Hour
+	// SyncFailedMaxAttempts จำนวนครั้งสูงสุดที่ส่งใหม่อัตโนมัติ หลังจากนั้นต้องสั่ง retry ผ่านคำสั่ง failed
+	SyncFailedMaxAttempts = 10
+)
+
+// SyncFailure แถวใน sml_market_sync_failed
+type SyncFailure struct {
+	ID           int
+	SyncID       int
+	TableID      int
+	RowOrderRef  int
+	ActiveCode   int
+	NewData      []byte
+	OldData      []byte
+	ErrorMessage string
+	Attempts     int
+	LastFailedAt time.Time
+	NextRetryAt  sql.NullTime
+	RequeuedAt   sql.NullTime
+}
+
+// CreateSyncFailedTable สร้างตาราง sml_market_sync_failed สำหรับเก็บแถวที่ API ปฏิเสธ (dead-letter)
+func CreateSyncFailedTable(db *sql.DB) error {
+	// sync_id = id เดิมใน sml_market_sync (ใช้ id เดิมเมื่อส่งใหม่ เพื่อรักษาลำดับเหตุการณ์)
+	// active_code, new_data, old_data = การเปลี่ยนแปลงสุทธิที่ส่งไม่สำเร็จ
+	// next_retry_at = เวลาที่จะส่งใหม่อัตโนมัติ (NULL = ครบจำนวนครั้งแล้ว ต้องสั่ง retry เอง)
+	// requeued_at = เวลาที่ถูกนำกลับเข้า sml_market_sync เพื่อส่งใหม่ (NULL = ยังรออยู่)
+	query := `
+		CREATE TABLE IF NOT EXISTS sml_market_sync_failed (
+			id SERIAL PRIMARY KEY,
+			sync_id INT NOT NULL,
+			table_id INT NOT NULL,
+			row_order_ref INT NOT NULL,
+			active_code INT NOT NULL,
+			new_data JSONB,
+			old_data JSONB,
+			error_message TEXT,
+			attempts INT NOT NULL DEFAULT 1,
+			first_failed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			last_failed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			next_retry_at TIMESTAMP,
+			requeued_at TIMESTAMP,
+			UNIQUE (table_id, row_order_ref)
+		)
+	`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("ไม่สามารถสร้างตาราง sml_market_sync_failed: %v", err)
+	}
+
+	return nil
+}
+
+// RequeueSyncFailures นำแถวที่ถึงเวลาส่งใหม่กลับเข้า sml_market_sync ด้วย id เดิม
+func RequeueSyncFailures(db *sql.DB, tableID int) (int, error) {
+	query := `
+		WITH due AS (
+			UPDATE sml_market_sync_failed
+			SET requeued_at = NOW()
+			WHERE table_id = $1 AND requeued_at IS NULL AND next_retry_at <= NOW()
+			RETURNING sync_id, table_id, active_code, row_order_ref, new_data, old_data
+		)
+		INSERT INTO sml_market_sync (id, table_id, active_code, row_order_ref, new_data, old_data)
+		SELECT sync_id, table_id, active_code, row_order_ref, new_data, old_data FROM due
+		ON CONFLICT (id) DO NOTHING
+	`
+
+	res, err := db.Exec(query, tableID)
+	if err != nil {
+		return 0, fmt.Errorf("error requeueing sml_market_sync_failed rows for table_id %d: %v", tableID, err)
+	}
+
+	count, _ := res.RowsAffected()
+	if count > 0 {
+		fmt.Printf("🔁 นำรายการที่เคยส่งไม่สำเร็จกลับมาส่งใหม่ (table_id=%d): %d รายการ\n", tableID, count)
+	}
+	return int(count), nil
+}
+
+// DeadLetterSyncRecords ย้ายแถวที่ API ปฏิเสธจาก sml_market_sync ไป sml_market_sync_failed
+// แต่ละ row_order_ref จะเหลือหนึ่งแถวที่เก็บการเปลี่ยนแปลงสุทธิ ข้อความ error และเวลาที่จะส่งใหม่ (exponential backoff)
+func DeadLetterSyncRecords(db *sql.DB, runID string, records []types.SyncRecord, failedIds []int, reasons map[int]string) error {
+	if len(failedIds) == 0 {
+		return nil
+	}
+
+	failedSet := make(map[int]bool, len(failedIds))
+	for _, id := range failedIds {
+		failedSet[id] = true
+	}
+	var failedRecords []types.SyncRecord
+	for _, record := range records {
+		if failedSet[record.ID] {
+			failedRecords = append(failedRecords, record)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting dead-letter transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	upsertQuery := `
+		INSERT INTO sml_market_sync_failed
+			(sync_id, table_id, row_order_ref, active_code, new_data, old_data, error_message, next_retry_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW() + $8 * INTERVAL '1 second')
+		ON CONFLICT (table_id, row_order_ref) DO UPDATE SET
+			sync_id = EXCLUDED.sync_id,
+			active_code = EXCLUDED.active_code,
+			new_data = EXCLUDED.new_data,
+			old_data = EXCLUDED.old_data,
+			error_message = EXCLUDED.error_message,
+			attempts = sml_market_sync_failed.attempts + 1,
+			last_failed_at = NOW(),
+			next_retry_at = CASE
+				WHEN sml_market_sync_failed.attempts + 1 >= $9 THEN NULL
+				ELSE NOW() + LEAST($8 * POWER(2, sml_market_sync_failed.attempts), $10) * INTERVAL '1 second'
+			END,
+			requeued_at = NULL
+	`
+
+	// ทุกแถวของ row_order_ref เดียวกันถูกรวมเป็นรายการสุทธิเดียว (แถวที่ insert แล้ว delete จะไม่ถูกเก็บ)
+	for _, change := range coalesceSyncRecords(failedRecords) {
+		_, err = tx.Exec(upsertQuery,
+			change.ID, change.TableID, change.RowOrderRef, change.ActiveCode,
+			nullableJSON(change.NewData), nullableJSON(change.OldData), reasons[change.RowOrderRef],
+			int(SyncFailedRetryBase.Seconds()), SyncFailedMaxAttempts, int(SyncFailedRetryMax.Seconds()))
+		if err != nil {
+			return fmt.Errorf("error writing row_order_ref %d to sml_market_sync_failed: %v", change.RowOrderRef, err)
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM sml_market_sync WHERE claim_run_id = $1 AND id = ANY($2)", runID, pq.Array(failedIds))
+	if err != nil {
+		return fmt.Errorf("error removing dead-lettered rows from sml_market_sync: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing dead-letter transaction: %v", err)
+	}
+
+	fmt.Printf("📮 ย้ายรายการที่ส่งไม่สำเร็จไป sml_market_sync_failed: %d แถว (จะส่งใหม่ตามรอบ retry)\n", len(failedIds))
+	return nil
+}
+
+// ClearSyncFailures ลบแถวใน sml_market_sync_failed ของ row_order_ref ที่ส่งสำเร็จแล้ว
+func ClearSyncFailures(db *sql.DB, tableID int, rowOrderRefs []int) error {
+	for start := 0; start < len(rowOrderRefs); start += 1000 {
+		end := start + 1000
+		if end > len(rowOrderRefs) {
+			end = len(rowOrderRefs)
+		}
+
+		placeholders := make([]string, 0, end-start)
+		args := []interface{}{tableID}
+		for _, ref := range rowOrderRefs[start:end] {
+			args = append(args, ref)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM sml_market_sync_failed WHERE table_id = $1 AND row_order_ref IN (%s)",
+			strings.Join(placeholders, ", ")), args...)
+		if err != nil {
+			return fmt.Errorf("error clearing sml_market_sync_failed rows: %v", err)
+		}
+	}
+	return nil
+}
+
+// ListSyncFailures คืนค่าแถวใน sml_market_sync_failed (tableID = 0 คือทุกตาราง)
+func ListSyncFailures(db *sql.DB, tableID int) ([]SyncFailure, error) {
+	query := `
+		SELECT id, sync_id, table_id, row_order_ref, active_code, new_data, old_data,
+			COALESCE(error_message, ''), attempts, last_failed_at, next_retry_at, requeued_at
+		FROM sml_market_sync_failed
+		WHERE $1 = 0 OR table_id = $1
+		ORDER BY table_id, sync_id
+	`
+
+	rows, err := db.Query(query, tableID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing sml_market_sync_failed: %v", err)
+	}
+	defer rows.Close()
+
+	var failures []SyncFailure
+	for rows.Next() {
+		var f SyncFailure
+		err := rows.Scan(&f.ID, &f.SyncID, &f.TableID, &f.RowOrderRef, &f.ActiveCode, &f.NewData, &f.OldData,
+			&f.ErrorMessage, &f.Attempts, &f.LastFailedAt, &f.NextRetryAt, &f.RequeuedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning sml_market_sync_failed row: %v", err)
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// RetrySyncFailures ตั้งให้แถวที่ระบุ (หรือทั้งหมดเมื่อ ids ว่าง) ถูกส่งใหม่ในรอบ sync ถัดไป
+// attempts เริ่มนับใหม่ แถวที่ส่งครบจำนวนครั้งแล้วจึงถูก retry อัตโนมัติได้อีก
+// และแถวที่ค้างสถานะกำลังส่งใหม่ (requeued_at) ก็ถูกนำกลับเข้าคิวด้วย
+func RetrySyncFailures(db *sql.DB, ids []int) (int, error) {
+	// แถวที่ยังอยู่ใน sml_market_sync จะไม่ถูกเพิ่มซ้ำ เพราะ RequeueSyncFailures ใช้ id เดิมกับ ON CONFLICT DO NOTHING
+	return execSyncFailures(db, "UPDATE sml_market_sync_failed SET attempts = 0, next_retry_at = NOW(), requeued_at = NULL", nil, ids)
+}
+
+// DiscardSyncFailures ลบแถวที่ระบุ (หรือทั้งหมดเมื่อ ids ว่าง) ทิ้งโดยไม่ส่งใหม่ (ยกเว้นแถวที่กำลังส่งใหม่อยู่)
+func DiscardSyncFailures(db *sql.DB, ids []int) (int, error) {
+	return execSyncFailures(db, "DELETE FROM sml_market_sync_failed", []string{"requeued_at IS NULL"}, ids)
+}
+
+// execSyncFailures รัน statement กับแถวที่ตรงทุกเงื่อนไขใน conditions และเป็นแถวที่ระบุ (ทุกแถวเมื่อ ids ว่าง)
+func execSyncFailures(db *sql.DB, statement string, conditions []string, ids []int) (int, error) {
+	var args []interface{}
+	if len(ids) > 0 {
+		placeholders := make([]string, len(ids))
+		for i, id := range ids {
+			placeholders[i] = "$" + strconv.Itoa(i+1)
+			args = append(args, id)
+		}
+		conditions = append(conditions, fmt.Sprintf("id IN (%s)", strings.Join(placeholders, ", ")))
+	}
+
+	query := statement
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error updating sml_market_sync_failed: %v", err)
+	}
+	count, _ := res.RowsAffected()
+	return int(count), nil
+}
+
+// nullableJSON แปลง snapshot เป็นค่าที่ส่งให้ column JSONB ได้ (nil = NULL)
+func nullableJSON(data []byte) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
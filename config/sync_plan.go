@@ -0,0 +1,210 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"smlmarketsync/types"
+)
+
+// CoalesceSyncRecords รวมหลายเหตุการณ์ของแถวเดียวกัน (table_id, row_order_ref) ให้เหลือการทำงานสุทธิเพียงรายการเดียว
+//   - เริ่มด้วย insert และจบด้วย delete  -> ไม่ต้องส่งอะไร (แถวไม่เคยถึง server)
+//   - เริ่มด้วย insert                     -> insert ด้วยข้อมูลล่าสุด
+//   - เริ่มด้วย update/delete และจบด้วย delete -> delete ตามข้อมูลก่อนเปลี่ยนของเหตุการณ์แรก
+//   - เริ่มด้วย update/delete              -> update ด้วยข้อมูลล่าสุด
+//
+// แถวจาก backfill เป็น update (แถวอาจอยู่บน server แล้ว) จึงไม่ถูกตัดทิ้งเมื่อถูกลบก่อนส่ง
+// new_data มาจากเหตุการณ์สุดท้าย ส่วน old_data มาจากเหตุการณ์แรก (สิ่งที่ server มีอยู่ตอนนี้)
+// id ของรายการสุทธิคือ id ของเหตุการณ์แรก เพื่อให้ลำดับระหว่างแถวยังเป็นไปตามเวลาที่ key เดิมถูกปล่อย
+// id ทั้งหมดยังคงอยู่ใน records เดิม ซึ่ง step ใช้ ack/release ตาม row_order_ref
+func CoalesceSyncRecords(records []types.SyncRecord) []types.SyncRecord {
+	changes := coalesceSyncRecords(records)
+	if len(changes) < len(records) {
+		fmt.Printf("🧮 รวมการเปลี่ยนแปลงของแถวเดียวกัน: %d เหตุการณ์ เหลือ %d รายการที่ต้องส่ง\n", len(records), len(changes))
+	}
+	return changes
+}
+
+func coalesceSyncRecords(records []types.SyncRecord) []types.SyncRecord {
+	type recordKey struct {
+		tableID     int
+		rowOrderRef int
+	}
+
+	// เรียงตาม id เพื่อให้ได้ลำดับเหตุการณ์จริงของแต่ละแถว
+	ordered := make([]types.SyncRecord, len(records))
+	copy(ordered, records)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].ID < ordered[j].ID
+	})
+
+	groups := make(map[recordKey][]types.SyncRecord)
+	var keys []recordKey
+	for _, record := range ordered {
+		key := recordKey{record.TableID, record.RowOrderRef}
+		if _, exists := groups[key]; !exists {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], record)
+	}
+
+	var changes []types.SyncRecord
+	for _, key := range keys {
+		if change, ok := coalesceEvents(groups[key]); ok {
+			changes = append(changes, change)
+		}
+	}
+
+	// เรียงตาม id ของเหตุการณ์แรกของแต่ละแถว (ลำดับที่เกิดขึ้นจริง)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].ID < changes[j].ID
+	})
+
+	return changes
+}
+
+// coalesceEvents รวมเหตุการณ์ของแถวเดียว (เรียงตาม id แล้ว) คืนค่า false ถ้าไม่ต้องส่งอะไร
+func coalesceEvents(events []types.SyncRecord) (types.SyncRecord, bool) {
+	first := events[0]
+	last := events[len(events)-1]
+	if len(events) == 1 {
+		return first, true
+	}
+
+	change := last
+	change.ID = first.ID
+	existedBefore := first.ActiveCode != 1
+
+	switch {
+	case !existedBefore && last.ActiveCode == 3:
+		return types.SyncRecord{}, false
+	case !existedBefore:
+		change.ActiveCode = 1
+		change.OldData = nil
+	case last.ActiveCode == 3:
+		change.ActiveCode = 3
+		change.NewData = nil
+		change.OldData = first.OldData
+	default:
+		change.ActiveCode = 2
+		change.OldData = first.OldData
+	}
+
+	return change, true
+}
+
+// ApplySyncChanges ส่งรายการสุทธิไปยัง API ทีละ batch ตามลำดับ id โดยแต่ละ batch ไม่มี key ซ้ำกัน
+// ภายใน batch เดียวกัน API จึงจัดลำดับ ลบ -> แก้ไข -> เพิ่ม ได้โดยไม่ผิดลำดับเหตุการณ์
+// keyColumn คือ natural key ใน snapshot (เช่น code, barcode) ที่ server ใช้ ถ้าว่างจะใช้แค่ row_order_ref
+// ถ้ารายการใดส่งไม่สำเร็จ รายการใน batch ถัดไปที่ใช้ key เดียวกันจะไม่ถูกส่ง (รอส่งใหม่พร้อมกันตามรอบ retry)
+// ถ้า apply คืน error พร้อม result ที่ไม่เป็น nil ต้องบันทึกรายการที่ยังไม่ได้ส่งของ batch นั้นไว้ใน result แล้ว
+func ApplySyncChanges(changes []types.SyncRecord, keyColumn string, apply func(batch []types.SyncRecord) (*SyncResult, error)) (*SyncResult, error) {
+	result := newSyncResult()
+	batches := planSyncBatches(changes, keyColumn)
+	if len(batches) > 1 {
+		fmt.Printf("🧩 แบ่งการส่งเป็น %d ชุดตามลำดับเหตุการณ์ (มี key ซ้ำกันระหว่างแถว)\n", len(batches))
+	}
+
+	failedKeys := make(map[string]bool)
+	for i, batch := range batches {
+		var ready []types.SyncRecord
+		for _, record := range batch {
+			keys := syncRecordKeys(record, keyColumn)
+			if anyKey(failedKeys, keys) {
+				// ย้ายไป sml_market_sync_failed พร้อมกัน เพื่อให้ส่งใหม่หลังรายการก่อนหน้าเสมอ
+				result.failedRefs[record.RowOrderRef] = "รอรายการก่อนหน้าที่ใช้ key เดียวกันซึ่งส่งไม่สำเร็จ"
+				addKeys(failedKeys, keys)
+				continue
+			}
+			ready = append(ready, record)
+		}
+		if len(ready) == 0 {
+			continue
+		}
+
+		batchResult, err := apply(ready)
+		if err != nil {
+			// batch ถัดไปยังไม่ได้ส่ง จะถูกปลดการจองไว้ส่งใหม่ ส่วน batch นี้ใช้ผลที่ apply คืนมา (ถ้ามี)
+			pending := batches[i+1:]
+			if batchResult != nil {
+				result.merge(batchResult)
+			} else {
+				pending = batches[i:]
+			}
+			for _, rest := range pending {
+				for _, record := range rest {
+					result.markSkipped(record.RowOrderRef, err.Error())
+				}
+			}
+			return result, err
+		}
+
+		result.merge(batchResult)
+		for _, record := range ready {
+			if batchResult.Failed(record.RowOrderRef) {
+				addKeys(failedKeys, syncRecordKeys(record, keyColumn))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// planSyncBatches แบ่งรายการ (เรียงตาม id แล้ว) เป็น batch ต่อเนื่อง โดยเริ่ม batch ใหม่เมื่อพบ key ที่ batch ปัจจุบันใช้แล้ว
+func planSyncBatches(changes []types.SyncRecord, keyColumn string) [][]types.SyncRecord {
+	var batches [][]types.SyncRecord
+	var current []types.SyncRecord
+	used := make(map[string]bool)
+
+	for _, record := range changes {
+		keys := syncRecordKeys(record, keyColumn)
+		if anyKey(used, keys) {
+			batches = append(batches, current)
+			current = nil
+			used = make(map[string]bool)
+		}
+		current = append(current, record)
+		addKeys(used, keys)
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// syncRecordKeys คืนค่า key ทั้งหมดที่รายการนี้แตะบน server: row_order_ref และ natural key ทั้งก่อนและหลังเปลี่ยน
+// แถวที่ไม่มี snapshot จะรู้แค่ row_order_ref
+func syncRecordKeys(record types.SyncRecord, keyColumn string) []string {
+	keys := []string{"ref:" + strconv.Itoa(record.RowOrderRef)}
+	if keyColumn == "" {
+		return keys
+	}
+
+	for _, data := range [][]byte{record.OldData, record.NewData} {
+		snapshot, err := DecodeSyncSnapshot(data)
+		if err != nil || snapshot == nil {
+			continue
+		}
+		if value := parseStringValue(snapshot[keyColumn]); value != "" {
+			keys = append(keys, "key:"+value)
+		}
+	}
+	return keys
+}
+
+func anyKey(set map[string]bool, keys []string) bool {
+	for _, key := range keys {
+		if set[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func addKeys(set map[string]bool, keys []string) {
+	for _, key := range keys {
+		set[key] = true
+	}
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"smlmarketsync/types"
+)
+
+// event สร้างเหตุการณ์ของ sml_market_sync (oldCode/newCode ว่าง = ไม่มี snapshot ฝั่งนั้น)
+func event(id, ref, activeCode int, oldCode, newCode string) types.SyncRecord {
+	record := types.SyncRecord{ID: id, TableID: 1, ActiveCode: activeCode, RowOrderRef: ref}
+	if oldCode != "" {
+		record.OldData = []byte(fmt.Sprintf(`{"code":%q,"row_order_ref":%d}`, oldCode, ref))
+	}
+	if newCode != "" {
+		record.NewData = []byte(fmt.Sprintf(`{"code":%q,"row_order_ref":%d}`, newCode, ref))
+	}
+	return record
+}
+
+func TestCoalesceSyncRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []types.SyncRecord
+		want   []types.SyncRecord
+	}{
+		{
+			name:   "single event is sent as is",
+			events: []types.SyncRecord{event(1, 10, 2, "A", "B")},
+			want:   []types.SyncRecord{event(1, 10, 2, "A", "B")},
+		},
+		{
+			name:   "insert then delete sends nothing",
+			events: []types.SyncRecord{event(1, 10, 1, "", "A"), event(2, 10, 3, "A", "")},
+			want:   nil,
+		},
+		{
+			name:   "insert, delete, insert becomes one insert of the latest row",
+			events: []types.SyncRecord{event(1, 10, 1, "", "A"), event(2, 10, 3, "A", ""), event(3, 10, 1, "", "B")},
+			want:   []types.SyncRecord{event(1, 10, 1, "", "B")},
+		},
+		{
+			name:   "update then delete deletes what the server has",
+			events: []types.SyncRecord{event(1, 10, 2, "A", "B"), event(2, 10, 3, "B", "")},
+			want:   []types.SyncRecord{event(1, 10, 3, "A", "")},
+		},
+		{
+			name:   "backfilled row deleted before it is sent is deleted on the server",
+			events: []types.SyncRecord{event(1, 10, 2, "A", "A"), event(2, 10, 3, "A", "")},
+			want:   []types.SyncRecord{event(1, 10, 3, "A", "")},
+		},
+		{
+			name:   "delete then insert becomes an update from the old row",
+			events: []types.SyncRecord{event(1, 10, 3, "A", ""), event(2, 10, 1, "", "B")},
+			want:   []types.SyncRecord{event(1, 10, 2, "A", "B")},
+		},
+		{
+			name: "events are grouped per row and ordered by the first id",
+			events: []types.SyncRecord{
+				event(4, 20, 2, "C", "D"),
+				event(1, 10, 2, "A", "B"),
+				event(2, 20, 2, "X", "C"),
+				event(3, 10, 2, "B", "E"),
+			},
+			want: []types.SyncRecord{event(1, 10, 2, "A", "E"), event(2, 20, 2, "X", "D")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := coalesceSyncRecords(tt.events)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("coalesceSyncRecords() =\n%s\nwant\n%s", describeRecords(got), describeRecords(tt.want))
+			}
+		})
+	}
+}
+
+func TestPlanSyncBatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		changes   []types.SyncRecord
+		keyColumn string
+		want      [][]int // row_order_ref ของแต่ละ batch
+	}{
+		{
+			name:      "distinct keys stay in one batch",
+			changes:   []types.SyncRecord{event(1, 10, 1, "", "A"), event(2, 20, 1, "", "B")},
+			keyColumn: "code",
+			want:      [][]int{{10, 20}},
+		},
+		{
+			name: "code released by a rename is reused in the next batch",
+			changes: []types.SyncRecord{
+				event(1, 10, 2, "A", "B"),
+				event(2, 20, 1, "", "A"),
+				event(3, 30, 1, "", "C"),
+			},
+			keyColumn: "code",
+			want:      [][]int{{10}, {20, 30}},
+		},
+		{
+			name: "delete of a code then insert of the same code on another row",
+			changes: []types.SyncRecord{
+				event(1, 10, 3, "A", ""),
+				event(2, 20, 1, "", "A"),
+				event(3, 10, 1, "", "A"),
+			},
+			keyColumn: "code",
+			want:      [][]int{{10}, {20}, {10}},
+		},
+		{
+			name: "swapped codes need three batches",
+			changes: []types.SyncRecord{
+				event(1, 10, 2, "A", "X"),
+				event(2, 20, 2, "B", "A"),
+				event(3, 30, 2, "X", "B"),
+			},
+			keyColumn: "code",
+			want:      [][]int{{10}, {20}, {30}},
+		},
+		{
+			name:      "without a key column only row_order_ref is checked",
+			changes:   []types.SyncRecord{event(1, 10, 2, "A", "B"), event(2, 20, 1, "", "A")},
+			keyColumn: "",
+			want:      [][]int{{10, 20}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]int
+			for _, batch := range planSyncBatches(tt.changes, tt.keyColumn) {
+				var refs []int
+				for _, record := range batch {
+					refs = append(refs, record.RowOrderRef)
+				}
+				got = append(got, refs)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planSyncBatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySyncChanges(t *testing.T) {
+	changes := []types.SyncRecord{
+		event(1, 10, 2, "A", "B"), // batch 1 - ล้มเหลว
+		event(2, 20, 1, "", "A"),  // batch 2 - ใช้ code A ของ ref 10 จึงต้องรอ
+		event(3, 30, 1, "", "C"),  // batch 2 - ไม่เกี่ยวข้อง ส่งได้
+		event(4, 40, 1, "", "A"),  // batch 3 - ใช้ code A ต่อจาก ref 20 จึงต้องรอด้วย
+	}
+
+	var sent [][]int
+	result, err := ApplySyncChanges(changes, "code", func(batch []types.SyncRecord) (*SyncResult, error) {
+		var refs []int
+		batchResult := newSyncResult()
+		for _, record := range batch {
+			refs = append(refs, record.RowOrderRef)
+			if record.RowOrderRef == 10 {
+				batchResult.markFailed([]interface{}{record.RowOrderRef}, "rejected")
+			}
+		}
+		sent = append(sent, refs)
+		return batchResult, nil
+	})
+	if err != nil {
+		t.Fatalf("ApplySyncChanges() error = %v", err)
+	}
+
+	if want := [][]int{{10}, {30}}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent batches = %v, want %v", sent, want)
+	}
+	for ref, failed := range map[int]bool{10: true, 20: true, 30: false, 40: true} {
+		if result.Failed(ref) != failed {
+			t.Errorf("Failed(%d) = %v, want %v", ref, result.Failed(ref), failed)
+		}
+	}
+}
+
+func TestApplySyncChangesStopsOnError(t *testing.T) {
+	changes := []types.SyncRecord{
+		event(1, 10, 2, "A", "B"),
+		event(2, 20, 1, "", "A"),
+	}
+
+	calls := 0
+	result, err := ApplySyncChanges(changes, "code", func(batch []types.SyncRecord) (*SyncResult, error) {
+		calls++
+		return nil, errors.New("api unavailable")
+	})
+	if err == nil {
+		t.Fatal("ApplySyncChanges() error = nil, want error")
+	}
+	if calls != 1 {
+		t.Errorf("apply called %d times, want 1", calls)
+	}
+	if !result.Failed(10) || !result.Failed(20) {
+		t.Errorf("unsent rows must be skipped: Failed(10) = %v, Failed(20) = %v", result.Failed(10), result.Failed(20))
+	}
+}
+
+func describeRecords(records []types.SyncRecord) string {
+	text := ""
+	for _, record := range records {
+		text += fmt.Sprintf("  {id:%d ref:%d active:%d old:%s new:%s}\n",
+			record.ID, record.RowOrderRef, record.ActiveCode, record.OldData, record.NewData)
+	}
+	return text
+}
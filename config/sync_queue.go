@@ -0,0 +1,403 @@
+package config
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"smlmarketsync/types"
+)
+
+// SyncClaimLease ระยะเวลาที่การจองแถวใน sml_market_sync มีผล
+// ถ้า process ตายระหว่างส่งข้อมูล แถวที่จองไว้จะถูก run ถัดไปจองใหม่ได้หลังหมดเวลานี้
+const SyncClaimLease = 30 * time.Minute
+
+var (
+	runID     string
+	runIDOnce sync.Once
+)
+
+// RunID คืนค่า id ของการทำงานรอบนี้ (ใช้ค่าเดียวกันตลอดอายุของ process)
+func RunID() string {
+	runIDOnce.Do(func() {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "unknown"
+		}
+		runID = fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+		if len(runID) > 64 {
+			runID = runID[len(runID)-64:]
+		}
+	})
+	return runID
+}
+
+// SyncClaimBatchSize จำนวนแถวสูงสุดที่จองจาก sml_market_sync ต่อครั้ง
+// backlog ขนาดใหญ่ (เช่น หลัง backfill) จึงถูกจองและส่งทีละชุด โดยไม่ต้องโหลดทั้งหมดไว้ใน memory
+// step ที่ส่งแบบ transaction ส่งแต่ละชุดใน transaction เดียว (ดู ApplySyncChangesInTransaction)
+const SyncClaimBatchSize = 5000
+
+// ProcessSyncRecords จองแถวของตารางที่ระบุทีละไม่เกิน SyncClaimBatchSize แถวตามลำดับ id แล้วเรียก process กับแต่ละชุด
+// จนไม่เหลือแถวที่จองได้ คืนจำนวนแถวที่จองทั้งหมด ถ้า process คืน error จะหยุดทันที
+// ชุดถัดไปจองเฉพาะ id ที่มากกว่าชุดก่อน แถวที่ถูกปลดการจองใน run นี้จึงไม่ถูกจองซ้ำจนกว่าจะถึง run ถัดไป
+func ProcessSyncRecords(db *sql.DB, tableID int, runID string, process func(records []types.SyncRecord) error) (int, error) {
+	// นำรายการที่ถึงเวลาส่งใหม่กลับเข้าคิวก่อน (ใช้ id เดิม จึงต้องทำก่อนจองชุดแรก)
+	_, err := RequeueSyncFailures(db, tableID)
+	if err != nil {
+		return 0, err
+	}
+
+	claimed, afterID := 0, 0
+	for {
+		records, err := ClaimSyncRecords(db, tableID, runID, afterID, SyncClaimBatchSize)
+		if err != nil {
+			return claimed, err
+		}
+		if len(records) == 0 {
+			return claimed, nil
+		}
+		claimed += len(records)
+		afterID = records[len(records)-1].ID
+
+		if err := process(records); err != nil {
+			return claimed, err
+		}
+		if len(records) < SyncClaimBatchSize {
+			return claimed, nil
+		}
+	}
+}
+
+// ClaimSyncRecords จองแถวใน sml_market_sync ของตารางที่ระบุที่มี id มากกว่า afterID ให้กับ run นี้ ไม่เกิน limit แถว (เรียงตาม id)
+// แถวที่ run อื่นจองไว้และยังไม่หมดเวลา (SyncClaimLease) หรือถูก lock อยู่จะไม่ถูกดึงมา
+// แถวของ row_order_ref ที่ยังรอส่งใหม่ใน sml_market_sync_failed จะไม่ถูกดึงมา เพื่อไม่ให้ส่งข้ามลำดับ
+func ClaimSyncRecords(db *sql.DB, tableID int, runID string, afterID int, limit int) ([]types.SyncRecord, error) {
+	query := `
+		UPDATE sml_market_sync
+		SET claim_run_id = $1, claimed_at = NOW()
+		WHERE id IN (
+			SELECT s.id FROM sml_market_sync s
+			WHERE s.table_id = $2
+			  AND s.id > $4
+			  AND (s.claim_run_id IS NULL OR s.claim_run_id = $1 OR s.claimed_at < NOW() - ($3 * INTERVAL '1 second'))
+			  AND NOT EXISTS (
+				SELECT 1 FROM sml_market_sync_failed f
+				WHERE f.table_id = s.table_id
+				  AND f.row_order_ref = s.row_order_ref
+				  AND f.requeued_at IS NULL
+			  )
+			ORDER BY s.id
+			LIMIT $5
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, table_id, active_code, row_order_ref, new_data, old_data
+	`
+
+	rows, err := db.Query(query, runID, tableID, int(SyncClaimLease.Seconds()), afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error claiming sml_market_sync rows for table_id %d: %v", tableID, err)
+	}
+	defer rows.Close()
+
+	var records []types.SyncRecord
+	for rows.Next() {
+		var record types.SyncRecord
+		err := rows.Scan(&record.ID, &record.TableID, &record.ActiveCode, &record.RowOrderRef, &record.NewData, &record.OldData)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning claimed sync row: %v", err)
+		}
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating claimed sync rows: %v", err)
+	}
+
+	// เรียงตาม id ซึ่งเป็นลำดับที่การเปลี่ยนแปลงเกิดขึ้นจริง
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+
+	if len(records) > 0 {
+		fmt.Printf("🔒 จองข้อมูลจาก sml_market_sync (table_id=%d) ได้ %d รายการ (run: %s)\n", tableID, len(records), runID)
+	}
+	return records, nil
+}
+
+// AckSyncRecords ลบแถวที่ API ยืนยันการรับข้อมูลแล้วออกจาก sml_market_sync แบบ batch
+// ลบเฉพาะแถวที่ยังถูกจองโดย runID นี้ เพื่อไม่ให้ลบแถวที่ run อื่นจองต่อไปแล้ว
+func AckSyncRecords(db *sql.DB, runID string, syncIds []int, batchSize int) error {
+	if len(syncIds) == 0 {
+		fmt.Println("✅ ไม่มีข้อมูลที่ต้องลบจาก sml_market_sync")
+		return nil
+	}
+
+	totalItems := len(syncIds)
+	fmt.Printf("🗑️ กำลังลบข้อมูลที่ซิงค์สำเร็จจากตาราง sml_market_sync (local database): %d รายการ (แบ่งเป็น batch ละ %d รายการ)\n",
+		totalItems, batchSize)
+
+	totalDeleted, failedBatches, batchCount := execSyncRecordBatches(db,
+		"DELETE FROM sml_market_sync WHERE claim_run_id = $1 AND id IN (%s)", runID, syncIds, batchSize)
+
+	if failedBatches > 0 {
+		fmt.Printf("⚠️ สรุปการลบข้อมูลจาก sml_market_sync: ลบได้ %d/%d รายการ (%d/%d batches สำเร็จ)\n",
+			totalDeleted, totalItems, batchCount-failedBatches, batchCount)
+		return fmt.Errorf("มีบาง batch ที่ลบไม่สำเร็จ (%d/%d batches ล้มเหลว)", failedBatches, batchCount)
+	}
+
+	fmt.Printf("✅ ลบข้อมูลจาก sml_market_sync เรียบร้อยแล้ว: %d รายการ (%d batches)\n", totalDeleted, batchCount)
+	return nil
+}
+
+// ReleaseSyncRecords ปลดการจองแถวที่ส่งไม่สำเร็จ เพื่อให้ run ถัดไปนำไปส่งใหม่
+func ReleaseSyncRecords(db *sql.DB, runID string, syncIds []int, batchSize int) error {
+	if len(syncIds) == 0 {
+		return nil
+	}
+
+	totalItems := len(syncIds)
+	fmt.Printf("🔓 กำลังปลดการจองข้อมูลที่ซิงค์ไม่สำเร็จใน sml_market_sync: %d รายการ\n", totalItems)
+
+	totalReleased, failedBatches, batchCount := execSyncRecordBatches(db,
+		"UPDATE sml_market_sync SET claim_run_id = NULL, claimed_at = NULL WHERE claim_run_id = $1 AND id IN (%s)",
+		runID, syncIds, batchSize)
+
+	if failedBatches > 0 {
+		return fmt.Errorf("ปลดการจองไม่สำเร็จ %d/%d batches (ปลดได้ %d/%d รายการ) แถวที่เหลือจะถูกปลดเมื่อหมดเวลาจอง",
+			failedBatches, batchCount, totalReleased, totalItems)
+	}
+
+	fmt.Printf("✅ ปลดการจองเรียบร้อยแล้ว: %d รายการ จะถูกส่งใหม่ในรอบถัดไป\n", totalReleased)
+	return nil
+}
+
+// execSyncRecordBatches รันคำสั่งที่มี claim_run_id เป็น $1 และรายการ id เป็น placeholder ที่เหลือ แบ่งเป็น batch
+func execSyncRecordBatches(db *sql.DB, queryFormat string, runID string, syncIds []int, batchSize int) (int, int, int) {
+	totalItems := len(syncIds)
+	batchCount := (totalItems + batchSize - 1) / batchSize
+	totalAffected := 0
+	failedBatches := 0
+
+	for b := 0; b < batchCount; b++ {
+		start := b * batchSize
+		end := start + batchSize
+		if end > totalItems {
+			end = totalItems
+		}
+
+		batchIds := syncIds[start:end]
+		placeholders := make([]string, len(batchIds))
+		args := make([]interface{}, 0, len(batchIds)+1)
+		args = append(args, runID)
+		for i, id := range batchIds {
+			placeholders[i] = "$" + strconv.Itoa(i+2)
+			args = append(args, id)
+		}
+
+		result, err := db.Exec(fmt.Sprintf(queryFormat, strings.Join(placeholders, ", ")), args...)
+		if err != nil {
+			fmt.Printf("   ❌ ERROR: batch ที่ %d/%d ของ sml_market_sync ล้มเหลว: %v\n", b+1, batchCount, err)
+			failedBatches++
+			continue
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			rowsAffected = int64(len(batchIds))
+		}
+		totalAffected += int(rowsAffected)
+	}
+
+	return totalAffected, failedBatches, batchCount
+}
+
+// SyncResult ผลการส่งข้อมูลไปยัง API ของแต่ละ step
+// เก็บ row_order_ref ที่ API ไม่ยืนยัน เพื่อให้ step รู้ว่าแถวไหนใน sml_market_sync ลบได้
+//   - failedRefs  = ส่งแล้วแต่ API ปฏิเสธ จะถูกย้ายไป sml_market_sync_failed และส่งใหม่ตาม backoff
+//   - skippedRefs = ยังไม่ได้ส่ง (เช่น อ่านข้อมูลต้นทางไม่ได้) จะถูกปลดการจองให้ run ถัดไปส่งทันที
+type SyncResult struct {
+	failedRefs  map[int]string
+	skippedRefs map[int]string
+	stopped     error // ErrCircuitOpen - รายการที่เหลือไม่ต้องส่ง
+}
+
+func newSyncResult() *SyncResult {
+	return &SyncResult{failedRefs: make(map[int]string), skippedRefs: make(map[int]string)}
+}
+
+// markFailed บันทึกว่า row_order_ref ของรายการเหล่านี้ส่งไม่สำเร็จ
+// items เป็นได้ทั้ง map ที่มี row_order_ref หรือค่า row_order_ref ตรง ๆ
+func (r *SyncResult) markFailed(items []interface{}, reason string) {
+	for _, item := range items {
+		if ref, ok := itemRowOrderRef(item); ok {
+			r.failedRefs[ref] = reason
+		}
+	}
+}
+
+// markError บันทึกรายการที่ส่งไม่สำเร็จเพราะ err
+// ถ้า circuit breaker เปิดอยู่ คำขอไม่ได้ถูกส่ง รายการจึงถูกบันทึกเป็น skipped (ปลดการจองให้ run ถัดไปส่ง)
+// แทน failed ที่จะถูกย้ายไป sml_market_sync_failed และนับ attempts
+func (r *SyncResult) markError(items []interface{}, err error) {
+	if !errors.Is(err, ErrCircuitOpen) {
+		r.markFailed(items, err.Error())
+		return
+	}
+	if r.stopped == nil {
+		r.stopped = err
+	}
+	for _, item := range items {
+		if ref, ok := itemRowOrderRef(item); ok {
+			r.markSkipped(ref, err.Error())
+		}
+	}
+}
+
+// markSkipped บันทึกว่า row_order_ref นี้ยังไม่ได้ส่ง
+func (r *SyncResult) markSkipped(rowOrderRef int, reason string) {
+	if _, failed := r.failedRefs[rowOrderRef]; !failed {
+		r.skippedRefs[rowOrderRef] = reason
+	}
+}
+
+// merge รวมผลของอีก batch เข้ามา
+func (r *SyncResult) merge(other *SyncResult) {
+	for ref, reason := range other.failedRefs {
+		r.failedRefs[ref] = reason
+		delete(r.skippedRefs, ref)
+	}
+	for ref, reason := range other.skippedRefs {
+		r.markSkipped(ref, reason)
+	}
+	if r.stopped == nil {
+		r.stopped = other.stopped
+	}
+}
+
+// Failed คืนค่า true ถ้า row_order_ref นี้ส่งไม่สำเร็จหรือยังไม่ได้ส่ง
+func (r *SyncResult) Failed(rowOrderRef int) bool {
+	_, failed := r.failedRefs[rowOrderRef]
+	_, skipped := r.skippedRefs[rowOrderRef]
+	return failed || skipped
+}
+
+// FailedCount จำนวน row_order_ref ที่ส่งไม่สำเร็จหรือยังไม่ได้ส่ง
+func (r *SyncResult) FailedCount() int {
+	return len(r.failedRefs) + len(r.skippedRefs)
+}
+
+// Err คืนค่า error สรุป ถ้ามีรายการที่ส่งไม่สำเร็จ
+// step แสดงเป็น warning แล้วทำงานต่อ เพราะ FinishSyncRecords ย้ายหรือปลดรายการเหล่านี้ไว้ส่งใหม่แล้ว
+func (r *SyncResult) Err() error {
+	if r.FailedCount() == 0 {
+		return nil
+	}
+	firstRef, reason := -1, ""
+	for _, refs := range []map[int]string{r.failedRefs, r.skippedRefs} {
+		for ref, refReason := range refs {
+			if firstRef == -1 || ref < firstRef {
+				firstRef, reason = ref, refReason
+			}
+		}
+	}
+	return fmt.Errorf("ส่งข้อมูลไม่สำเร็จ %d รายการ (เช่น row_order_ref %d: %s)",
+		r.FailedCount(), firstRef, reason)
+}
+
+// SplitRecords แยก id ใน sml_market_sync เป็นกลุ่มที่ลบได้ (ack) กลุ่มที่ API ปฏิเสธ (failed)
+// และกลุ่มที่ยังไม่ได้ส่งซึ่งต้องปลดการจอง (release)
+func (r *SyncResult) SplitRecords(records []types.SyncRecord) ([]int, []int, []int) {
+	var ackIds, failedIds, releaseIds []int
+	for _, record := range records {
+		if _, failed := r.failedRefs[record.RowOrderRef]; failed {
+			failedIds = append(failedIds, record.ID)
+		} else if _, skipped := r.skippedRefs[record.RowOrderRef]; skipped {
+			releaseIds = append(releaseIds, record.ID)
+		} else {
+			ackIds = append(ackIds, record.ID)
+		}
+	}
+	return ackIds, failedIds, releaseIds
+}
+
+// FinishSyncRecords ack แถวที่ส่งสำเร็จ ย้ายแถวที่ API ปฏิเสธไป sml_market_sync_failed
+// และ release แถวที่ยังไม่ได้ส่ง ตามผลจาก API
+func FinishSyncRecords(db *sql.DB, runID string, records []types.SyncRecord, result *SyncResult) error {
+	ackIds, failedIds, releaseIds := result.SplitRecords(records)
+
+	ackErr := AckSyncRecords(db, runID, ackIds, 100)
+	if ackErr == nil && len(records) > 0 {
+		ackErr = ClearSyncFailures(db, records[0].TableID, ackedRowOrderRefs(records, result))
+	}
+	failedErr := DeadLetterSyncRecords(db, runID, records, failedIds, result.failedRefs)
+	releaseErr := ReleaseSyncRecords(db, runID, releaseIds, 100)
+	for _, err := range []error{ackErr, failedErr, releaseErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ackedRowOrderRefs คืนค่า row_order_ref ที่ส่งสำเร็จ (ไม่ซ้ำ)
+func ackedRowOrderRefs(records []types.SyncRecord, result *SyncResult) []int {
+	seen := make(map[int]bool)
+	var refs []int
+	for _, record := range records {
+		if !result.Failed(record.RowOrderRef) && !seen[record.RowOrderRef] {
+			seen[record.RowOrderRef] = true
+			refs = append(refs, record.RowOrderRef)
+		}
+	}
+	return refs
+}
+
+// SyncRecordIDs คืนค่า id ทั้งหมดของแถวที่จองไว้
+func SyncRecordIDs(records []types.SyncRecord) []int {
+	ids := make([]int, len(records))
+	for i, record := range records {
+		ids[i] = record.ID
+	}
+	return ids
+}
+
+// DecodeSyncSnapshot แปลง snapshot (new_data/old_data) เป็น map คืนค่า nil ถ้าไม่มี snapshot
+func DecodeSyncSnapshot(data []byte) (map[string]interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var snapshot map[string]interface{}
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding sml_market_sync snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// itemRowOrderRef อ่าน row_order_ref จาก map ของรายการ หรือจากค่าที่เป็น row_order_ref ตรง ๆ
+func itemRowOrderRef(item interface{}) (int, bool) {
+	if itemMap, ok := item.(map[string]interface{}); ok {
+		item = itemMap["row_order_ref"]
+	}
+
+	switch v := item.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	case string:
+		ref, err := strconv.Atoi(v)
+		return ref, err == nil
+	default:
+		return 0, false
+	}
+}
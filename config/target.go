@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Target ปลายทางที่ APIClient ส่งคำสั่งไป (HTTP API หรือ PostgreSQL ของ marketplace โดยตรง)
+// ทุกแบบคืนผลเป็น QueryResponse รูปแบบเดียวกัน step ต่าง ๆ จึงทำงานได้โดยไม่ต้องรู้ว่าใช้ปลายทางแบบใด
+// ถ้าคำสั่งผิด (เช่น SQL error) จะคืน QueryResponse ที่ Success = false
+// ถ้าติดต่อปลายทางไม่ได้จะคืน QueryResponse เป็น nil พร้อม error
+type Target interface {
+	// Select รันคำสั่ง SELECT แล้วคืนแถวใน Data เป็น []interface{} ของ map[string]interface{}
+	Select(query string, params []interface{}) (*QueryResponse, error)
+	// Command รันคำสั่งที่ไม่คืนแถว (INSERT, UPDATE, DELETE, CREATE, ...)
+	Command(query string, params []interface{}) (*QueryResponse, error)
+	// Tx รันคำสั่งทั้งหมดตามลำดับใน transaction เดียว
+	Tx(statements []TxStatement) (*QueryResponse, error)
+}
+
+// TxStatement คำสั่งหนึ่งคำสั่งใน transaction พร้อมค่าของ $1, $2, ...
+// ถ้า Bulk ไม่เป็น nil คำสั่งนี้คือการ upsert หลายแถว ปลายทางที่เป็น BulkUpserter ส่งด้วย COPY
+// ส่วนปลายทางอื่นใช้คำสั่งจาก BulkRows.statement แทน
+type TxStatement struct {
+	Query  string
+	Params []interface{}
+	Bulk   *BulkRows
+}
+
+// BulkUpserter target ที่ upsert หลายแถวแบบ bulk ได้ (เช่น COPY ของ PostgreSQL)
+// rows เรียงค่าตาม columns
+type BulkUpserter interface {
+	BulkUpsert(tableName string, keyColumns []string, columns []string, rows [][]interface{}) (*QueryResponse, error)
+}
+
+// BulkRows แถวที่ต้อง upsert เข้า Table ตาม KeyColumns (ค่าของแต่ละแถวเรียงตาม Columns)
+type BulkRows struct {
+	Table      string
+	KeyColumns []string
+	Columns    []string
+	Rows       [][]interface{}
+}
+
+// statement คำสั่ง INSERT ... ON CONFLICT หลายแถวที่ให้ผลเดียวกับการ upsert ด้วย COPY
+func (b *BulkRows) statement() TxStatement {
+	var values []string
+	var params queryParams
+	for _, row := range b.Rows {
+		values = append(values, params.row(row...))
+	}
+	return TxStatement{
+		Query:  fmt.Sprintf(upsertQueryFormat(b.Table, b.KeyColumns, b.Columns), strings.Join(values, ",")),
+		Params: params.values,
+	}
+}
+
+// Target types ของ section "target" ใน smlmarketsync.json
+const (
+	TargetHTTP     = "http"
+	TargetPostgres = "postgres"
+)
+
+// TargetConfig การเลือกปลายทาง (section "target" ใน smlmarketsync.json)
+// ถ้าไม่มี section นี้จะใช้ HTTP API ตามเดิม
+type TargetConfig struct {
+	Type     string         `json:"type"`     // "http" (ค่าเริ่มต้น) หรือ "postgres"
+	Postgres DatabaseConfig `json:"postgres"` // การเชื่อมต่อฐานข้อมูล marketplace เมื่อ type = "postgres"
+}
+
+// newTarget สร้างปลายทางตาม section "target" ใน smlmarketsync.json (HTTP API ใช้การตั้งค่าจาก apiConfig)
+func newTarget(apiConfig *APIConfig) Target {
+	config, err := loadConfig()
+	if err != nil || config.Target == nil {
+		return newHTTPTarget(apiConfig)
+	}
+	switch config.Target.Type {
+	case "", TargetHTTP:
+		return newHTTPTarget(apiConfig)
+	case TargetPostgres:
+		target, err := newPostgresTarget(&config.Target.Postgres, apiConfig)
+		if err != nil {
+			log.Fatalf("❌ Error: ไม่สามารถเชื่อมต่อฐานข้อมูล marketplace: %v\nโปรแกรมจบการทำงาน", err)
+		}
+		log.Printf("✅ ส่งข้อมูลไปยังฐานข้อมูล marketplace โดยตรง: %s:%d", config.Target.Postgres.Host, config.Target.Postgres.Port)
+		return target
+	default:
+		log.Fatalf("❌ Error: target.type ใน %s ไม่ถูกต้อง: %q (ใช้ได้ \"http\" หรือ \"postgres\")\nโปรแกรมจบการทำงาน", configPath, config.Target.Type)
+		return nil
+	}
+}
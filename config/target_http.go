@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// transactionTag dollar-quote ที่ครอบคำสั่งทั้งหมดใน DO block ของ transaction (ใช้เมื่อ server ไม่มี transaction endpoint)
+const transactionTag = "$sml_market_sync_tx$"
+
+// errEndpointNotFound server ตอบ 404 (ไม่มี endpoint ที่เรียก)
+var errEndpointNotFound = errors.New("endpoint not found")
+
+// httpTarget ส่งคำสั่งไปยัง /pgselect และ /pgcommand ของ API
+type httpTarget struct {
+	client *http.Client
+	config *APIConfig
+	auth   Authenticator // nil = ไม่ยืนยันตัวตน
+	policy *retryPolicy
+
+	// inlineParams = true เมื่อ server ไม่รองรับ params จะแปลง parameter เป็นข้อความ SQL ก่อนส่ง
+	inlineParams atomic.Bool
+	// doBlockTx = true เมื่อ server ไม่มี transaction endpoint จะส่ง transaction เป็น DO block แทน
+	doBlockTx atomic.Bool
+}
+
+func newHTTPTarget(config *APIConfig) *httpTarget {
+	return &httpTarget{
+		client: &http.Client{
+			Timeout: config.Timeout(),
+		},
+		config: config,
+		auth:   newAuthenticator(config.Auth),
+		policy: newRetryPolicy(config),
+	}
+}
+
+func (t *httpTarget) Select(query string, params []interface{}) (*QueryResponse, error) {
+	return t.execute(query, params, t.config.SelectEndpoint)
+}
+
+func (t *httpTarget) Command(query string, params []interface{}) (*QueryResponse, error) {
+	return t.execute(query, params, t.config.CommandEndpoint)
+}
+
+// Tx ส่งคำสั่งพร้อม params ทั้งหมดไปยัง transaction endpoint ในคำขอเดียว server รันทุกคำสั่งใน transaction เดียวกัน
+// ถ้า server ไม่มี endpoint นี้ (404) จะส่งเป็น DO block ผ่าน command endpoint แทนตั้งแต่คำขอนี้
+func (t *httpTarget) Tx(statements []TxStatement) (*QueryResponse, error) {
+	if t.doBlockTx.Load() {
+		return t.txDoBlock(statements)
+	}
+
+	request := TransactionRequest{Statements: make([]QueryRequest, len(statements))}
+	for i, statement := range statements {
+		if statement.Bulk != nil {
+			statement = statement.Bulk.statement()
+		}
+		request.Statements[i] = QueryRequest{Query: statement.Query, Params: statement.Params}
+	}
+
+	resp, err := t.executeTx(request)
+	if errors.Is(err, errEndpointNotFound) {
+		fmt.Printf("⚠️ server ไม่มี %s จะส่ง transaction เป็น DO block แทนตั้งแต่คำขอนี้\n", t.config.TransactionEndpoint)
+		t.doBlockTx.Store(true)
+		return t.txDoBlock(statements)
+	}
+	return resp, err
+}
+
+// executeTx ส่ง request ไปยัง transaction endpoint ถ้า server ไม่รองรับ params จะแปลงเป็นข้อความแบบเดียวกับ execute
+func (t *httpTarget) executeTx(request TransactionRequest) (*QueryResponse, error) {
+	if !t.inlineParams.Load() {
+		resp, err := t.executeQuery(request, t.config.TransactionEndpoint)
+		if !paramsUnsupported(resp, err) {
+			return resp, err
+		}
+		fmt.Println("⚠️ server ไม่รองรับ params จะแปลง parameter เป็นข้อความ SQL แทนตั้งแต่คำขอนี้")
+		t.inlineParams.Store(true)
+	}
+
+	inlined := TransactionRequest{Statements: make([]QueryRequest, len(request.Statements))}
+	for i, statement := range request.Statements {
+		inlined.Statements[i] = QueryRequest{Query: interpolateParams(statement.Query, statement.Params)}
+	}
+	return t.executeQuery(inlined, t.config.TransactionEndpoint)
+}
+
+// txDoBlock ส่งคำสั่งทั้งหมดเป็น DO block เดียว (แปลง parameter เป็นข้อความ) สำหรับ server ที่ไม่มี transaction endpoint
+func (t *httpTarget) txDoBlock(statements []TxStatement) (*QueryResponse, error) {
+	var script strings.Builder
+	script.WriteString("DO " + transactionTag + "\nBEGIN\n")
+	for _, statement := range statements {
+		if statement.Bulk != nil {
+			statement = statement.Bulk.statement()
+		}
+		query := strings.TrimSpace(statement.Query)
+		if len(statement.Params) > 0 {
+			query = interpolateParams(query, statement.Params)
+		}
+		if strings.Contains(query, transactionTag) {
+			return nil, fmt.Errorf("statement contains reserved tag %s", transactionTag)
+		}
+		script.WriteString(strings.TrimRight(query, "; \t\n"))
+		script.WriteString(";\n")
+	}
+	script.WriteString("END\n" + transactionTag)
+
+	return t.Command(script.String(), nil)
+}
+
+// execute ส่ง query พร้อม params ถ้า server ไม่รองรับ params จะสลับไปใช้แบบแปลงเป็นข้อความอัตโนมัติ
+func (t *httpTarget) execute(query string, params []interface{}, endpoint string) (*QueryResponse, error) {
+	if len(params) == 0 {
+		return t.executeQuery(QueryRequest{Query: query}, endpoint)
+	}
+
+	if t.inlineParams.Load() {
+		return t.executeQuery(QueryRequest{Query: interpolateParams(query, params)}, endpoint)
+	}
+
+	resp, err := t.executeQuery(QueryRequest{Query: query, Params: params}, endpoint)
+	if paramsUnsupported(resp, err) {
+		fmt.Println("⚠️ server ไม่รองรับ params จะแปลง parameter เป็นข้อความ SQL แทนตั้งแต่คำขอนี้")
+		t.inlineParams.Store(true)
+		return t.executeQuery(QueryRequest{Query: interpolateParams(query, params)}, endpoint)
+	}
+	return resp, err
+}
+
+// executeQuery ส่งคำขอไปยัง endpoint ถ้าติดต่อไม่ได้หรือได้ status ที่ส่งซ้ำได้ จะส่งซ้ำตาม api.retry (ดู retryPolicy)
+// reqBody เป็น QueryRequest หรือ TransactionRequest
+func (t *httpTarget) executeQuery(reqBody interface{}, endpoint string) (*QueryResponse, error) {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	url := t.config.endpointURL(endpoint)
+	return t.policy.do(endpoint == t.config.SelectEndpoint, func() (*QueryResponse, *retryHint, error) {
+		return t.post(url, jsonData)
+	})
+}
+
+// post ส่งคำขอหนึ่งครั้ง hint != nil เมื่อติดต่อ API ไม่ได้หรือได้ status ที่ส่งซ้ำได้
+func (t *httpTarget) post(url string, jsonData []byte) (*QueryResponse, *retryHint, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if t.auth != nil {
+		if err := t.auth.Authenticate(req, jsonData); err != nil {
+			return nil, nil, fmt.Errorf("error authenticating request: %v", err)
+		}
+	}
+
+	// แสดงข้อมูล URL ที่กำลังเรียก
+	fmt.Printf("กำลังส่งคำขอไปยัง URL: %s\n", url)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, &retryHint{}, fmt.Errorf("error executing request to %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		// การเชื่อมต่อถูกตัดระหว่างอ่าน response
+		return nil, &retryHint{}, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	// แสดงตัวอย่าง response body สำหรับ debug
+	bodySample := string(body)
+	if len(bodySample) > 500 {
+		bodySample = bodySample[:500] + "..."
+	}
+	fmt.Printf("ได้รับการตอบกลับ: %s\n", bodySample)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, fmt.Errorf("%w: %s", errEndpointNotFound, url)
+	}
+
+	// status ที่ส่งซ้ำได้ (เช่น 502 จาก proxy) มักไม่มี body เป็น JSON
+	if t.config.Retry.retryableStatus(resp.StatusCode) {
+		return nil, &retryHint{retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))},
+			fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, bodySample)
+	}
+
+	var response QueryResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error unmarshaling response: %v\nResponse body: %s", err, bodySample)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &response, nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, response.Message)
+	}
+	return &response, nil, nil
+}
+
+// parseRetryAfter แปลง header Retry-After (จำนวนวินาทีหรือวันที่แบบ HTTP) เป็นระยะเวลาที่ต้องรอ
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// copyTempTable ตารางชั่วคราวที่ BulkUpsert ใช้รับข้อมูลจาก COPY (ถูกลบเมื่อ transaction จบ)
+const copyTempTable = "sml_market_sync_copy"
+
+// postgresTarget ส่งคำสั่งไปยังฐานข้อมูล marketplace โดยตรงด้วย lib/pq (เช่น ผ่าน VPN)
+// การส่งซ้ำและ circuit breaker ใช้ api.retry และ api.circuit_breaker เดียวกับ HTTP API
+type postgresTarget struct {
+	db     *sql.DB
+	policy *retryPolicy
+}
+
+func newPostgresTarget(config *DatabaseConfig, apiConfig *APIConfig) (*postgresTarget, error) {
+	db, err := config.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTarget{db: db, policy: newRetryPolicy(apiConfig)}, nil
+}
+
+func (t *postgresTarget) Select(query string, params []interface{}) (*QueryResponse, error) {
+	return t.run(true, func() (*QueryResponse, error) {
+		rows, err := t.db.Query(query, params...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		data, err := scanRowMaps(rows)
+		if err != nil {
+			return nil, err
+		}
+		return &QueryResponse{Success: true, Data: data}, nil
+	})
+}
+
+func (t *postgresTarget) Command(query string, params []interface{}) (*QueryResponse, error) {
+	return t.run(false, func() (*QueryResponse, error) {
+		result, err := t.db.Exec(query, params...)
+		if err != nil {
+			return nil, err
+		}
+		return commandResponse(result), nil
+	})
+}
+
+// Tx รันทุกคำสั่งใน transaction ของฐานข้อมูล (parameter ถูกส่งแยกจาก query ตามปกติ)
+// คำสั่งแบบ bulk (TxStatement.Bulk) ถูกส่งด้วย COPY ภายใน transaction เดียวกัน
+func (t *postgresTarget) Tx(statements []TxStatement) (*QueryResponse, error) {
+	return t.run(false, func() (*QueryResponse, error) {
+		tx, err := t.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, statement := range statements {
+			if statement.Bulk != nil {
+				_, err = copyUpsert(tx, statement.Bulk)
+			} else {
+				_, err = tx.Exec(statement.Query, statement.Params...)
+			}
+			if err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("statement %d: %w", i+1, err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return &QueryResponse{Success: true, Message: fmt.Sprintf("%d statements committed", len(statements))}, nil
+	})
+}
+
+// BulkUpsert ส่งแถวทั้งหมดเข้าตารางชั่วคราวด้วย COPY แล้ว upsert จากตารางนั้นในคำสั่งเดียว (ใน transaction เดียวกัน)
+func (t *postgresTarget) BulkUpsert(tableName string, keyColumns []string, columns []string, rows [][]interface{}) (*QueryResponse, error) {
+	bulk := &BulkRows{Table: tableName, KeyColumns: keyColumns, Columns: columns, Rows: rows}
+	return t.run(false, func() (*QueryResponse, error) {
+		tx, err := t.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		result, err := copyUpsert(tx, bulk)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return commandResponse(result), nil
+	})
+}
+
+// copyUpsert ส่งแถวของ bulk เข้าตารางชั่วคราวด้วย COPY แล้ว upsert เข้า bulk.Table ภายใน tx
+// ตารางชั่วคราวถูกลบหลังใช้ คำสั่ง bulk หลายคำสั่งจึงอยู่ใน transaction เดียวกันได้
+func copyUpsert(tx *sql.Tx, bulk *BulkRows) (sql.Result, error) {
+	_, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", copyTempTable, bulk.Table))
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn(copyTempTable, bulk.Columns...))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range bulk.Rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			stmt.Close()
+			return nil, err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	if err := stmt.Close(); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(upsertQuery(bulk.Table, bulk.KeyColumns, bulk.Columns, "SELECT "+strings.Join(bulk.Columns, ", ")+" FROM "+copyTempTable))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DROP TABLE " + copyTempTable); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// run เรียก exec ตาม retryPolicy แล้วแปลง error เป็น QueryResponse ด้วย postgresResponse
+// error ที่ติดต่อฐานข้อมูลไม่ได้หรือเป็นปัญหาชั่วคราว (ดู postgresTransient) จะถูกส่งซ้ำ
+func (t *postgresTarget) run(isSelect bool, exec func() (*QueryResponse, error)) (*QueryResponse, error) {
+	return t.policy.do(isSelect, func() (*QueryResponse, *retryHint, error) {
+		resp, err := exec()
+		if err == nil {
+			return resp, nil, nil
+		}
+		resp, err = postgresResponse(err)
+		if resp == nil || postgresTransient(resp.Error) {
+			if err == nil {
+				err = fmt.Errorf("%s", resp.Message)
+			}
+			return resp, &retryHint{}, err
+		}
+		return resp, nil, err
+	})
+}
+
+// postgresTransient SQLSTATE ที่ส่งซ้ำแล้วอาจสำเร็จ: การเชื่อมต่อหลุด, serialization failure, deadlock,
+// server กำลังปิด และ connection เต็ม
+func postgresTransient(code string) bool {
+	switch {
+	case strings.HasPrefix(code, "08"):
+		return true
+	case code == "40001", code == "40P01", code == "57P01", code == "57P02", code == "57P03", code == "53300":
+		return true
+	}
+	return false
+}
+
+// postgresResponse แปลง error ของฐานข้อมูลเป็น QueryResponse ที่ไม่สำเร็จ (แบบเดียวกับที่ API ตอบ)
+// error ที่ไม่ได้มาจาก server (เช่น ติดต่อไม่ได้) จะคืนเป็น error เพื่อให้ผู้เรียกรู้ว่าไม่ได้รันคำสั่ง
+func postgresResponse(err error) (*QueryResponse, error) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return &QueryResponse{Success: false, Message: err.Error(), Error: string(pqErr.Code)}, nil
+	}
+	return nil, err
+}
+
+// commandResponse คืนผลของคำสั่งพร้อมจำนวนแถวที่ได้รับผลกระทบ
+func commandResponse(result sql.Result) *QueryResponse {
+	affected, _ := result.RowsAffected()
+	return &QueryResponse{Success: true, Message: fmt.Sprintf("%d rows affected", affected)}
+}
+
+// scanRowMaps อ่านทุกแถวเป็น map ตามชื่อ column โดยแปลงค่าให้เหมือนกับที่ได้จาก JSON ของ API
+// (ตัวเลขจำนวนเต็มเป็น float64, NUMERIC และข้อความเป็น string)
+func scanRowMaps(rows *sql.Rows) ([]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	data := []interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			switch v := values[i].(type) {
+			case []byte:
+				row[column] = string(v)
+			case int64:
+				row[column] = float64(v)
+			case time.Time:
+				row[column] = v.Format(time.RFC3339Nano)
+			default:
+				row[column] = v
+			}
+		}
+		data = append(data, row)
+	}
+	return data, rows.Err()
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// retryPolicy การส่งซ้ำและ circuit breaker ตาม api.retry และ api.circuit_breaker ที่ทุก Target ใช้ร่วมกัน
+type retryPolicy struct {
+	retry   APIRetryConfig
+	breaker *circuitBreaker
+}
+
+func newRetryPolicy(config *APIConfig) *retryPolicy {
+	return &retryPolicy{retry: config.Retry, breaker: newCircuitBreaker(config.Breaker)}
+}
+
+// retryHint คำขอที่ส่งซ้ำได้ พร้อมเวลาที่ปลายทางขอให้รอ (Retry-After, 0 = ไม่ระบุ)
+type retryHint struct {
+	retryAfter time.Duration
+}
+
+// do เรียก send จนสำเร็จหรือครบจำนวนครั้ง (select และ command ใช้จำนวนครั้งแยกกัน)
+// send คืน hint != nil เมื่อติดต่อปลายทางไม่ได้หรือได้ผลที่ส่งซ้ำได้
+// ถ้าส่งซ้ำครบแล้วยังไม่สำเร็จจะนับเป็นความล้มเหลวของ circuit breaker
+func (p *retryPolicy) do(isSelect bool, send func() (*QueryResponse, *retryHint, error)) (*QueryResponse, error) {
+	trial, err := p.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts := p.retry.attempts(isSelect)
+	for attempt := 1; ; attempt++ {
+		resp, hint, err := send()
+		if hint == nil {
+			p.breaker.record(trial, true)
+			return resp, err
+		}
+		if attempt >= maxAttempts {
+			p.breaker.record(trial, false)
+			return resp, err
+		}
+
+		delay := p.retry.backoff(attempt, hint.retryAfter)
+		fmt.Printf("⚠️ ส่งคำขอไม่สำเร็จ (ครั้งที่ %d/%d): %v จะส่งซ้ำใน %s\n", attempt, maxAttempts, err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,315 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// upsertQueryFormat สร้างคำสั่ง INSERT ... ON CONFLICT DO UPDATE สำหรับ executeBatchBisect (VALUES เป็น %s)
+// ทุก column ยกเว้น key จะถูกแทนด้วยค่าใหม่ การส่งซ้ำ (retry) จึงให้ผลเหมือนเดิม
+func upsertQueryFormat(tableName string, keyColumns []string, columns []string) string {
+	return upsertQuery(tableName, keyColumns, columns, "VALUES %s")
+}
+
+// upsertQuery สร้างคำสั่ง INSERT ... ON CONFLICT DO UPDATE ที่รับแถวจาก source (VALUES หรือ SELECT)
+func upsertQuery(tableName string, keyColumns []string, columns []string, source string) string {
+	isKey := make(map[string]bool, len(keyColumns))
+	for _, column := range keyColumns {
+		isKey[column] = true
+	}
+
+	var sets []string
+	for _, column := range columns {
+		if !isKey[column] {
+			sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+		}
+	}
+
+	return fmt.Sprintf(`
+		INSERT INTO %s (%s)
+		%s
+		ON CONFLICT (%s) DO UPDATE SET
+			%s
+	`, tableName, strings.Join(columns, ", "), source, strings.Join(keyColumns, ", "), strings.Join(sets, ",\n\t\t\t"))
+}
+
+// upsertRows upsert rows เข้า tableName ตาม keyColumns คืนค่าจำนวนแถวที่บันทึกสำเร็จ (แถวที่ผิดถูกบันทึกลง result)
+// ปลายทางที่เป็น BulkUpserter (PostgreSQL โดยตรง) ส่งทั้งชุดด้วย COPY ถ้าถูกปฏิเสธจะใช้ executeBatchBisect หาแถวที่ผิด
+// ใน transaction จะเก็บเป็นคำสั่ง bulk ที่ปลายทางส่งด้วย COPY ตอน commit ส่วนปลายทางอื่นส่งเป็น INSERT หลายแถว
+func (api *APIClient) upsertRows(tableName string, keyColumns []string, columns []string, rows []batchRow, result *SyncResult) int {
+	if len(rows) == 0 {
+		return 0
+	}
+	bulk, ok := api.target.(BulkUpserter)
+	if !ok {
+		return api.executeBatchBisect(upsertQueryFormat(tableName, keyColumns, columns), rows, result)
+	}
+
+	values := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = row.values
+	}
+	if api.tx != nil {
+		api.tx.queueBulk(&BulkRows{Table: tableName, KeyColumns: keyColumns, Columns: columns, Rows: values})
+		return len(rows)
+	}
+
+	resp, err := bulk.BulkUpsert(tableName, keyColumns, columns, values)
+	if err == nil && resp.Success {
+		return len(rows)
+	}
+	if resp == nil {
+		result.markError(batchRowItems(rows), err)
+		return 0
+	}
+	fmt.Printf("   🔍 upsert %s ด้วย COPY %d รายการถูกปฏิเสธ (%s) ส่งเป็น INSERT เพื่อหาแถวที่ผิด\n", tableName, len(rows), resp.Message)
+	return api.executeBatchBisect(upsertQueryFormat(tableName, keyColumns, columns), rows, result)
+}
+
+// deleteStaleKeys ลบแถวบน server ที่มี row_order_ref เดียวกับรายการใหม่แต่ key ไม่ตรงกัน (key ถูกแก้ไขที่ต้นทาง)
+// เรียกก่อน upsert ตาม key ใหม่ เพื่อไม่ให้แถวของ key เก่าค้างอยู่ แถวที่ key ไม่เปลี่ยนจะไม่ถูกแตะ
+// keyIndex และ refIndex คือตำแหน่งของ key และ row_order_ref ใน values ของแต่ละแถว
+func (api *APIClient) deleteStaleKeys(tableName string, keyColumn string, rows []batchRow, keyIndex int, refIndex int) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	var staleKeys []string
+	var params queryParams
+	for _, row := range rows {
+		staleKeys = append(staleKeys, fmt.Sprintf("(%s::INT, %s::VARCHAR)",
+			params.add(row.values[refIndex]), params.add(row.values[keyIndex])))
+	}
+
+	query := fmt.Sprintf(`
+		DELETE FROM %s t
+		USING (VALUES %s) AS v(row_order_ref, key)
+		WHERE t.row_order_ref = v.row_order_ref AND t.%s <> v.key
+	`, tableName, strings.Join(staleKeys, ","), keyColumn)
+
+	resp, err := api.ExecuteCommand(query, params.values...)
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s", resp.Message)
+	}
+	return nil
+}
+
+// naturalKey unique key ของตารางที่ไม่ขึ้นกับ row_order_ref (SML ลบแล้วสร้างแถวเดิมใหม่ row_order_ref จะเปลี่ยน)
+// column ใน nulls อาจเป็น NULL จึงใช้ COALESCE กับค่าแทนใน index เพราะ unique index ถือว่า NULL ไม่ซ้ำกัน
+// previous คือชื่อ index ของ key รุ่นก่อน ซึ่งต้องลบออก ไม่เช่นนั้น index เก่ายังบังคับ key เดิมอยู่
+type naturalKey struct {
+	index    string
+	columns  []string
+	nulls    map[string]string
+	previous []string
+}
+
+// conflictTarget คืน column และ expression ของ key ตามที่ใช้ใน unique index และ ON CONFLICT
+func (k naturalKey) conflictTarget() []string {
+	return k.expressions("")
+}
+
+// expressions คืน expression ของ key โดยนำหน้า column ด้วย prefix (เช่น "t.")
+func (k naturalKey) expressions(prefix string) []string {
+	target := make([]string, len(k.columns))
+	for i, column := range k.columns {
+		if value, ok := k.nulls[column]; ok {
+			target[i] = fmt.Sprintf("(COALESCE(%s%s, %s))", prefix, column, value)
+		} else {
+			target[i] = prefix + column
+		}
+	}
+	return target
+}
+
+// dedupeQuery คำสั่งลบแถวที่ key ซ้ำกันใน tableName โดยเก็บแถวที่ row_order_ref ใหม่สุดไว้ (ถ้าเท่ากันเก็บแถวที่เพิ่มทีหลัง)
+// แถวที่ key มีค่า NULL ไม่ถือว่าซ้ำ ตรงกับที่ unique index ตรวจ
+func (k naturalKey) dedupeQuery(tableName string) string {
+	return fmt.Sprintf(`
+		DELETE FROM %[1]s t
+		USING %[1]s newer
+		WHERE (%[2]s) = (%[3]s)
+		  AND (COALESCE(newer.row_order_ref, 0), newer.ctid) > (COALESCE(t.row_order_ref, 0), t.ctid)
+	`, tableName, strings.Join(k.expressions("t."), ", "), strings.Join(k.expressions("newer."), ", "))
+}
+
+// ensureNaturalKey สร้าง unique index ของ key บน server เพื่อให้ upsert ใช้เป็น target ของ ON CONFLICT ได้
+// โค้ดรุ่นก่อนที่ insert อย่างเดียวอาจทิ้งแถวที่ key ซ้ำกันไว้ ซึ่งทำให้สร้าง index ไม่ได้
+// จึงลบแถวซ้ำออกก่อน (เก็บ row_order_ref ใหม่สุด) เฉพาะตอนที่ยังไม่มี index
+func (api *APIClient) ensureNaturalKey(tableName string, key naturalKey) error {
+	for _, previous := range key.previous {
+		resp, err := api.ExecuteCommand("DROP INDEX IF EXISTS " + previous)
+		if err != nil {
+			return err
+		}
+		if !resp.Success {
+			return fmt.Errorf("failed to drop previous index %s: %s", previous, resp.Message)
+		}
+	}
+
+	exists, err := api.indexExists(key.index)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	resp, err := api.ExecuteCommand(key.dedupeQuery(tableName))
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to remove rows with duplicate %s: %s", strings.Join(key.columns, ", "), resp.Message)
+	}
+	fmt.Printf("🧹 ลบแถวที่ %s ซ้ำกันใน %s ก่อนสร้าง index %s: %s\n", strings.Join(key.columns, ", "), tableName, key.index, resp.Message)
+
+	resp, err = api.ExecuteCommand(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)",
+		key.index, tableName, strings.Join(key.conflictTarget(), ", ")))
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to create index %s: %s", key.index, resp.Message)
+	}
+	return nil
+}
+
+// indexExists ตรวจสอบว่ามี index ชื่อนี้บน server หรือไม่
+func (api *APIClient) indexExists(indexName string) (bool, error) {
+	resp, err := api.ExecuteSelect("SELECT EXISTS(SELECT 1 FROM pg_indexes WHERE indexname = $1) AS exists", indexName)
+	if err != nil {
+		return false, err
+	}
+	if !resp.Success {
+		return false, fmt.Errorf("failed to check if index %s exists: %s", indexName, resp.Message)
+	}
+
+	if data, ok := resp.Data.([]interface{}); ok && len(data) > 0 {
+		if row, ok := data[0].(map[string]interface{}); ok {
+			if exists, ok := row["exists"].(bool); ok {
+				return exists, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("unexpected response format when checking if index %s exists", indexName)
+}
+
+// latestByKey เก็บเฉพาะแถวล่าสุดของแต่ละ key และคืนรายการต้นทางของแถวที่เหลือ (สำหรับ runBatches)
+// key ซ้ำในคำสั่ง INSERT ... ON CONFLICT เดียวกันจะทำให้ทั้งคำสั่งล้มเหลว ส่วน batch ที่ส่งพร้อมกันก็จะชนกันเอง
+func latestByKey(rows []batchRow, columns []string, key naturalKey) ([]batchRow, []interface{}) {
+	position := make(map[string]int, len(columns))
+	for i, column := range columns {
+		position[column] = i
+	}
+
+	latest := make(map[string]int)
+	var unique []batchRow
+	for _, row := range rows {
+		keyValues := make([]interface{}, len(key.columns))
+		for i, column := range key.columns {
+			keyValues[i] = row.values[position[column]]
+		}
+		id := fmt.Sprintf("%#v", keyValues)
+		if idx, exists := latest[id]; exists {
+			unique[idx] = row
+			continue
+		}
+		latest[id] = len(unique)
+		unique = append(unique, row)
+	}
+	return unique, batchRowItems(unique)
+}
+
+// deleteStaleNaturalKeys ลบแถวบน server ที่มี row_order_ref เดียวกับรายการใหม่แต่ key ไม่ตรงกัน (key ถูกแก้ไขที่ต้นทาง)
+// ทำแบบเดียวกับ deleteStaleKeys สำหรับ key หลาย column ค่าของแต่ละแถวส่งเป็น JSON parameter เดียว
+// แล้วแปลงตามชนิด column ของตารางด้วย json_populate_recordset
+func (api *APIClient) deleteStaleNaturalKeys(tableName string, key naturalKey, columns []string, rows []batchRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	payload, err := rowsJSON(columns, rows)
+	if err != nil {
+		return err
+	}
+
+	current := make([]string, len(key.columns))
+	incoming := make([]string, len(key.columns))
+	for i, column := range key.columns {
+		current[i] = "t." + column
+		incoming[i] = "v." + column
+	}
+	query := fmt.Sprintf(`
+		DELETE FROM %s t
+		USING json_populate_recordset(NULL::%s, $1::json) v
+		WHERE t.row_order_ref = v.row_order_ref AND (%s) IS DISTINCT FROM (%s)
+	`, tableName, tableName, strings.Join(current, ", "), strings.Join(incoming, ", "))
+
+	resp, err := api.ExecuteCommand(query, payload)
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s", resp.Message)
+	}
+	return nil
+}
+
+// deleteNaturalKeys ลบแถวบน server ที่ key ตรงกับแถวที่ถูกลบที่ต้นทาง (ค่า key มาจาก snapshot ของแถวก่อนลบ)
+// เทียบด้วย expression เดียวกับ unique index จึงลบแถวที่ upsert ไว้ได้แม้ row_order_ref บน server จะเป็นของแถวอื่น
+// คืนค่าจำนวนแถวที่ส่งลบสำเร็จ ส่วน batch ที่ล้มเหลวถูกบันทึกลง result
+func (api *APIClient) deleteNaturalKeys(tableName string, key naturalKey, columns []string, rows []batchRow, result *SyncResult) int {
+	if len(rows) == 0 {
+		return 0
+	}
+
+	query := fmt.Sprintf(`
+		DELETE FROM %s t
+		USING json_populate_recordset(NULL::%s, $1::json) v
+		WHERE (%s) = (%s)
+	`, tableName, tableName, strings.Join(key.expressions("t."), ", "), strings.Join(key.expressions("v."), ", "))
+
+	return api.runBatches(tableName, batchRowItems(rows), api.deleteBatchSize(1000), result, func(b, start, end int, batchResult *SyncResult) int {
+		batch := rows[start:end]
+		payload, err := rowsJSON(columns, batch)
+		if err != nil {
+			batchResult.markFailed(batchRowItems(batch), err.Error())
+			return 0
+		}
+
+		resp, err := api.ExecuteCommand(query, payload)
+		if err != nil {
+			fmt.Printf("❌ ERROR: ไม่สามารถลบข้อมูลจาก %s ตาม %s (batch %d) ได้: %v\n", tableName, strings.Join(key.columns, ", "), b+1, err)
+			batchResult.markError(batchRowItems(batch), err)
+			return 0
+		}
+		if !resp.Success {
+			fmt.Printf("❌ ERROR: ลบข้อมูลจาก %s ตาม %s (batch %d) ล้มเหลว: %s\n", tableName, strings.Join(key.columns, ", "), b+1, resp.Message)
+			batchResult.markFailed(batchRowItems(batch), resp.Message)
+			return 0
+		}
+		return len(batch)
+	})
+}
+
+// rowsJSON แปลง rows เป็น JSON array ของ object ตามชื่อ columns สำหรับ json_populate_recordset
+func rowsJSON(columns []string, rows []batchRow) (string, error) {
+	records := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		record := make(map[string]interface{}, len(columns))
+		for c, column := range columns {
+			record[column] = row.values[c]
+		}
+		records[i] = record
+	}
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// indexTarget ปลายทางที่ตอบว่ามี index หรือไม่ตาม exists และเก็บคำสั่งที่ได้รับ
+type indexTarget struct {
+	exists   bool
+	commands []string
+}
+
+func (t *indexTarget) Select(query string, params []interface{}) (*QueryResponse, error) {
+	return &QueryResponse{Success: true, Data: []interface{}{map[string]interface{}{"exists": t.exists}}}, nil
+}
+
+func (t *indexTarget) Command(query string, params []interface{}) (*QueryResponse, error) {
+	t.commands = append(t.commands, strings.Join(strings.Fields(query), " "))
+	return &QueryResponse{Success: true}, nil
+}
+
+func (t *indexTarget) Tx(statements []TxStatement) (*QueryResponse, error) {
+	return &QueryResponse{Success: true}, nil
+}
+
+func TestEnsureNaturalKey(t *testing.T) {
+	key := naturalKey{
+		index:    "t_key_v2",
+		columns:  []string{"a", "d"},
+		nulls:    map[string]string{"d": "'-infinity'::DATE"},
+		previous: []string{"t_key"},
+	}
+
+	tests := []struct {
+		name   string
+		exists bool
+		want   []string
+	}{
+		{
+			name:   "index already exists",
+			exists: true,
+			want:   []string{"DROP INDEX IF EXISTS t_key"},
+		},
+		{
+			name:   "duplicates are removed before the index is created",
+			exists: false,
+			want: []string{
+				"DROP INDEX IF EXISTS t_key",
+				"DELETE FROM t t USING t newer " +
+					"WHERE (t.a, (COALESCE(t.d, '-infinity'::DATE))) = (newer.a, (COALESCE(newer.d, '-infinity'::DATE))) " +
+					"AND (COALESCE(newer.row_order_ref, 0), newer.ctid) > (COALESCE(t.row_order_ref, 0), t.ctid)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS t_key_v2 ON t (a, (COALESCE(d, '-infinity'::DATE)))",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &indexTarget{exists: tt.exists}
+			api := NewAPIClientWithTarget(target, nil)
+			if err := api.ensureNaturalKey("t", key); err != nil {
+				t.Fatalf("ensureNaturalKey() error = %v", err)
+			}
+			if !reflect.DeepEqual(target.commands, tt.want) {
+				t.Errorf("commands =\n%s\nwant\n%s", strings.Join(target.commands, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// WarehouseConfig การเลือกคลังที่ส่งยอดคงเหลือและการจับคู่กับ location ของ marketplace (section "warehouses" ใน smlmarketsync.json)
+// ถ้าไม่มี location เลย จะส่งทุก wh_code ตามเดิม
+type WarehouseConfig struct {
+	Locations []WarehouseLocation `json:"locations"`
+}
+
+// WarehouseLocation location หนึ่งบน marketplace ที่รวมยอดจากคลัง SML หนึ่งคลังหรือมากกว่า
+type WarehouseLocation struct {
+	Code         string   `json:"code"`                    // รหัส location ที่ส่งเป็น wh_code ของ ic_balance
+	WhCodes      []string `json:"wh_codes"`                // คลัง SML ที่รวมยอดเข้า location นี้
+	SplitPercent *float64 `json:"split_percent,omitempty"` // สัดส่วนของ balance_qty และ available_qty ที่จัดสรรให้ location นี้ (ไม่ระบุ = 100)
+}
+
+// NewWarehouseConfig อ่านการตั้งค่า warehouses จาก smlmarketsync.json (ถ้าไม่มี section นี้จะส่งทุกคลัง)
+// การตั้งค่าที่ไม่ถูกต้องจะทำให้โปรแกรมหยุด เพราะยอดที่จับคู่ผิดจะถูกส่งขึ้น server
+func NewWarehouseConfig() *WarehouseConfig {
+	config, err := loadConfig()
+	if err != nil {
+		log.Printf("⚠️ Warning: %v (ส่งยอดคงเหลือทุกคลัง)", err)
+		return &WarehouseConfig{}
+	}
+	if config.Warehouses == nil {
+		return &WarehouseConfig{}
+	}
+	if err := config.Warehouses.Validate(); err != nil {
+		log.Fatalf("❌ Error: warehouses ใน %s ไม่ถูกต้อง: %v\nโปรแกรมจบการทำงาน", configPath, err)
+	}
+	return config.Warehouses
+}
+
+// Enabled ตรวจว่ามีการจับคู่คลังหรือไม่ (false = ส่งทุก wh_code ตามเดิม)
+func (w *WarehouseConfig) Enabled() bool {
+	return len(w.Locations) > 0
+}
+
+// Validate ตรวจรหัส location และสัดส่วนการแบ่ง (ผลรวมสัดส่วนของคลังเดียวกันต้องไม่เกิน 100 เพื่อไม่ให้ขายเกินยอดจริง)
+func (w *WarehouseConfig) Validate() error {
+	seen := make(map[string]bool)
+	allocated := make(map[string]float64)
+	for i, location := range w.Locations {
+		if location.Code == "" {
+			return fmt.Errorf("locations[%d]: ต้องระบุ code", i)
+		}
+		if seen[location.Code] {
+			return fmt.Errorf("locations[%d]: code %s ซ้ำ", i, location.Code)
+		}
+		seen[location.Code] = true
+
+		if len(location.WhCodes) == 0 {
+			return fmt.Errorf("locations[%d] (%s): ต้องระบุ wh_codes อย่างน้อยหนึ่งคลัง", i, location.Code)
+		}
+		percent := location.splitPercent()
+		if percent <= 0 || percent > 100 {
+			return fmt.Errorf("locations[%d] (%s): split_percent ต้องอยู่ระหว่าง 0 ถึง 100", i, location.Code)
+		}
+
+		inLocation := make(map[string]bool)
+		for _, whCode := range location.WhCodes {
+			if whCode == "" || inLocation[whCode] {
+				return fmt.Errorf("locations[%d] (%s): wh_codes ว่างหรือซ้ำ", i, location.Code)
+			}
+			inLocation[whCode] = true
+			allocated[whCode] += percent
+		}
+	}
+	for whCode, percent := range allocated {
+		if percent > 100 {
+			return fmt.Errorf("คลัง %s ถูกแบ่งให้ location รวมกัน %.2f%% (เกิน 100%%)", whCode, percent)
+		}
+	}
+	return nil
+}
+
+// MappingValues คืน VALUES (wh_code, location, split_percent) ของทุกคู่คลัง/location สำหรับ join ใน SQL
+func (w *WarehouseConfig) MappingValues() string {
+	var rows []string
+	for _, location := range w.Locations {
+		percent := strconv.FormatFloat(location.splitPercent(), 'f', -1, 64)
+		for _, whCode := range location.WhCodes {
+			rows = append(rows, fmt.Sprintf("(%s, %s, %s::NUMERIC)", quoteLiteral(whCode), quoteLiteral(location.Code), percent))
+		}
+	}
+	return "VALUES " + strings.Join(rows, ", ")
+}
+
+// WhCodeFilter คืนเงื่อนไขที่เลือกเฉพาะคลังที่ถูกจับคู่กับ location
+func (w *WarehouseConfig) WhCodeFilter(whCodeColumn string) string {
+	var whCodes []string
+	seen := make(map[string]bool)
+	for _, location := range w.Locations {
+		for _, whCode := range location.WhCodes {
+			if !seen[whCode] {
+				seen[whCode] = true
+				whCodes = append(whCodes, quoteLiteral(whCode))
+			}
+		}
+	}
+	return fmt.Sprintf("%s IN (%s)", whCodeColumn, strings.Join(whCodes, ", "))
+}
+
+// LocationPairs แปลงคู่สินค้า/คลัง SML เป็นคู่สินค้า/location ที่ได้รับผลกระทบ (คลังที่ไม่ถูกจับคู่จะถูกข้าม)
+func (w *WarehouseConfig) LocationPairs(pairs []BalancePair) []BalancePair {
+	locations := make(map[string][]string)
+	for _, location := range w.Locations {
+		for _, whCode := range location.WhCodes {
+			locations[whCode] = append(locations[whCode], location.Code)
+		}
+	}
+
+	var result []BalancePair
+	seen := make(map[BalancePair]bool)
+	for _, pair := range pairs {
+		for _, code := range locations[pair.WhCode] {
+			locationPair := BalancePair{IcCode: pair.IcCode, WhCode: code}
+			if !seen[locationPair] {
+				seen[locationPair] = true
+				result = append(result, locationPair)
+			}
+		}
+	}
+	return result
+}
+
+// splitPercent สัดส่วนของ location (ไม่ระบุ = 100)
+func (l WarehouseLocation) splitPercent() float64 {
+	if l.SplitPercent == nil {
+		return 100
+	}
+	return *l.SplitPercent
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"database/sql"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"smlmarketsync/config"
 	"smlmarketsync/steps"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 func main() {
@@ -29,6 +36,21 @@ func main() {
 	} else {
 		fmt.Println("✅ ตาราง sml_market_sync มีอยู่แล้ว")
 	}
+	// เพิ่ม column สำหรับการจองแถว (claim/ack) ถ้ายังไม่มี
+	err = config.EnsureSyncTableColumns(db)
+	if err != nil {
+		log.Fatalf("Failed to upgrade sml_market_sync table: %v", err)
+	}
+	// ตาราง sml_market_sync_failed สำหรับรายการที่ API ปฏิเสธ (รอส่งใหม่ตาม backoff)
+	err = config.CreateSyncFailedTable(db)
+	if err != nil {
+		log.Fatalf("Failed to create sml_market_sync_failed table: %v", err)
+	}
+	// ตาราง sml_market_balance_sync สำหรับคู่สินค้า/คลังที่ยอดคงเหลือเปลี่ยน (จาก trigger ของ ic_trans_detail)
+	err = config.CreateBalanceSyncTable(db)
+	if err != nil {
+		log.Fatalf("Failed to create sml_market_balance_sync table: %v", err)
+	}
 	// ตรวจสอบ บน database ว่ามี ใน table ic_inventory_price มี tigger หรือไม่
 	if !config.PriceTriggerExists(db) {
 		// สร้าง trigger สำหรับ ic_inventory_price ถ้ายังไม่มี
@@ -87,55 +109,75 @@ func main() {
 		fmt.Println("✅ Trigger สำหรับ ar_customer มีอยู่แล้ว")
 	}
 
+	// ตรวจสอบ บน database ว่ามี ใน table ic_trans_detail มี tigger หรือไม่ (ใช้ sync balance เฉพาะที่เปลี่ยน)
+	// trigger ทำงานเมื่อแก้ column ที่ใช้คำนวณยอดคงเหลือและยอดจองเท่านั้น (สร้างใหม่ถ้าไม่ตรงกับ availability ปัจจุบัน)
+	availability := config.NewAvailabilityConfig()
+	availability.CheckSchema(db)
+	if !config.BalanceTriggerExists(db, availability) {
+		// สร้าง trigger สำหรับ ic_trans_detail และ ic_trans ถ้ายังไม่มี
+		err = config.CreateBalanceTrigger(db, availability)
+		if err != nil {
+			log.Fatalf("Failed to create trigger for ic_trans_detail: %v", err)
+		}
+		fmt.Println("✅ Trigger สำหรับ ic_trans_detail ถูกสร้างเรียบร้อยแล้ว")
+	} else {
+		fmt.Println("✅ Trigger สำหรับ ic_trans_detail มีอยู่แล้ว")
+	}
+
+	// คำสั่งเพิ่มเติม:
+	//   smlmarketsync backfill [--chunk=5000] [--pause=200ms] [--reset] [ตาราง...]
+	//   smlmarketsync failed list [--table=ชื่อตาราง]
+	//   smlmarketsync failed retry|discard [--all] [id...]
+	//   smlmarketsync balance [--full]
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			err = runBackfill(db, os.Args[2:])
+		case "balance":
+			err = runBalance(db, os.Args[2:])
+		case "failed":
+			err = runFailed(db, os.Args[2:])
+		default:
+			err = fmt.Errorf("ไม่รู้จักคำสั่ง %s", os.Args[1])
+		}
+		if err != nil {
+			log.Fatalf("❌ Error in %s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Sync Data Start
 	fmt.Println("🔄 เริ่มขั้นตอนการซิงค์ข้อมูล...")
+	// client เดียวตาม section "api" ใช้ร่วมกันทุก step
+	apiClient := config.NewAPIClient()
 	// Sync สินค้า (Product/Inventory)
 	fmt.Println("\n🔄 เริ่มขั้นตอนการ sync สินค้า")
-	productStep := steps.NewProductSyncStep(db)
+	productStep := steps.NewProductSyncStep(db, apiClient)
 	err = productStep.ExecuteProductSync()
 	if err != nil {
 		log.Fatalf("❌ Error in product sync steps: %v", err)
 	}
 	fmt.Println("✅ ขั้นตอนการ sync สินค้า เสร็จสิ้น")
-	// Sync Price
-	fmt.Println("\n🔄 เริ่มขั้นตอนการ sync ราคาสินค้า")
-	priceStep := steps.NewPriceSyncStep(db)
-	err = priceStep.ExecutePriceSync()
-	if err != nil {
-		log.Fatalf("❌ Error in price sync step: %v", err)
-	}
-	fmt.Println("✅ ขั้นตอนการ sync ราคาสินค้า เสร็จสิ้น")
 
-	// Sync Price Formula
-	fmt.Println("\n🔄 เริ่มขั้นตอนการ sync สูตรราคาสินค้า")
-	priceFormulaStep := steps.NewPriceFormulaSyncStep(db)
-	err = priceFormulaStep.ExecutePriceFormulaSync()
+	// ราคา สูตรราคา ProductBarcode และลูกค้า เขียนคนละตารางบน server และใช้คิวคนละ table_id จึงส่งพร้อมกันได้
+	// ภายในแต่ละ step ยังส่ง transaction ทีละชุดตามลำดับ ราคา สูตรราคา และ ProductBarcode อ้างอิง ic_code จึงเริ่มหลังสินค้าเสร็จ
+	priceStep := steps.NewPriceSyncStep(db, apiClient)
+	priceFormulaStep := steps.NewPriceFormulaSyncStep(db, apiClient)
+	productBarcodeStep := steps.NewProductBarcodeSyncStep(db, apiClient)
+	customerStep := steps.NewCustomerSyncStep(db, apiClient)
+	err = runSteps([]syncStep{
+		{"ราคาสินค้า", priceStep.ExecutePriceSync},
+		{"สูตรราคาสินค้า", priceFormulaStep.ExecutePriceFormulaSync},
+		{"ProductBarcode", productBarcodeStep.ExecuteProductBarcodeSync},
+		{"ลูกค้า", customerStep.ExecuteCustomerSync},
+	})
 	if err != nil {
-		log.Fatalf("❌ Error in price formula sync step: %v", err)
+		log.Fatalf("❌ Error in sync steps: %v", err)
 	}
-	fmt.Println("✅ ขั้นตอนการ sync สูตรราคาสินค้า เสร็จสิ้น")
-
-	// Sync ProductBarcode
-	fmt.Println("\n🔄 เริ่มขั้นตอนการ sync ProductBarcode")
-	productBarcodeStep := steps.NewProductBarcodeSyncStep(db)
-	err = productBarcodeStep.ExecuteProductBarcodeSync()
-	if err != nil {
-		log.Fatalf("❌ Error in ProductBarcode sync steps: %v", err)
-	}
-	fmt.Println("✅ ขั้นตอนการ sync ProductBarcode เสร็จสิ้น")
-
-	// Sync Customer
-	fmt.Println("\n🔄 เริ่มขั้นตอนการ sync ลูกค้า")
-	customerStep := steps.NewCustomerSyncStep(db)
-	err = customerStep.ExecuteCustomerSync()
-	if err != nil {
-		log.Fatalf("❌ Error in customer sync step: %v", err)
-	}
-	fmt.Println("✅ ขั้นตอนการ sync ลูกค้า เสร็จสิ้น")
 
 	// Sync Balance
 	fmt.Println("\n🔄 เริ่มขั้นตอนการ sync balance")
-	balanceStep := steps.NewBalanceSyncStep(db)
+	balanceStep := steps.NewBalanceSyncStep(db, apiClient)
 	err = balanceStep.ExecuteBalanceSync()
 	if err != nil {
 		log.Fatalf("❌ Error in balance sync step: %v", err)
@@ -145,3 +187,195 @@ func main() {
 	fmt.Println("\n🎉 การซิงค์ข้อมูลเสร็จสิ้นทุกขั้นตอน!")
 	fmt.Println("ข้อมูลถูกซิงค์ครบทุกตาราง: ic_inventory_barcode, ic_balance, ar_customer, ic_inventory_price, และ ic_inventory_price_formula")
 }
+
+// runBackfill เพิ่มข้อมูลที่มีอยู่เดิมของตารางที่ติดตามเข้า sml_market_sync เพื่อให้ถูกส่งไป API ในรอบ sync ถัดไป
+func runBackfill(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	chunkSize := flags.Int("chunk", 5000, "จำนวน roworder ต่อ 1 transaction")
+	pause := flags.Duration("pause", 200*time.Millisecond, "หน่วงเวลาระหว่าง chunk")
+	reset := flags.Bool("reset", false, "เริ่ม backfill ใหม่ตั้งแต่ต้น")
+	flags.Parse(args)
+
+	tables := config.SyncTables
+	if flags.NArg() > 0 {
+		tables = nil
+		for _, name := range flags.Args() {
+			table, ok := config.FindSyncTable(name)
+			if !ok {
+				return fmt.Errorf("ไม่รู้จักตาราง %s", name)
+			}
+			tables = append(tables, table)
+		}
+	}
+
+	fmt.Println("=== Backfill ข้อมูลเดิมเข้า sml_market_sync ===")
+	err := config.CreateBackfillTable(db)
+	if err != nil {
+		return err
+	}
+
+	options := config.BackfillOptions{ChunkSize: *chunkSize, Pause: *pause, Reset: *reset}
+	total := 0
+	for _, table := range tables {
+		fmt.Printf("\n🔄 เริ่ม backfill ตาราง %s (table_id=%d)\n", table.TableName, table.TableID)
+		added, err := config.BackfillSyncTable(db, table, options)
+		total += added
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("\n🎉 Backfill เสร็จสิ้น เพิ่มเข้า sml_market_sync ทั้งหมด %d รายการ\n", total)
+	fmt.Println("ข้อมูลจะถูกส่งไปยัง API เมื่อรันโปรแกรมแบบปกติ")
+	return nil
+}
+
+// runBalance sync เฉพาะ balance โดย --full จะเทียบ ic_balance ทั้งตารางโดยไม่รอรอบ
+func runBalance(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("balance", flag.ExitOnError)
+	full := flags.Bool("full", false, "เทียบ ic_balance ทั้งตาราง (full reconcile)")
+	flags.Parse(args)
+
+	balanceStep := steps.NewBalanceSyncStep(db, config.NewAPIClient())
+	balanceStep.FullReconcile = *full
+	return balanceStep.ExecuteBalanceSync()
+}
+
+// runFailed จัดการรายการใน sml_market_sync_failed: list, retry, discard
+func runFailed(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("ต้องระบุคำสั่งย่อย: list, retry หรือ discard")
+	}
+
+	flags := flag.NewFlagSet("failed "+args[0], flag.ExitOnError)
+	tableName := flags.String("table", "", "แสดงเฉพาะตารางที่ระบุ")
+	all := flags.Bool("all", false, "ทำกับทุกรายการ")
+	positional := parseInterspersed(flags, args[1:])
+
+	switch args[0] {
+	case "list":
+		tableID := 0
+		if *tableName != "" {
+			table, ok := config.FindSyncTable(*tableName)
+			if !ok {
+				return fmt.Errorf("ไม่รู้จักตาราง %s", *tableName)
+			}
+			tableID = table.TableID
+		}
+
+		failures, err := config.ListSyncFailures(db, tableID)
+		if err != nil {
+			return err
+		}
+		if len(failures) == 0 {
+			fmt.Println("✅ ไม่มีรายการที่ส่งไม่สำเร็จ")
+			return nil
+		}
+
+		fmt.Printf("%-6s %-8s %-10s %-6s %-8s %-19s %s\n", "id", "table_id", "row_order", "active", "attempts", "next_retry", "error")
+		for _, f := range failures {
+			nextRetry := "(ต้องสั่ง retry)"
+			if f.RequeuedAt.Valid {
+				nextRetry = "(กำลังส่งใหม่)"
+			} else if f.NextRetryAt.Valid {
+				nextRetry = f.NextRetryAt.Time.Format("2006-01-02 15:04:05")
+			}
+			// ตัดตามตัวอักษร ข้อความภาษาไทยจึงไม่ถูกตัดกลางตัวอักษร
+			message := f.ErrorMessage
+			if runes := []rune(message); len(runes) > 80 {
+				message = string(runes[:80]) + "..."
+			}
+			fmt.Printf("%-6d %-8d %-10d %-6d %-8d %-19s %s\n",
+				f.ID, f.TableID, f.RowOrderRef, f.ActiveCode, f.Attempts, nextRetry, message)
+		}
+		fmt.Printf("รวม %d รายการ\n", len(failures))
+		return nil
+
+	case "retry", "discard":
+		var ids []int
+		for _, arg := range positional {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("id ไม่ถูกต้อง: %s", arg)
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 && !*all {
+			return fmt.Errorf("ต้องระบุ id หรือ --all")
+		}
+		if len(ids) > 0 && *all {
+			return fmt.Errorf("ระบุ id และ --all พร้อมกันไม่ได้ (ใช้อย่างใดอย่างหนึ่ง)")
+		}
+
+		if args[0] == "retry" {
+			count, err := config.RetrySyncFailures(db, ids)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("🔁 ตั้งให้ส่งใหม่ในรอบ sync ถัดไป: %d รายการ\n", count)
+		} else {
+			count, err := config.DiscardSyncFailures(db, ids)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("🗑️ ลบรายการทิ้งโดยไม่ส่งใหม่: %d รายการ\n", count)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("ไม่รู้จักคำสั่งย่อย %s (ใช้ list, retry หรือ discard)", args[0])
+	}
+}
+
+// parseInterspersed อ่าน flag ที่อยู่ก่อนหรือหลัง argument อื่นได้ (flag.Parse หยุดที่ argument แรกที่ไม่ใช่ flag)
+// เช่น "failed retry 3 --all" และคืน argument ที่ไม่ใช่ flag ตามลำดับเดิม
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// syncStep ขั้นตอนการ sync ที่ runSteps ส่งพร้อมกับขั้นตอนอื่น
+type syncStep struct {
+	name    string
+	execute func() error
+}
+
+// runSteps รันทุก step พร้อมกันแล้วรอให้เสร็จทั้งหมด คืน error ของทุก step ที่ล้มเหลว
+// step ที่ล้มเหลวไม่หยุด step อื่น เพราะแต่ละ step ack/release คิวของตัวเอง
+func runSteps(syncSteps []syncStep) error {
+	errs := make([]error, len(syncSteps))
+	var wg sync.WaitGroup
+	for i, step := range syncSteps {
+		wg.Add(1)
+		go func(i int, step syncStep) {
+			defer wg.Done()
+			fmt.Printf("\n🔄 เริ่มขั้นตอนการ sync %s\n", step.name)
+			if err := step.execute(); err != nil {
+				errs[i] = fmt.Errorf("%s: %v", step.name, err)
+				fmt.Printf("❌ ขั้นตอนการ sync %s ล้มเหลว: %v\n", step.name, err)
+				return
+			}
+			fmt.Printf("✅ ขั้นตอนการ sync %s เสร็จสิ้น\n", step.name)
+		}(i, step)
+	}
+	wg.Wait()
+
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("%s", strings.Join(messages, "; "))
+	}
+	return nil
+}
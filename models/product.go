@@ -53,10 +53,10 @@ type ProductRepository struct {
 	apiClient *config.APIClient
 }
 
-func NewProductRepository(db *sql.DB) *ProductRepository {
+func NewProductRepository(db *sql.DB, apiClient *config.APIClient) *ProductRepository {
 	return &ProductRepository{
 		db:        db,
-		apiClient: config.NewAPIClient(),
+		apiClient: apiClient,
 	}
 }
 
@@ -240,21 +240,14 @@ func (r *ProductRepository) uploadBatchViaAPI(items []InventoryItem) error {
 		return nil
 	}
 
-	// สร้าง bulk insert query แบบ VALUES literal
+	// สร้าง bulk insert query แบบ VALUES ($1, $2, ...) ส่งค่าเป็น parameter
 	var valueStrings []string
+	var params []interface{}
 	for _, item := range items {
-		// Escape single quotes ใน string values
-		icCode := strings.ReplaceAll(item.IcCode, "'", "''")
-		barcode := strings.ReplaceAll(item.Barcode, "'", "''")
-		name := strings.ReplaceAll(item.Name, "'", "''")
-		unitCode := strings.ReplaceAll(item.UnitCode, "'", "''")
-		unitName := strings.ReplaceAll(item.UnitName, "'", "''")
-
-		valueString := fmt.Sprintf(
-			"('%s', '%s', '%s', '%s', '%s')",
-			icCode, barcode, name, unitCode, unitName,
-		)
+		n := len(params)
+		valueString := fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5)
 		valueStrings = append(valueStrings, valueString)
+		params = append(params, item.IcCode, item.Barcode, item.Name, item.UnitCode, item.UnitName)
 	}
 	query := fmt.Sprintf(`
 		INSERT INTO ic_inventory_barcode 
@@ -264,7 +257,7 @@ func (r *ProductRepository) uploadBatchViaAPI(items []InventoryItem) error {
 		strings.Join(valueStrings, ","))
 
 	// ใช้ API client แทน direct database connection
-	resp, err := r.apiClient.ExecuteCommand(query)
+	resp, err := r.apiClient.ExecuteCommand(query, params...)
 	if err != nil {
 		return fmt.Errorf("API command error: %v", err)
 	}
@@ -280,19 +273,14 @@ func (r *ProductRepository) uploadBatchViaAPI(items []InventoryItem) error {
 func (r *ProductRepository) GetBalanceDataFromLocal() ([]interface{}, error) {
 	fmt.Println("กำลังดึงข้อมูล balance จากฐานข้อมูล local...")
 
-	query := `
+	query := fmt.Sprintf(`
 		SELECT 
 			itd.item_code AS ic_code,
 			itd.wh_code AS warehouse,
 			ii.unit_standard AS ic_unit_code,
 			COALESCE(SUM(itd.calc_flag * (
-				CASE WHEN ((itd.trans_flag IN (70,54,60,58,310,12) OR (itd.trans_flag=66 AND itd.qty>0) OR (itd.trans_flag=14 AND itd.inquiry_type=0) OR (itd.trans_flag=48 AND itd.inquiry_type < 2)) 
-						  OR (itd.trans_flag IN (56,68,72,44) OR (itd.trans_flag=66 AND itd.qty<0) OR (itd.trans_flag=46 AND itd.inquiry_type IN (0,2))  
-							  OR (itd.trans_flag=16 AND itd.inquiry_type IN (0,2)) OR (itd.trans_flag=311 AND itd.inquiry_type=0)) 
-						  AND NOT (itd.doc_ref <> '' AND itd.is_pos = 1))
-					 THEN ROUND((itd.qty*itd.stand_value) / itd.divide_value, 2) 
-					 ELSE 0 
-				END)), 0) AS balance_qty
+				%[1]s
+				)), 0) AS balance_qty
 		FROM ic_trans_detail itd
 		INNER JOIN ic_inventory ii ON ii.code = itd.item_code AND ii.item_type NOT IN (1,3)
 		WHERE itd.last_status = 0 
@@ -300,14 +288,9 @@ func (r *ProductRepository) GetBalanceDataFromLocal() ([]interface{}, error) {
 		  AND itd.is_doc_copy = 0
 		GROUP BY itd.item_code, itd.wh_code, ii.unit_standard
 		HAVING COALESCE(SUM(itd.calc_flag * (
-			CASE WHEN ((itd.trans_flag IN (70,54,60,58,310,12) OR (itd.trans_flag=66 AND itd.qty>0) OR (itd.trans_flag=14 AND itd.inquiry_type=0) OR (itd.trans_flag=48 AND itd.inquiry_type < 2)) 
-					  OR (itd.trans_flag IN (56,68,72,44) OR (itd.trans_flag=66 AND itd.qty<0) OR (itd.trans_flag=46 AND itd.inquiry_type IN (0,2))  
-						  OR (itd.trans_flag=16 AND itd.inquiry_type IN (0,2)) OR (itd.trans_flag=311 AND itd.inquiry_type=0)) 
-					  AND NOT (itd.doc_ref <> '' AND itd.is_pos = 1))
-				 THEN ROUND((itd.qty*itd.stand_value) / itd.divide_value, 2) 
-				 ELSE 0 
-			END)), 0) <> 0
-		ORDER BY itd.item_code, itd.wh_code`
+			%[1]s
+			)), 0) <> 0
+		ORDER BY itd.item_code, itd.wh_code`, config.NewStockRules().QuantityExpr("itd"))
 
 	rows, err := r.db.Query(query)
 	if err != nil {
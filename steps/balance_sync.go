@@ -2,25 +2,61 @@ package steps
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"smlmarketsync/config"
 	"smlmarketsync/types"
 	"strconv"
+	"time"
 )
 
 type BalanceSyncStep struct {
 	db        *sql.DB
 	apiClient *config.APIClient
+	runID     string
+	batchSize int
+
+	// checksumBuckets จำนวนกลุ่มที่ใช้เทียบ checksum ตอน full reconcile
+	checksumBuckets int
+	// stockRules กฎที่กำหนดว่าการเคลื่อนไหวใดนับเป็นยอดคงเหลือ
+	stockRules *config.StockRules
+	// availability ยอดจองและ safety stock ที่หักออกจากยอดคงเหลือเป็นยอดพร้อมขาย
+	availability *config.AvailabilityConfig
+	// warehouses คลังที่ส่งยอดและ location ของ marketplace ที่จับคู่ไว้
+	warehouses *config.WarehouseConfig
+	// sellableUnits ส่งยอดของทุกหน่วยที่มีบาร์โค้ด และ floorPartialUnits ปัดแพ็คที่ไม่ครบทิ้ง
+	sellableUnits     bool
+	floorPartialUnits bool
+
+	// reconcileInterval ระยะเวลาระหว่างการเทียบ ic_balance ทั้งตาราง (balance.reconcile_interval_hours)
+	reconcileInterval time.Duration
+
+	// FullReconcile บังคับให้เทียบ ic_balance ทั้งตาราง แม้ยังไม่ถึงรอบ reconcileInterval
+	FullReconcile bool
 }
 
-func NewBalanceSyncStep(db *sql.DB) *BalanceSyncStep {
+func NewBalanceSyncStep(db *sql.DB, apiClient *config.APIClient) *BalanceSyncStep {
+	balanceConfig := config.NewBalanceConfig()
+	// ปิดการตัดยอดตาม open_orders ถ้า ic_trans_detail ไม่มี column อ้างอิงที่ตั้งค่าไว้
+	availability := config.NewAvailabilityConfig()
+	availability.CheckSchema(db)
 	return &BalanceSyncStep{
-		db:        db,
-		apiClient: config.NewAPIClient(),
+		db:                db,
+		apiClient:         apiClient,
+		runID:             config.RunID(),
+		batchSize:         balanceConfig.BatchSize,
+		checksumBuckets:   balanceConfig.ChecksumBuckets,
+		stockRules:        config.NewStockRules(),
+		availability:      availability,
+		warehouses:        config.NewWarehouseConfig(),
+		sellableUnits:     balanceConfig.SellableUnits,
+		floorPartialUnits: balanceConfig.FloorPartialUnits,
+		reconcileInterval: balanceConfig.ReconcileInterval(),
 	}
 }
 
 // ExecuteBalanceSync รันขั้นตอนที่ 5: การ sync balance
+// ปกติจะส่งเฉพาะคู่สินค้า/คลังที่ trigger ของ ic_trans_detail บันทึกไว้ และเทียบทั้งตารางทุก balance.reconcile_interval_hours
 func (s *BalanceSyncStep) ExecuteBalanceSync() error {
 	fmt.Println("=== ซิงค์ข้อมูล balance กับ API ===")
 
@@ -32,32 +68,138 @@ func (s *BalanceSyncStep) ExecuteBalanceSync() error {
 	}
 	fmt.Println("✅ ตรวจสอบ/สร้างตาราง ic_balance เรียบร้อยแล้ว")
 
-	// 2. ดึงข้อมูล balance จาก local database
-	fmt.Println("กำลังดึงข้อมูล balance จากฐานข้อมูล local...")
-	localData, err := s.GetAllBalanceFromSource()
+	full := s.FullReconcile
+	if !full {
+		full, err = config.BalanceReconcileDue(s.db, s.reconcileInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	// จองคิวก่อนเสมอ ถ้าเทียบทั้งตารางสำเร็จ คู่ในคิวก็ถูกส่งไปด้วยแล้ว
+	pairs, err := config.ClaimBalancePairs(s.db, s.runID)
+	if err != nil {
+		return err
+	}
+
+	if full {
+		fmt.Println("🔁 เทียบข้อมูล balance ทั้งตาราง (full reconcile)")
+		err = s.executeFullReconcile()
+		if err == nil {
+			err = config.MarkBalanceReconciled(s.db)
+		}
+	} else {
+		err = s.executeIncrementalSync(pairs)
+	}
+
+	if err != nil {
+		if releaseErr := config.ReleaseBalancePairs(s.db, s.runID); releaseErr != nil {
+			fmt.Printf("⚠️ Warning: %v\n", releaseErr)
+		}
+		return err
+	}
+	return config.AckBalancePairs(s.db, s.runID)
+}
+
+// executeIncrementalSync คำนวณยอดคงเหลือใหม่เฉพาะคู่สินค้า/คลังที่จองไว้ แล้วส่งไปยัง API เป็นชุด ชุดละหนึ่ง transaction
+func (s *BalanceSyncStep) executeIncrementalSync(pairs []config.BalancePair) error {
+	if len(pairs) == 0 {
+		fmt.Println("✅ ไม่มีการเปลี่ยนแปลงของ balance ตั้งแต่รอบก่อน")
+		return nil
+	}
+
+	balances, err := s.GetBalanceForClaimedPairs()
 	if err != nil {
 		return fmt.Errorf("error getting local balance data: %v", err)
 	}
 
-	if len(localData) == 0 {
-		fmt.Println("ไม่มีข้อมูล balance ใน local database")
+	// ยอดบน server เก็บตาม location จึงต้องแทนที่ทุก location ที่มีคลังที่เปลี่ยน
+	if s.warehouses.Enabled() {
+		pairs = s.warehouses.LocationPairs(pairs)
+	}
+
+	err = s.apiClient.SyncBalanceChanges(pairs, balances, s.batchSize)
+	if err != nil {
+		return fmt.Errorf("error syncing balance changes to API: %w", err)
+	}
+
+	fmt.Printf("✅ ซิงค์ข้อมูล balance ที่เปลี่ยนแปลงเรียบร้อยแล้ว: %d คู่สินค้า/คลัง, %d รายการ\n", len(pairs), len(balances))
+	return nil
+}
+
+// executeFullReconcile เทียบ checksum ของ ic_balance แยกตามกลุ่มของ ic_code ระหว่าง local และ server
+// แล้วดึงและเทียบเฉพาะแถวของกลุ่มที่ไม่ตรงกัน ถ้าคำนวณ checksum ไม่ได้จะเทียบทั้งตารางแบบเดิม
+func (s *BalanceSyncStep) executeFullReconcile() error {
+	fmt.Printf("กำลังเทียบ checksum ของ balance (%d กลุ่ม)...\n", s.checksumBuckets)
+	serverChecksums, err := s.apiClient.GetBalanceChecksums(s.checksumBuckets)
+	if errors.Is(err, config.ErrCircuitOpen) {
+		return err
+	}
+	if err != nil {
+		fmt.Printf("⚠️ Warning: ไม่สามารถคำนวณ checksum บน server: %v (จะเทียบทั้งตาราง)\n", err)
+		return s.executeFullDiff()
+	}
+	localChecksums, err := s.getLocalBalanceChecksums()
+	if err != nil {
+		fmt.Printf("⚠️ Warning: ไม่สามารถคำนวณ checksum บน local: %v (จะเทียบทั้งตาราง)\n", err)
+		return s.executeFullDiff()
+	}
+
+	buckets := config.MismatchedBalanceBuckets(localChecksums, serverChecksums)
+	if len(buckets) == 0 {
+		fmt.Println("✅ checksum ของ balance ตรงกันทุกกลุ่ม ไม่มีข้อมูลที่ต้องซิงค์")
 		return nil
 	}
-	fmt.Printf("ดึงข้อมูล balance จาก local ได้ %d รายการ\n", len(localData))
-	// 3. ซิงค์ข้อมูลโดยส่งทั้งหมดแบบ batch 
-	fmt.Println("กำลังซิงค์ข้อมูล balance...")
-	fmt.Printf("📦 จะประมวลผลข้อมูล %d รายการ\n", len(localData))
+	fmt.Printf("🔍 พบ %d/%d กลุ่มที่ checksum ไม่ตรงกัน\n", len(buckets), s.checksumBuckets)
 
-	// แสดงตัวอย่างข้อมูลรายการแรก
-	if len(localData) > 0 {
-		fmt.Printf("ตัวอย่างข้อมูลรายการแรก: %v\n", localData[0])
-	} 
-	totalCount, err := s.apiClient.SyncInventoryBalanceData(localData)
+	totalCount, err := s.streamBalanceDiff(
+		"AND "+config.BalanceBucketFilter("itd.item_code", buckets, s.checksumBuckets),
+		config.BalanceBucketFilter("ic_code", buckets, s.checksumBuckets))
 	if err != nil {
-		return fmt.Errorf("error syncing balance data to API: %v", err)
+		return err
+	}
+
+	fmt.Printf("✅ ซิงค์ข้อมูล balance เรียบร้อยแล้ว\n")
+	fmt.Printf("📊 สถิติการซิงค์ balance:\n")
+	fmt.Printf("   - กลุ่มที่ไม่ตรงกัน: %d จาก %d กลุ่ม\n", len(buckets), s.checksumBuckets)
+	fmt.Printf("   - ข้อมูลที่ซิงค์: %d รายการ (แบบ batch)\n", totalCount)
+
+	return nil
+}
+
+// getLocalBalanceChecksums คำนวณ checksum ของยอดคงเหลือบน local แยกตามกลุ่ม ด้วยสูตรเดียวกับ GetBalanceChecksums
+func (s *BalanceSyncStep) getLocalBalanceChecksums() (map[int]string, error) {
+	source := "(" + s.balanceQuery("") + ") balances"
+	query := config.BalanceChecksumQuery(source, "ic_code", "warehouse", "ic_unit_code", "balance_qty", "available_qty", s.checksumBuckets)
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing balance checksum query: %v", err)
+	}
+	defer rows.Close()
+
+	checksums := make(map[int]string)
+	for rows.Next() {
+		var bucket int
+		var checksum string
+		if err := rows.Scan(&bucket, &checksum); err != nil {
+			return nil, fmt.Errorf("error scanning balance checksum: %v", err)
+		}
+		checksums[bucket] = checksum
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating balance checksums: %v", err)
 	}
-		
+	return checksums, nil
+}
 
+// executeFullDiff เทียบยอดคงเหลือทั้งหมดจาก local กับ ic_balance ทั้งตารางบน server
+// ใช้เมื่อเทียบ checksum ไม่ได้
+func (s *BalanceSyncStep) executeFullDiff() error {
+	totalCount, err := s.streamBalanceDiff("", "")
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("✅ ซิงค์ข้อมูล balance เรียบร้อยแล้ว\n")
 	fmt.Printf("📊 สถิติการซิงค์ balance:\n")
@@ -66,40 +208,152 @@ func (s *BalanceSyncStep) ExecuteBalanceSync() error {
 	return nil
 }
 
-// GetAllBalanceFromSource ดึงข้อมูล balance ทั้งหมดจากฐานข้อมูลต้นทาง
-func (s *BalanceSyncStep) GetAllBalanceFromSource() ([]interface{}, error) {
-	query := `
+// streamBalanceDiff อ่านยอดคงเหลือจาก local ทีละแถว (เรียงตาม key แบบ COLLATE "C") แล้วเทียบกับ ic_balance บน server แบบ merge-join
+// localFilter คือเงื่อนไขของ ic_trans_detail และ serverFilter คือเงื่อนไขของ ic_balance ที่เลือกแถวชุดเดียวกัน
+// ไม่มีการเก็บยอดทั้งตารางไว้ใน memory
+func (s *BalanceSyncStep) streamBalanceDiff(localFilter, serverFilter string) (int, error) {
+	query := fmt.Sprintf(`
+		SELECT * FROM (%s) balances
+		ORDER BY ic_code COLLATE "C", warehouse COLLATE "C", ic_unit_code COLLATE "C"
+	`, s.balanceQuery(localFilter))
+
+	fmt.Println("กำลังดึงข้อมูล balance จาก ic_trans_detail และ ic_inventory (แบบ stream)...")
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return 0, fmt.Errorf("error executing balance query: %v", err)
+	}
+	defer rows.Close()
+
+	source := func() (map[string]interface{}, error) {
+		for rows.Next() {
+			balance, err := scanBalance(rows)
+			if err != nil {
+				fmt.Printf("⚠️ ข้ามรายการที่อ่านไม่ได้: %v\n", err)
+				continue
+			}
+			return balance, nil
+		}
+		return nil, rows.Err()
+	}
+
+	fmt.Println("กำลังซิงค์ข้อมูล balance...")
+	totalCount, err := s.apiClient.SyncInventoryBalanceData(source, serverFilter, s.batchSize)
+	if err != nil {
+		return totalCount, fmt.Errorf("error syncing balance data to API: %v", err)
+	}
+	return totalCount, nil
+}
+
+// GetBalanceForClaimedPairs ดึงข้อมูล balance เฉพาะคู่สินค้า/คลังที่ run นี้จองไว้ใน sml_market_balance_sync
+// คู่ที่ยอดเป็น 0 จะไม่อยู่ในผลลัพธ์ (จะถูกลบบน server)
+// เมื่อจับคู่คลังกับ location จะคำนวณทุก location ของสินค้าที่จองไว้ เพราะ location หนึ่งรวมยอดจากหลายคลัง
+func (s *BalanceSyncStep) GetBalanceForClaimedPairs() ([]interface{}, error) {
+	if s.warehouses.Enabled() {
+		return s.queryBalances(`AND itd.item_code IN (
+			SELECT item_code FROM sml_market_balance_sync WHERE claim_run_id = $1
+		  )`, s.runID)
+	}
+	return s.queryBalances(`AND (itd.item_code, itd.wh_code) IN (
+			SELECT item_code, wh_code FROM sml_market_balance_sync WHERE claim_run_id = $1
+		  )`, s.runID)
+}
+
+// balanceQuery คืนคำสั่งที่คำนวณยอดคงเหลือที่จะส่ง โดยเพิ่มเงื่อนไข filter ต่อท้าย WHERE ของ ic_trans_detail
+// ถ้าเปิด sellable_units จะแปลงยอดของ unit_standard เป็นทุกหน่วยที่มีบาร์โค้ดตามอัตราส่วนใน ic_unit_use
+// (1 หน่วย = stand_value / divide_value ของ unit_standard) หน่วยที่เพิ่งมีบาร์โค้ดจะถูกส่งในรอบ full reconcile
+func (s *BalanceSyncStep) balanceQuery(filter string) string {
+	if !s.sellableUnits {
+		return s.locationBalanceQuery(filter)
+	}
+
+	available := "ROUND(b.available_qty * u.divide_value / u.stand_value, 3)"
+	if s.floorPartialUnits {
+		available = "CASE WHEN u.is_standard THEN b.available_qty ELSE FLOOR(b.available_qty * u.divide_value / u.stand_value) END"
+	}
+	return fmt.Sprintf(`
+		SELECT
+			b.ic_code,
+			b.warehouse,
+			u.unit_code AS ic_unit_code,
+			ROUND(b.balance_qty * u.divide_value / u.stand_value, 3) AS balance_qty,
+			%s AS available_qty
+		FROM (%s) b
+		INNER JOIN (
+			SELECT ii.code AS ic_code, ii.unit_standard AS unit_code, 1::NUMERIC AS stand_value, 1::NUMERIC AS divide_value, TRUE AS is_standard
+			FROM ic_inventory ii
+			UNION ALL
+			SELECT iu.ic_code, iu.code, iu.stand_value, iu.divide_value, FALSE
+			FROM ic_unit_use iu
+			INNER JOIN ic_inventory ii ON ii.code = iu.ic_code AND iu.code <> ii.unit_standard
+			WHERE iu.stand_value > 0 AND iu.divide_value > 0
+			  AND EXISTS (SELECT 1 FROM ic_inventory_barcode ib WHERE ib.ic_code = iu.ic_code AND ib.unit_code = iu.code)
+		) u ON u.ic_code = b.ic_code
+		ORDER BY b.ic_code, b.warehouse, u.unit_code
+	`, available, s.locationBalanceQuery(filter))
+}
+
+// locationBalanceQuery คืนคำสั่งที่คำนวณยอดคงเหลือใน unit_standard ของแต่ละคลังหรือ location
+// ถ้าตั้งค่า warehouses ไว้ จะส่งเฉพาะคลังที่ถูกจับคู่ รวมยอดตาม location และแบ่ง balance_qty และ available_qty ตาม split_percent
+// location ที่ได้ส่วนแบ่งเป็น 0 จะไม่อยู่ในผลลัพธ์ (จะถูกลบบน server)
+func (s *BalanceSyncStep) locationBalanceQuery(filter string) string {
+	if !s.warehouses.Enabled() {
+		return s.warehouseBalanceQuery(filter)
+	}
+	return fmt.Sprintf(`
+		SELECT
+			b.ic_code,
+			m.location AS warehouse,
+			b.ic_unit_code,
+			ROUND(SUM(b.balance_qty) * m.split_percent / 100, 3) AS balance_qty,
+			ROUND(SUM(b.available_qty) * m.split_percent / 100, 3) AS available_qty
+		FROM (%s) b
+		INNER JOIN (%s) AS m(wh_code, location, split_percent) ON m.wh_code = b.warehouse
+		GROUP BY b.ic_code, m.location, b.ic_unit_code, m.split_percent
+		HAVING ROUND(SUM(b.balance_qty) * m.split_percent / 100, 3) <> 0
+		ORDER BY b.ic_code, m.location
+	`, s.warehouseBalanceQuery(filter+"\n\t\t  AND "+s.warehouses.WhCodeFilter("itd.wh_code")), s.warehouses.MappingValues())
+}
+
+// warehouseBalanceQuery คืนคำสั่งที่คำนวณยอดคงเหลือของแต่ละคลัง SML จาก ic_trans_detail ตาม stock_rules
+// available_qty คือยอดคงเหลือหักยอดจองและ safety stock ตาม availability (ไม่ต่ำกว่า 0)
+func (s *BalanceSyncStep) warehouseBalanceQuery(filter string) string {
+	return fmt.Sprintf(`
 		SELECT 
 			itd.item_code AS ic_code,
 			itd.wh_code AS warehouse,
 			ii.unit_standard AS ic_unit_code,
 			COALESCE(SUM(itd.calc_flag * (
-				CASE WHEN ((itd.trans_flag IN (70,54,60,58,310,12) OR (itd.trans_flag=66 AND itd.qty>0) OR (itd.trans_flag=14 AND itd.inquiry_type=0) OR (itd.trans_flag=48 AND itd.inquiry_type < 2)) 
-						  OR (itd.trans_flag IN (56,68,72,44) OR (itd.trans_flag=66 AND itd.qty<0) OR (itd.trans_flag=46 AND itd.inquiry_type IN (0,2))  
-							  OR (itd.trans_flag=16 AND itd.inquiry_type IN (0,2)) OR (itd.trans_flag=311 AND itd.inquiry_type=0)) 
-						  AND NOT (itd.doc_ref <> '' AND itd.is_pos = 1))
-					 THEN ROUND((itd.qty*itd.stand_value) / itd.divide_value, 2) 
-					 ELSE 0 
-				END)), 0) AS balance_qty
+				%[1]s
+				)), 0) AS balance_qty,
+			GREATEST(COALESCE(SUM(itd.calc_flag * (
+				%[1]s
+				)), 0)
+				- COALESCE(SUM(%[3]s), 0)
+				- %[4]s, 0) AS available_qty
 		FROM ic_trans_detail itd
 		INNER JOIN ic_inventory ii ON ii.code = itd.item_code AND ii.item_type NOT IN (1,3)
+		%[5]s
 		WHERE itd.last_status = 0 
 		  AND itd.item_type <> 5  
 		  AND itd.is_doc_copy = 0
-		GROUP BY itd.item_code, itd.wh_code, ii.unit_standard
+		  %[2]s
+		GROUP BY itd.item_code, itd.wh_code, ii.unit_standard, ii.group_main
 		HAVING COALESCE(SUM(itd.calc_flag * (
-			CASE WHEN ((itd.trans_flag IN (70,54,60,58,310,12) OR (itd.trans_flag=66 AND itd.qty>0) OR (itd.trans_flag=14 AND itd.inquiry_type=0) OR (itd.trans_flag=48 AND itd.inquiry_type < 2)) 
-					  OR (itd.trans_flag IN (56,68,72,44) OR (itd.trans_flag=66 AND itd.qty<0) OR (itd.trans_flag=46 AND itd.inquiry_type IN (0,2))  
-						  OR (itd.trans_flag=16 AND itd.inquiry_type IN (0,2)) OR (itd.trans_flag=311 AND itd.inquiry_type=0)) 
-					  AND NOT (itd.doc_ref <> '' AND itd.is_pos = 1))
-				 THEN ROUND((itd.qty*itd.stand_value) / itd.divide_value, 2) 
-				 ELSE 0 
-			END)), 0) <> 0
+			%[1]s
+			)), 0) <> 0
 		ORDER BY itd.item_code, itd.wh_code
-	`
+	`, s.stockRules.QuantityExpr("itd"), filter,
+		s.availability.ReservedExpr("itd"),
+		s.availability.SafetyStockExpr("itd.item_code", "ii.group_main", "itd.wh_code"),
+		s.availability.ReservedJoin("itd"))
+}
+
+// queryBalances คำนวณยอดคงเหลือจาก ic_trans_detail โดยเพิ่มเงื่อนไข filter ต่อท้าย WHERE
+func (s *BalanceSyncStep) queryBalances(filter string, args ...interface{}) ([]interface{}, error) {
+	query := s.balanceQuery(filter)
 
 	fmt.Println("กำลังดึงข้อมูล balance จาก ic_trans_detail และ ic_inventory...")
-	rows, err := s.db.Query(query)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("error executing balance query: %v", err)
 	}
@@ -109,35 +363,12 @@ func (s *BalanceSyncStep) GetAllBalanceFromSource() ([]interface{}, error) {
 	count := 0
 
 	for rows.Next() {
-		var balance types.BalanceItem
-		var balanceQtyStr string
-
-		err := rows.Scan(
-			&balance.IcCode,
-			&balance.Warehouse,
-			&balance.UnitCode,
-			&balanceQtyStr,
-		)
+		balanceMap, err := scanBalance(rows)
 		if err != nil {
 			fmt.Printf("⚠️ ข้ามรายการที่อ่านไม่ได้: %v\n", err)
 			continue
 		}
 
-		// แปลง balance_qty จาก string เป็น float64
-		balanceQty, err := strconv.ParseFloat(balanceQtyStr, 64)
-		if err != nil {
-			fmt.Printf("⚠️ ข้ามรายการที่แปลง balance_qty ไม่ได้: %s -> %v\n", balanceQtyStr, err)
-			continue
-		}
-		balance.BalanceQty = balanceQty
-		// แปลงเป็น map สำหรับ API
-		balanceMap := map[string]interface{}{
-			"ic_code":      balance.IcCode,
-			"warehouse":    balance.Warehouse, // Field name in API is 'warehouse'
-			"ic_unit_code": balance.UnitCode,  // Field name in API is 'ic_unit_code'
-			"balance_qty":  balance.BalanceQty,
-		}
-
 		balances = append(balances, balanceMap)
 		count++
 
@@ -160,3 +391,41 @@ func (s *BalanceSyncStep) GetAllBalanceFromSource() ([]interface{}, error) {
 
 	return balances, nil
 }
+
+// scanBalance อ่านยอดคงเหลือหนึ่งแถวจากผลของ balanceQuery แล้วแปลงเป็น map สำหรับ API
+func scanBalance(rows *sql.Rows) (map[string]interface{}, error) {
+	var balance types.BalanceItem
+	var balanceQtyStr, availableQtyStr string
+
+	err := rows.Scan(
+		&balance.IcCode,
+		&balance.Warehouse,
+		&balance.UnitCode,
+		&balanceQtyStr,
+		&availableQtyStr,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// แปลง balance_qty จาก string เป็น float64
+	balanceQty, err := strconv.ParseFloat(balanceQtyStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("แปลง balance_qty ไม่ได้: %s -> %v", balanceQtyStr, err)
+	}
+	balance.BalanceQty = balanceQty
+	availableQty, err := strconv.ParseFloat(availableQtyStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("แปลง available_qty ไม่ได้: %s -> %v", availableQtyStr, err)
+	}
+	balance.AvailableQty = availableQty
+
+	// แปลงเป็น map สำหรับ API
+	return map[string]interface{}{
+		"ic_code":       balance.IcCode,
+		"warehouse":     balance.Warehouse, // Field name in API is 'warehouse'
+		"ic_unit_code":  balance.UnitCode,  // Field name in API is 'ic_unit_code'
+		"balance_qty":   balance.BalanceQty,
+		"available_qty": balance.AvailableQty,
+	}, nil
+}
@@ -5,19 +5,19 @@ import (
 	"fmt"
 	"smlmarketsync/config"
 	"smlmarketsync/types"
-	"strings"
-	"time"
 )
 
 type CustomerSyncStep struct {
 	db        *sql.DB
 	apiClient *config.APIClient
+	runID     string
 }
 
-func NewCustomerSyncStep(db *sql.DB) *CustomerSyncStep {
+func NewCustomerSyncStep(db *sql.DB, apiClient *config.APIClient) *CustomerSyncStep {
 	return &CustomerSyncStep{
 		db:        db,
-		apiClient: config.NewAPIClient(),
+		apiClient: apiClient,
+		runID:     config.RunID(),
 	}
 }
 
@@ -33,94 +33,71 @@ func (s *CustomerSyncStep) ExecuteCustomerSync() error {
 	}
 	fmt.Println("✅ ตรวจสอบ/สร้างตาราง ar_customer เรียบร้อยแล้ว")
 
-	// 2. ดึงข้อมูลลูกค้าจาก local database ผ่าน sml_market_sync
+	// 2. จองข้อมูลลูกค้าจาก sml_market_sync ทีละชุดตามลำดับ id แล้วซิงค์ไปยัง API จนหมด
 	fmt.Println("กำลังดึงข้อมูลลูกค้าจากฐานข้อมูล local...")
-	syncIds, inserts, updates, deletes, err := s.GetAllCustomersFromSource()
+	claimed, err := config.ProcessSyncRecords(s.db, 4, s.runID, s.syncCustomerRecords)
 	if err != nil {
-		return fmt.Errorf("error getting local customer data: %v", err)
+		return err
 	}
-
-	if len(syncIds) == 0 {
+	if claimed == 0 {
 		fmt.Println("ไม่มีข้อมูลลูกค้าใน local database")
 		return nil
 	}
+	fmt.Println("✅ ซิงค์ข้อมูลลูกค้าเรียบร้อยแล้ว")
+	return nil
+}
+
+// syncCustomerRecords ส่งการเปลี่ยนแปลงของแถวที่จองไว้ชุดหนึ่งไปยัง API แล้ว ack/release ตามผล
+func (s *CustomerSyncStep) syncCustomerRecords(records []types.SyncRecord) error {
+	// รวมหลายเหตุการณ์ของแถวเดียวกันให้เหลือการทำงานสุทธิ (id ทั้งหมดยังถูก ack ตาม records)
+	changes := config.CoalesceSyncRecords(records)
 
-	// 3. ลบข้อมูลใน sml_market_sync ที่ถูกซิงค์แล้วแบบ batch
-	err = s.DeleteSyncRecordsInBatches(syncIds, 100) // ลบครั้งละ 100 รายการ
+	// 3. ซิงค์ข้อมูลไปยัง API (ทีละชุดตามลำดับเหตุการณ์)
+	fmt.Println("กำลังซิงค์ข้อมูลลูกค้าไปยัง API...")
+	result, applyErr := config.ApplySyncChanges(changes, "code", func(batch []types.SyncRecord) (*config.SyncResult, error) {
+		inserts, updates, deletes, err := s.GetAllCustomersFromSource(batch)
+		if err != nil {
+			return nil, fmt.Errorf("error getting local customer data: %v", err)
+		}
+		return s.apiClient.SyncCustomerData(inserts, updates, deletes), nil
+	})
+
+	// 4. ลบข้อมูลใน sml_market_sync เฉพาะรายการที่ API ยืนยันแล้ว รายการที่ไม่สำเร็จจะถูกปลดการจองไว้ส่งใหม่
+	err := config.FinishSyncRecords(s.db, s.runID, records, result)
 	if err != nil {
 		fmt.Printf("⚠️ Warning: %v\n", err)
-		// ทำงานต่อไปถึงแม้จะมีข้อผิดพลาด
 	}
-	// 4. ซิงค์ข้อมูลไปยัง API
-	fmt.Println("กำลังซิงค์ข้อมูลลูกค้าไปยัง API...")
-	err = s.apiClient.SyncCustomerData(inserts, updates, deletes) // ส่ง inserts, updates, deletes แยกกัน
-	if err != nil {
-		return fmt.Errorf("error syncing customer data to API: %v", err)
+	if applyErr != nil {
+		return applyErr
+	}
+	if err := result.Err(); err != nil {
+		fmt.Printf("⚠️ Warning: %v\n", err)
 	}
-	fmt.Println("✅ ซิงค์ข้อมูลลูกค้าเรียบร้อยแล้ว")
 	return nil
 }
 
 // GetAllCustomersFromSource ดึงข้อมูลลูกค้าทั้งหมดจากฐานข้อมูลต้นทาง ผ่าน sml_market_sync
-func (s *CustomerSyncStep) GetAllCustomersFromSource() ([]int, []interface{}, []interface{}, []interface{}, error) {
-	var syncIds []int
+// ใช้ snapshot ที่ trigger บันทึกไว้ถ้ามี ไม่เช่นนั้นจะอ่านแถวปัจจุบันจาก ar_customer
+func (s *CustomerSyncStep) GetAllCustomersFromSource(records []types.SyncRecord) ([]interface{}, []interface{}, []interface{}, error) {
 	var deletes []interface{}
 	var inserts []interface{}
 	var updates []interface{}
 
-	// ดึงข้อมูลจาก sml_market_sync สำหรับตาราง customer (table_id = 4)
-	querySync := "SELECT id, row_order_ref, active_code FROM sml_market_sync WHERE table_id = 4 ORDER BY active_code DESC"
-
-	rowsSync, errSync := s.db.Query(querySync)
-	if errSync != nil {
-		return nil, nil, nil, nil, fmt.Errorf("error executing customer sync query: %v", errSync)
-	}
-	defer rowsSync.Close()
-
-	for rowsSync.Next() {
-		var id, rowOrderRef, activeCode int
-		err := rowsSync.Scan(&id, &rowOrderRef, &activeCode)
+	for _, record := range records {
+		rowOrderRef, activeCode := record.RowOrderRef, record.ActiveCode
+		oldRow, err := config.DecodeSyncSnapshot(record.OldData)
 		if err != nil {
-			return nil, nil, nil, nil, fmt.Errorf("error scanning customer sync row: %v", err)
+			return nil, nil, nil, err
 		}
-		syncIds = append(syncIds, id)
 
 		if activeCode != 3 {
-			// ดึงข้อมูลลูกค้าจากตาราง ar_customer (local database)
-			queryGetData := `
-				SELECT roworder, code, price_level 
-				FROM ar_customer
-				WHERE roworder = $1 AND code IS NOT NULL AND code != ''
-			`
-			// log queryGetData (following price sync pattern)
-			fmt.Printf("Executing customer query: %s with rowOrderRef: %d\n", queryGetData, rowOrderRef)
-			row := s.db.QueryRow(queryGetData, rowOrderRef)
-
-			var customer types.CustomerItem
-			var priceLevel sql.NullString
-			err := row.Scan(
-				&customer.RowOrderRef,
-				&customer.Code,
-				&priceLevel,
-			)
+			customerMap, err := s.getCustomerMap(record)
 			if err != nil {
-				if err == sql.ErrNoRows {
-					fmt.Printf("⚠️ ไม่พบข้อมูลลูกค้าสำหรับ rowOrderRef: %d\n", rowOrderRef)
-					continue
-				}
-				return nil, nil, nil, nil, fmt.Errorf("error scanning customer row: %v", err)
+				return nil, nil, nil, err
 			}
-
-			// แปลง price_level
-			if priceLevel.Valid {
-				customer.PriceLevel = priceLevel.String
-			}
-
-			// แปลงเป็น map สำหรับ API
-			customerMap := map[string]interface{}{
-				"row_order_ref": customer.RowOrderRef,
-				"code":        customer.Code,
-				"price_level": customer.PriceLevel,
+			if customerMap == nil {
+				fmt.Printf("⚠️ ไม่พบข้อมูลลูกค้าสำหรับ rowOrderRef: %d\n", rowOrderRef)
+				continue
 			}
 
 			// แยกประเภทตาม active_code
@@ -129,96 +106,65 @@ func (s *CustomerSyncStep) GetAllCustomersFromSource() ([]int, []interface{}, []
 				inserts = append(inserts, customerMap)
 			}
 			if activeCode == 2 {
-				// activeCode = 2: DELETE บน server ก่อน แล้ว INSERT ใหม่ (ไม่ใช่ UPDATE)
-				deletes = append(deletes, customer.RowOrderRef) // ใช้ row_order_ref เป็น key ในการลบ
-				inserts = append(inserts, customerMap)   // เพิ่มเข้า inserts เพื่อ insert ใหม่
+				// activeCode = 2: upsert ตาม code (ถ้า code ถูกแก้ไข API จะลบแถวของ code เก่าเอง)
+				updates = append(updates, customerMap)
 			}
 		} else if activeCode == 3 {
-			deletes = append(deletes, rowOrderRef)
+			deletes = append(deletes, deleteItem(rowOrderRef, oldRow, "code", "code"))
 		}
 	}
 
-	return syncIds, inserts, updates, deletes, nil
+	return inserts, updates, deletes, nil
 }
 
-// DeleteSyncRecordsInBatches ลบข้อมูลจาก sml_market_sync ในฐานข้อมูลท้องถิ่นแบบแบ่งเป็น batch
-func (s *CustomerSyncStep) DeleteSyncRecordsInBatches(syncIds []int, batchSize int) error {
-	if len(syncIds) == 0 {
-		fmt.Println("✅ ไม่มีข้อมูลที่ต้องลบจาก sml_market_sync")
-		return nil
+// getCustomerMap สร้างข้อมูลลูกค้าสำหรับ API จาก snapshot หรือจาก ar_customer (คืนค่า nil ถ้าไม่พบหรือไม่มี code)
+func (s *CustomerSyncStep) getCustomerMap(record types.SyncRecord) (map[string]interface{}, error) {
+	newRow, err := config.DecodeSyncSnapshot(record.NewData)
+	if err != nil {
+		return nil, err
 	}
-
-	totalItems := len(syncIds)
-	fmt.Printf("🗑️ กำลังลบข้อมูลจากตาราง sml_market_sync (local database): %d รายการ (แบ่งเป็น batch ละ %d รายการ)\n",
-		totalItems, batchSize)
-
-	// แบ่งเป็น batch
-	batchCount := (totalItems + batchSize - 1) / batchSize
-	totalDeleted := 0
-	successBatches := 0
-	failedBatches := 0
-
-	for b := 0; b < batchCount; b++ {
-		start := b * batchSize
-		end := start + batchSize
-		if end > totalItems {
-			end = totalItems
-		}
-
-		batchIds := syncIds[start:end]
-		currentBatchSize := len(batchIds)
-
-		fmt.Printf("   🔄 กำลังลบ batch ที่ %d/%d (รายการ %d-%d) จากทั้งหมด %d รายการ\n",
-			b+1, batchCount, start+1, end, totalItems)
-
-		// สร้าง query และ parameter placeholders
-		placeholders := make([]string, len(batchIds))
-		args := make([]interface{}, len(batchIds))
-
-		for i, id := range batchIds {
-			placeholders[i] = fmt.Sprintf("$%d", i+1)
-			args[i] = id
+	if newRow != nil {
+		code := snapshotString(newRow, "code")
+		if code == "" {
+			return nil, nil
 		}
-		// สร้างคำสั่ง DELETE
-		query := fmt.Sprintf("DELETE FROM sml_market_sync WHERE id IN (%s)",
-			strings.Join(placeholders, ", "))
-
-		// ทำการลบข้อมูล
-		result, err := s.db.Exec(query, args...)
-		if err != nil {
-			fmt.Printf("   ❌ ERROR: ไม่สามารถลบข้อมูล batch ที่ %d จาก sml_market_sync ได้: %v\n",
-				b+1, err)
-			failedBatches++
-			// ทำ batch ต่อไป
-			continue
-		}
-
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			fmt.Printf("   ⚠️ Warning: ไม่สามารถอ่านจำนวนแถวที่ถูกลบได้: %v\n", err)
-			// ใช้ขนาดของ batch แทน
-			rowsAffected = int64(currentBatchSize)
-		}
-
-		totalDeleted += int(rowsAffected)
-		successBatches++
-		fmt.Printf("   ✅ ลบข้อมูล batch ที่ %d จาก sml_market_sync สำเร็จ: %d รายการ\n",
-			b+1, rowsAffected)
+		return map[string]interface{}{
+			"row_order_ref": record.RowOrderRef,
+			"code":          code,
+			"price_level":   snapshotString(newRow, "price_level"),
+		}, nil
+	}
 
-		// หน่วงเวลาเล็กน้อยระหว่าง batch เพื่อลดภาระของ database
-		if b < batchCount-1 {
-			time.Sleep(100 * time.Millisecond)
+	// แถวที่บันทึกก่อนมี snapshot: ดึงข้อมูลลูกค้าจากตาราง ar_customer (local database)
+	queryGetData := `
+		SELECT roworder, code, price_level 
+		FROM ar_customer
+		WHERE roworder = $1 AND code IS NOT NULL AND code != ''
+	`
+	row := s.db.QueryRow(queryGetData, record.RowOrderRef)
+
+	var customer types.CustomerItem
+	var priceLevel sql.NullString
+	err = row.Scan(
+		&customer.RowOrderRef,
+		&customer.Code,
+		&priceLevel,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
+		return nil, fmt.Errorf("error scanning customer row: %v", err)
 	}
 
-	// สรุปผลการดำเนินการ
-	if failedBatches > 0 {
-		fmt.Printf("⚠️ สรุปการลบข้อมูลจาก sml_market_sync: ลบได้ %d/%d รายการ (%d/%d batches สำเร็จ)\n",
-			totalDeleted, totalItems, successBatches, batchCount)
-		return fmt.Errorf("มีบาง batch ที่ลบไม่สำเร็จ (%d/%d batches ล้มเหลว)",
-			failedBatches, batchCount)
+	// แปลง price_level
+	if priceLevel.Valid {
+		customer.PriceLevel = priceLevel.String
 	}
-	fmt.Printf("✅ ลบข้อมูลจาก sml_market_sync เรียบร้อยแล้ว: %d รายการ (%d batches)\n",
-		totalDeleted, batchCount)
-	return nil
+
+	return map[string]interface{}{
+		"row_order_ref": customer.RowOrderRef,
+		"code":          customer.Code,
+		"price_level":   customer.PriceLevel,
+	}, nil
 }
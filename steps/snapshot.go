@@ -0,0 +1,90 @@
+package steps
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Helper สำหรับอ่านค่าจาก snapshot ของแถว (new_data/old_data ใน sml_market_sync)
+// ค่า NULL จะถูกแปลงเป็นค่าว่างแบบเดียวกับ COALESCE ใน query เดิม
+
+func snapshotString(row map[string]interface{}, key string) string {
+	value, ok := row[key]
+	if !ok || value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func snapshotFloat(row map[string]interface{}, key string) float64 {
+	switch v := row[key].(type) {
+	case float64:
+		return v
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			return f
+		}
+	}
+	return 0
+}
+
+func snapshotInt(row map[string]interface{}, key string) int {
+	return int(snapshotFloat(row, key))
+}
+
+// snapshotDefault คืนค่า def ถ้า string ว่าง
+func snapshotDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// deleteItem สร้างรายการลบที่มี row_order_ref และ natural key จาก snapshot ของแถวก่อนลบ (ถ้ามี)
+func deleteItem(rowOrderRef int, oldRow map[string]interface{}, keyColumn string, remoteColumn string) interface{} {
+	item := map[string]interface{}{"row_order_ref": rowOrderRef}
+	if oldRow != nil {
+		if key := snapshotString(oldRow, keyColumn); key != "" {
+			item[remoteColumn] = key
+		}
+	}
+	return item
+}
+
+// snapshotDeleteItem สร้างรายการลบสำหรับตารางที่ natural key มีหลาย column
+// ถ้ามี snapshot ของแถวก่อนลบ รายการจะมีทุก column ตาม snapshotMap ไม่เช่นนั้นมีแค่ row_order_ref แบบ deleteItem
+func snapshotDeleteItem(rowOrderRef int, oldRow map[string]interface{}, snapshotMap func(int, map[string]interface{}) map[string]interface{}) interface{} {
+	if oldRow == nil {
+		return deleteItem(rowOrderRef, nil, "", "")
+	}
+	return snapshotMap(rowOrderRef, oldRow)
+}
+
+// keyStillExists ตรวจว่ายังมีแถวอื่นใน tableName ที่ natural key ตรงกับ snapshot ของแถวที่ถูกลบหรือไม่
+// SML อาจมีหลายแถวที่ key ซ้ำกันซึ่งบน server ถูก upsert รวมเป็นแถวเดียว ถ้ายังเหลือแถวอื่นอยู่ต้องไม่ลบแถวบน server
+// textColumns เทียบเป็นข้อความ (NULL เท่ากับค่าว่าง) ส่วน numberColumns เทียบเป็นตัวเลข (NULL เท่ากับ 0)
+func keyStillExists(db *sql.DB, tableName string, rowOrderRef int, oldRow map[string]interface{}, textColumns []string, numberColumns []string) (bool, error) {
+	conditions := []string{"roworder <> $1"}
+	args := []interface{}{rowOrderRef}
+	for _, column := range textColumns {
+		args = append(args, snapshotString(oldRow, column))
+		conditions = append(conditions, fmt.Sprintf("COALESCE(%s::text, '') = $%d", column, len(args)))
+	}
+	for _, column := range numberColumns {
+		args = append(args, snapshotFloat(oldRow, column))
+		conditions = append(conditions, fmt.Sprintf("COALESCE(%s, 0) = $%d", column, len(args)))
+	}
+
+	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE %s)", tableName, strings.Join(conditions, " AND "))
+	var exists bool
+	if err := db.QueryRow(query, args...).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error checking remaining rows of %s: %v", tableName, err)
+	}
+	return exists, nil
+}
@@ -44,10 +44,11 @@ type BarcodeItem struct {
 
 // BalanceItem สำหรับข้อมูล ic_balance
 type BalanceItem struct {
-	IcCode     string  `json:"ic_code"`
-	Warehouse  string  `json:"warehouse"`    // wh_code in database
-	UnitCode   string  `json:"ic_unit_code"` // unit_code in database
-	BalanceQty float64 `json:"balance_qty"`
+	IcCode       string  `json:"ic_code"`
+	Warehouse    string  `json:"warehouse"`    // wh_code in database
+	UnitCode     string  `json:"ic_unit_code"` // unit_code in database
+	BalanceQty   float64 `json:"balance_qty"`
+	AvailableQty float64 `json:"available_qty"` // balance_qty หักยอดจองและ safety stock
 }
 
 // CustomerItem สำหรับข้อมูล ar_customer
@@ -96,3 +97,14 @@ type PriceFormulaItem struct {
 	PriceCurrency int    `json:"price_currency"`
 	CurrencyCode  string `json:"currency_code"`
 }
+
+// SyncRecord แถวใน sml_market_sync ที่ถูกจอง (claim) ไว้โดย run ปัจจุบัน
+// NewData/OldData เป็น snapshot (JSON) ของแถวจาก trigger ถ้าเป็นแถวที่บันทึกก่อนมี snapshot จะเป็น nil
+type SyncRecord struct {
+	ID          int    `json:"id"`
+	TableID     int    `json:"table_id"`
+	ActiveCode  int    `json:"active_code"`
+	RowOrderRef int    `json:"row_order_ref"`
+	NewData     []byte `json:"new_data,omitempty"`
+	OldData     []byte `json:"old_data,omitempty"`
+}